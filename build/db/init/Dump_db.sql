@@ -13,6 +13,8 @@ CREATE TABLE `users`
         `last_name` VARCHAR(191) NULL,
         `email` VARCHAR(191) NOT NULL,
         `password` VARCHAR(191) NOT NULL,
+        `password_changed_at` DATETIME(3) NULL,
+        `role` VARCHAR(32) NOT NULL DEFAULT 'user',
         `email_verified_at` DATETIME(3) NULL,
         `created_at` DATETIME(3) NOT NULL,
         `updated_at` DATETIME(3) NOT NULL,
@@ -33,6 +35,10 @@ CREATE TABLE `tokens`
         `user_id` VARCHAR(36) NOT NULL,
         `token` VARCHAR(191) NOT NULL,
         `token_hash` BLOB NOT NULL,
+        `password_change_only` TINYINT(1) NOT NULL DEFAULT 0,
+        `scopes` VARCHAR(1024) NOT NULL DEFAULT '',
+        `client_id` VARCHAR(64) NULL,
+        `impersonator_id` VARCHAR(36) NULL,
         `created_at` DATETIME(3) NOT NULL,
         `updated_at` DATETIME(3) NOT NULL,
         `expire_at` DATETIME(3) NOT NULL,
@@ -43,8 +49,289 @@ CREATE TABLE `tokens`
             FOREIGN KEY (`user_id`) 
             REFERENCES `users` (`user_id`)
             ON UPDATE CASCADE
+            ON DELETE CASCADE,
+        CONSTRAINT `FK_tokens_impersonator_id`
+            FOREIGN KEY (`impersonator_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+DROP TABLE IF EXISTS `password_history`;
+CREATE TABLE `password_history`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `user_id` VARCHAR(36) NOT NULL,
+        `password` VARCHAR(191) NOT NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        INDEX `IDX_password_history_user_id` (`user_id`, `created_at`),
+        CONSTRAINT `FK_password_history_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+DROP TABLE IF EXISTS `api_keys`;
+CREATE TABLE `api_keys`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `user_id` VARCHAR(36) NOT NULL,
+        `name` VARCHAR(191) NOT NULL,
+        `prefix` VARCHAR(32) NOT NULL,
+        `secret_hash` BLOB NOT NULL,
+        `scopes` VARCHAR(1024) NOT NULL DEFAULT '',
+        `last_used_at` DATETIME(3) NULL,
+        `expire_at` DATETIME(3) NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        `updated_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_api_keys_prefix`
+            UNIQUE (`prefix`),
+        CONSTRAINT `UK_api_keys_name`
+            UNIQUE (`user_id`, `name`),
+        CONSTRAINT `FK_api_keys_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
             ON DELETE CASCADE
     )
     DEFAULT CHARACTER SET `utf8mb4`
     COLLATE `utf8mb4_unicode_ci`
-;
\ No newline at end of file
+;
+
+DROP TABLE IF EXISTS `oauth_clients`;
+CREATE TABLE `oauth_clients`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `client_id` VARCHAR(64) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `name` VARCHAR(191) NOT NULL,
+        `secret_hash` BLOB NULL,
+        `redirect_uris` TEXT NOT NULL,
+        `scopes` VARCHAR(1024) NOT NULL DEFAULT '',
+        `created_at` DATETIME(3) NOT NULL,
+        `updated_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_oauth_clients_client_id`
+            UNIQUE (`client_id`),
+        CONSTRAINT `FK_oauth_clients_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+DROP TABLE IF EXISTS `oauth_authorization_codes`;
+CREATE TABLE `oauth_authorization_codes`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `code_hash` BINARY(32) NOT NULL,
+        `client_id` VARCHAR(64) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `redirect_uri` VARCHAR(1024) NOT NULL,
+        `scopes` VARCHAR(1024) NOT NULL DEFAULT '',
+        `code_challenge` VARCHAR(128) NOT NULL DEFAULT '',
+        `code_challenge_method` VARCHAR(16) NOT NULL DEFAULT '',
+        `nonce` VARCHAR(255) NOT NULL DEFAULT '',
+        `created_at` DATETIME(3) NOT NULL,
+        `expire_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_oauth_authorization_codes_code_hash`
+            UNIQUE (`code_hash`),
+        CONSTRAINT `FK_oauth_authorization_codes_client_id`
+            FOREIGN KEY (`client_id`)
+            REFERENCES `oauth_clients` (`client_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE,
+        CONSTRAINT `FK_oauth_authorization_codes_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+DROP TABLE IF EXISTS `oauth_refresh_tokens`;
+CREATE TABLE `oauth_refresh_tokens`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `token_hash` BINARY(32) NOT NULL,
+        `client_id` VARCHAR(64) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `scopes` VARCHAR(1024) NOT NULL DEFAULT '',
+        `created_at` DATETIME(3) NOT NULL,
+        `expire_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_oauth_refresh_tokens_token_hash`
+            UNIQUE (`token_hash`),
+        CONSTRAINT `FK_oauth_refresh_tokens_client_id`
+            FOREIGN KEY (`client_id`)
+            REFERENCES `oauth_clients` (`client_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE,
+        CONSTRAINT `FK_oauth_refresh_tokens_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+DROP TABLE IF EXISTS `federated_identities`;
+CREATE TABLE `federated_identities`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `provider` VARCHAR(64) NOT NULL,
+        `subject` VARCHAR(255) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `email` VARCHAR(191) NOT NULL DEFAULT '',
+        `created_at` DATETIME(3) NOT NULL,
+        `updated_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_federated_identities`
+            UNIQUE (`provider`, `subject`),
+        CONSTRAINT `FK_federated_identities_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+DROP TABLE IF EXISTS `federated_login_states`;
+CREATE TABLE `federated_login_states`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `state_hash` BINARY(32) NOT NULL,
+        `provider` VARCHAR(64) NOT NULL,
+        `nonce` VARCHAR(64) NOT NULL,
+        `code_verifier` VARCHAR(128) NOT NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        `expire_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_federated_login_states_state_hash`
+            UNIQUE (`state_hash`)
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+DROP TABLE IF EXISTS `audit_events`;
+CREATE TABLE `audit_events`
+    (
+        `id` BIGINT NOT NULL AUTO_INCREMENT,
+        `event_type` VARCHAR(64) NOT NULL,
+        `actor_id` VARCHAR(36) NOT NULL DEFAULT '',
+        `impersonator_id` VARCHAR(36) NOT NULL DEFAULT '',
+        `target_id` VARCHAR(36) NOT NULL DEFAULT '',
+        `ip` VARCHAR(45) NOT NULL DEFAULT '',
+        `user_agent` VARCHAR(512) NOT NULL DEFAULT '',
+        `request_id` VARCHAR(64) NOT NULL DEFAULT '',
+        `diff` TEXT NOT NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        `prev_hash` CHAR(64) NOT NULL DEFAULT '',
+        `hash` CHAR(64) NOT NULL DEFAULT '',
+        PRIMARY KEY (`id`),
+        INDEX `IX_audit_events_event_type` (`event_type`, `id`),
+        INDEX `IX_audit_events_actor_id` (`actor_id`, `id`),
+        INDEX `IX_audit_events_target_id` (`target_id`, `id`),
+        INDEX `IX_audit_events_created_at` (`created_at`)
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+CREATE TRIGGER `TR_audit_events_no_update` BEFORE UPDATE ON `audit_events`
+    FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_events is append-only'
+;
+CREATE TRIGGER `TR_audit_events_no_delete` BEFORE DELETE ON `audit_events`
+    FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_events is append-only'
+;
+
+DROP TABLE IF EXISTS `audit_chain_head`;
+CREATE TABLE `audit_chain_head`
+    (
+        `id` TINYINT NOT NULL,
+        `event_id` BIGINT NOT NULL DEFAULT 0,
+        `hash` CHAR(64) NOT NULL DEFAULT '',
+        PRIMARY KEY (`id`)
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+INSERT INTO `audit_chain_head` (`id`) VALUES (1);
+
+DROP TABLE IF EXISTS `login_attempts`;
+CREATE TABLE `login_attempts`
+    (
+        `id` BIGINT NOT NULL AUTO_INCREMENT,
+        `user_id` VARCHAR(36) NOT NULL DEFAULT '',
+        `email` VARCHAR(191) NOT NULL DEFAULT '',
+        `method` VARCHAR(128) NOT NULL,
+        `outcome` VARCHAR(32) NOT NULL,
+        `flags` VARCHAR(255) NOT NULL DEFAULT '',
+        `ip` VARCHAR(45) NOT NULL DEFAULT '',
+        `user_agent` VARCHAR(512) NOT NULL DEFAULT '',
+        `latitude` DOUBLE NULL,
+        `longitude` DOUBLE NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        INDEX `IX_login_attempts_user_id` (`user_id`, `id`)
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+DROP TABLE IF EXISTS `login_challenges`;
+CREATE TABLE `login_challenges`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `challenge_hash` BINARY(32) NOT NULL,
+        `code_hash` BINARY(32) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `method` VARCHAR(128) NOT NULL,
+        `scopes` VARCHAR(255) NOT NULL DEFAULT '',
+        `flags` VARCHAR(255) NOT NULL DEFAULT '',
+        `attempts` int(11) NOT NULL DEFAULT 0,
+        `created_at` DATETIME(3) NOT NULL,
+        `expire_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_login_challenges_challenge_hash`
+            UNIQUE (`challenge_hash`),
+        CONSTRAINT `FK_login_challenges_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+-- the migrate tool's record of the schema version; keep it at the number of
+-- the latest migration, which the models check on /readyz
+DROP TABLE IF EXISTS `schema_migrations`;
+CREATE TABLE `schema_migrations`
+    (
+        `version` bigint(20) NOT NULL,
+        `dirty` tinyint(1) NOT NULL,
+        PRIMARY KEY (`version`)
+    )
+;
+INSERT INTO `schema_migrations` (`version`, `dirty`) VALUES (15, 0);
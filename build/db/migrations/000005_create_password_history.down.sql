@@ -0,0 +1,5 @@
+DROP TABLE `password_history`;
+
+ALTER TABLE `tokens` DROP COLUMN `password_change_only`;
+
+ALTER TABLE `users` DROP COLUMN `password_changed_at`;
@@ -0,0 +1,27 @@
+ALTER TABLE `users`
+    ADD COLUMN `password_changed_at` DATETIME(3) NULL AFTER `password`
+;
+
+UPDATE `users` SET `password_changed_at` = `updated_at`;
+
+ALTER TABLE `tokens`
+    ADD COLUMN `password_change_only` TINYINT(1) NOT NULL DEFAULT 0 AFTER `token_hash`
+;
+
+CREATE TABLE IF NOT EXISTS `password_history`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `user_id` VARCHAR(36) NOT NULL,
+        `password` VARCHAR(191) NOT NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        INDEX `IDX_password_history_user_id` (`user_id`, `created_at`),
+        CONSTRAINT `FK_password_history_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
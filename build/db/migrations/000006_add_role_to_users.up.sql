@@ -0,0 +1,3 @@
+ALTER TABLE `users`
+    ADD COLUMN `role` VARCHAR(32) NOT NULL DEFAULT 'user' AFTER `password_changed_at`
+;
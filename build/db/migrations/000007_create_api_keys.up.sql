@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS `api_keys`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `user_id` VARCHAR(36) NOT NULL,
+        `name` VARCHAR(191) NOT NULL,
+        `prefix` VARCHAR(32) NOT NULL,
+        `secret_hash` BLOB NOT NULL,
+        `scopes` VARCHAR(1024) NOT NULL DEFAULT '',
+        `last_used_at` DATETIME(3) NULL,
+        `expire_at` DATETIME(3) NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        `updated_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_api_keys_prefix`
+            UNIQUE (`prefix`),
+        CONSTRAINT `UK_api_keys_name`
+            UNIQUE (`user_id`, `name`),
+        CONSTRAINT `FK_api_keys_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
@@ -0,0 +1,5 @@
+ALTER TABLE `tokens`
+    ADD COLUMN `scopes` VARCHAR(1024) NOT NULL DEFAULT '' AFTER `password_change_only`
+;
+
+UPDATE `tokens` SET `scopes` = 'users:read users:write' WHERE `password_change_only` = 0;
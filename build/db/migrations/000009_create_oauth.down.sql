@@ -0,0 +1,7 @@
+ALTER TABLE `tokens` DROP COLUMN `client_id`;
+
+DROP TABLE `oauth_refresh_tokens`;
+
+DROP TABLE `oauth_authorization_codes`;
+
+DROP TABLE `oauth_clients`;
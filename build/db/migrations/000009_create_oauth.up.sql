@@ -0,0 +1,84 @@
+CREATE TABLE IF NOT EXISTS `oauth_clients`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `client_id` VARCHAR(64) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `name` VARCHAR(191) NOT NULL,
+        `secret_hash` BLOB NULL,
+        `redirect_uris` TEXT NOT NULL,
+        `scopes` VARCHAR(1024) NOT NULL DEFAULT '',
+        `created_at` DATETIME(3) NOT NULL,
+        `updated_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_oauth_clients_client_id`
+            UNIQUE (`client_id`),
+        CONSTRAINT `FK_oauth_clients_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+CREATE TABLE IF NOT EXISTS `oauth_authorization_codes`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `code_hash` BINARY(32) NOT NULL,
+        `client_id` VARCHAR(64) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `redirect_uri` VARCHAR(1024) NOT NULL,
+        `scopes` VARCHAR(1024) NOT NULL DEFAULT '',
+        `code_challenge` VARCHAR(128) NOT NULL DEFAULT '',
+        `code_challenge_method` VARCHAR(16) NOT NULL DEFAULT '',
+        `created_at` DATETIME(3) NOT NULL,
+        `expire_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_oauth_authorization_codes_code_hash`
+            UNIQUE (`code_hash`),
+        CONSTRAINT `FK_oauth_authorization_codes_client_id`
+            FOREIGN KEY (`client_id`)
+            REFERENCES `oauth_clients` (`client_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE,
+        CONSTRAINT `FK_oauth_authorization_codes_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+CREATE TABLE IF NOT EXISTS `oauth_refresh_tokens`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `token_hash` BINARY(32) NOT NULL,
+        `client_id` VARCHAR(64) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `scopes` VARCHAR(1024) NOT NULL DEFAULT '',
+        `created_at` DATETIME(3) NOT NULL,
+        `expire_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_oauth_refresh_tokens_token_hash`
+            UNIQUE (`token_hash`),
+        CONSTRAINT `FK_oauth_refresh_tokens_client_id`
+            FOREIGN KEY (`client_id`)
+            REFERENCES `oauth_clients` (`client_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE,
+        CONSTRAINT `FK_oauth_refresh_tokens_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+ALTER TABLE `tokens`
+    ADD COLUMN `client_id` VARCHAR(64) NULL AFTER `scopes`
+;
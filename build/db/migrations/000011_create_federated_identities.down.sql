@@ -0,0 +1,3 @@
+DROP TABLE `federated_login_states`;
+
+DROP TABLE `federated_identities`;
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS `federated_identities`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `provider` VARCHAR(64) NOT NULL,
+        `subject` VARCHAR(255) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `email` VARCHAR(191) NOT NULL DEFAULT '',
+        `created_at` DATETIME(3) NOT NULL,
+        `updated_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_federated_identities`
+            UNIQUE (`provider`, `subject`),
+        CONSTRAINT `FK_federated_identities_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+CREATE TABLE IF NOT EXISTS `federated_login_states`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `state_hash` BINARY(32) NOT NULL,
+        `provider` VARCHAR(64) NOT NULL,
+        `nonce` VARCHAR(64) NOT NULL,
+        `code_verifier` VARCHAR(128) NOT NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        `expire_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_federated_login_states_state_hash`
+            UNIQUE (`state_hash`)
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
@@ -0,0 +1,2 @@
+ALTER TABLE `tokens` DROP FOREIGN KEY `FK_tokens_impersonator_id`;
+ALTER TABLE `tokens` DROP COLUMN `impersonator_id`;
@@ -0,0 +1,8 @@
+ALTER TABLE `tokens`
+    ADD COLUMN `impersonator_id` VARCHAR(36) NULL AFTER `client_id`,
+    ADD CONSTRAINT `FK_tokens_impersonator_id`
+        FOREIGN KEY (`impersonator_id`)
+        REFERENCES `users` (`user_id`)
+        ON UPDATE CASCADE
+        ON DELETE CASCADE
+;
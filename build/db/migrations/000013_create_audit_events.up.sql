@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS `audit_events`
+    (
+        `id` BIGINT NOT NULL AUTO_INCREMENT,
+        `event_type` VARCHAR(64) NOT NULL,
+        `actor_id` VARCHAR(36) NOT NULL DEFAULT '',
+        `impersonator_id` VARCHAR(36) NOT NULL DEFAULT '',
+        `target_id` VARCHAR(36) NOT NULL DEFAULT '',
+        `ip` VARCHAR(45) NOT NULL DEFAULT '',
+        `user_agent` VARCHAR(512) NOT NULL DEFAULT '',
+        `request_id` VARCHAR(64) NOT NULL DEFAULT '',
+        `diff` TEXT NOT NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        INDEX `IX_audit_events_event_type` (`event_type`, `id`),
+        INDEX `IX_audit_events_actor_id` (`actor_id`, `id`),
+        INDEX `IX_audit_events_target_id` (`target_id`, `id`),
+        INDEX `IX_audit_events_created_at` (`created_at`)
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
@@ -0,0 +1,7 @@
+DROP TRIGGER IF EXISTS `TR_audit_events_no_delete`;
+DROP TRIGGER IF EXISTS `TR_audit_events_no_update`;
+DROP TABLE `audit_chain_head`;
+ALTER TABLE `audit_events`
+    DROP COLUMN `hash`,
+    DROP COLUMN `prev_hash`
+;
@@ -0,0 +1,21 @@
+ALTER TABLE `audit_events`
+    ADD COLUMN `prev_hash` CHAR(64) NOT NULL DEFAULT '' AFTER `created_at`,
+    ADD COLUMN `hash` CHAR(64) NOT NULL DEFAULT '' AFTER `prev_hash`
+;
+CREATE TABLE IF NOT EXISTS `audit_chain_head`
+    (
+        `id` TINYINT NOT NULL,
+        `event_id` BIGINT NOT NULL DEFAULT 0,
+        `hash` CHAR(64) NOT NULL DEFAULT '',
+        PRIMARY KEY (`id`)
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+INSERT INTO `audit_chain_head` (`id`) VALUES (1);
+CREATE TRIGGER `TR_audit_events_no_update` BEFORE UPDATE ON `audit_events`
+    FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_events is append-only'
+;
+CREATE TRIGGER `TR_audit_events_no_delete` BEFORE DELETE ON `audit_events`
+    FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_events is append-only'
+;
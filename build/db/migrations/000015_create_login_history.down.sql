@@ -0,0 +1,3 @@
+DROP TABLE `login_challenges`;
+
+DROP TABLE `login_attempts`;
@@ -0,0 +1,44 @@
+CREATE TABLE IF NOT EXISTS `login_attempts`
+    (
+        `id` BIGINT NOT NULL AUTO_INCREMENT,
+        `user_id` VARCHAR(36) NOT NULL DEFAULT '',
+        `email` VARCHAR(191) NOT NULL DEFAULT '',
+        `method` VARCHAR(128) NOT NULL,
+        `outcome` VARCHAR(32) NOT NULL,
+        `flags` VARCHAR(255) NOT NULL DEFAULT '',
+        `ip` VARCHAR(45) NOT NULL DEFAULT '',
+        `user_agent` VARCHAR(512) NOT NULL DEFAULT '',
+        `latitude` DOUBLE NULL,
+        `longitude` DOUBLE NULL,
+        `created_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        INDEX `IX_login_attempts_user_id` (`user_id`, `id`)
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
+
+CREATE TABLE IF NOT EXISTS `login_challenges`
+    (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `challenge_hash` BINARY(32) NOT NULL,
+        `code_hash` BINARY(32) NOT NULL,
+        `user_id` VARCHAR(36) NOT NULL,
+        `method` VARCHAR(128) NOT NULL,
+        `scopes` VARCHAR(255) NOT NULL DEFAULT '',
+        `flags` VARCHAR(255) NOT NULL DEFAULT '',
+        `attempts` int(11) NOT NULL DEFAULT 0,
+        `created_at` DATETIME(3) NOT NULL,
+        `expire_at` DATETIME(3) NOT NULL,
+        PRIMARY KEY (`id`),
+        CONSTRAINT `UK_login_challenges_challenge_hash`
+            UNIQUE (`challenge_hash`),
+        CONSTRAINT `FK_login_challenges_user_id`
+            FOREIGN KEY (`user_id`)
+            REFERENCES `users` (`user_id`)
+            ON UPDATE CASCADE
+            ON DELETE CASCADE
+    )
+    DEFAULT CHARACTER SET `utf8mb4`
+    COLLATE `utf8mb4_unicode_ci`
+;
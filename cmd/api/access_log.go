@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+)
+
+// accessLogEntry collects what the access log needs to know about a request
+// from further down the chain
+type accessLogEntry struct {
+	userID string
+}
+
+const accessLogEntryKey contextKey = "accessLogEntry"
+
+// quietRoutes are polled by the orchestrator, and only logged at debug level
+var quietRoutes = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// accessLog logs every request once it has been served, with the route it
+// matched, the status and size of the response, how long it took and the
+// user who made it, and counts it in the request metrics. It has to run
+// after assignRequestID.
+func (app *applicationConfig) accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		defer func() {
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			// the route is known once the router has matched it
+			route := ""
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				route = rctx.RoutePattern()
+			}
+
+			level := logging.LevelInfo
+			switch {
+			case status >= 500:
+				level = logging.LevelError
+			case quietRoutes[route]:
+				level = logging.LevelDebug
+			}
+
+			fields := []interface{}{
+				"request_id", requestID(r),
+				"method", r.Method,
+				"route", route,
+				"path", r.URL.Path,
+				"status", status,
+				"bytes", ww.BytesWritten(),
+				"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if entry.userID != "" {
+				fields = append(fields, "user_id", entry.userID)
+			}
+
+			app.logger.Log(level, "request", fields...)
+			app.metrics.observeRequest(r.Method, route, status, time.Since(start).Seconds())
+		}()
+
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), accessLogEntryKey, entry)))
+	})
+}
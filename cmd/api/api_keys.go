@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// apiKeyView is how an API key is shown to its owner. The secret is only
+// included in the response to the request that created the key.
+type apiKeyView struct {
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Key        string     `json:"key,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpireAt   *time.Time `json:"expire_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func newAPIKeyView(key *models.APIKey) apiKeyView {
+	scopes := key.Scopes
+	if scopes == nil {
+		scopes = models.Scopes{}
+	}
+
+	return apiKeyView{
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Key:        key.Key,
+		Scopes:     scopes,
+		LastUsedAt: nullTimePtr(key.LastUsedAt),
+		ExpireAt:   nullTimePtr(key.ExpireAt),
+		CreatedAt:  key.CreatedAt,
+	}
+}
+
+// errAPIKeyNotAllowed is returned when an API key is used to manage API keys
+var errAPIKeyNotAllowed = errors.New("api keys cannot be managed with an api key")
+
+// CreateAPIKey creates a named API key for the authenticated user. The full
+// key is returned once, in this response, and cannot be retrieved later.
+func (app *applicationConfig) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Name     string     `json:"name"`
+		Scopes   []string   `json:"scopes"`
+		ExpireAt *time.Time `json:"expire_at"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+	if user.APIKey != nil {
+		app.errorJSON(w, errAPIKeyNotAllowed, http.StatusForbidden)
+		return
+	}
+	if err := checkAuthorizingUser(user); err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	if requestPayload.Name == "" {
+		app.errorJSON(w, errors.New("name is required"))
+		return
+	}
+
+	var expireAt time.Time
+	if requestPayload.ExpireAt != nil {
+		if requestPayload.ExpireAt.Before(time.Now()) {
+			app.errorJSON(w, errors.New("expire_at must be in the future"))
+			return
+		}
+		expireAt = *requestPayload.ExpireAt
+	}
+
+	scopes, err := requestedScopes(requestPayload.Scopes, user.GrantedScopes())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	key, err := app.models.APIKey.GenerateAPIKey(user.UserID, requestPayload.Name, scopes, expireAt)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.APIKey.Insert(key)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, models.AuditTokenIssued, user.UserID, models.AuditDiff{
+		"api_key": {To: key.Prefix},
+		"scopes":  {To: key.Scopes.String()},
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "api key created",
+		Data:    newAPIKeyView(key),
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
+
+// APIKeys lists the authenticated user's API keys, without their secrets
+func (app *applicationConfig) APIKeys(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	keys, err := app.models.APIKey.IndexForUser(user.UserID)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	views := make([]apiKeyView, 0, len(keys))
+	for _, key := range keys {
+		views = append(views, newAPIKeyView(key))
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    views,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// DeleteAPIKey revokes one of the authenticated user's API keys, by prefix
+func (app *applicationConfig) DeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user.APIKey != nil {
+		app.errorJSON(w, errAPIKeyNotAllowed, http.StatusForbidden)
+		return
+	}
+	if err := checkAuthorizingUser(user); err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	prefix := chi.URLParam(r, "prefix")
+
+	err := app.models.APIKey.DeleteForUser(user.UserID, prefix)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	app.audit(r, models.AuditTokenRevoked, user.UserID, models.AuditDiff{"api_key": {To: prefix}})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "api key deleted",
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
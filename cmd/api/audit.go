@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// audit page sizes
+const (
+	auditDefaultLimit = 50
+	auditMaxLimit     = 500
+)
+
+// audit records a security relevant event caused by request r. The actor is
+// the authenticated user, if there is one; targetID is the user the event is
+// about. Failing to record an event is logged, but does not fail the request.
+func (app *applicationConfig) audit(r *http.Request, eventType, targetID string, diff models.AuditDiff) {
+	event := models.AuditEvent{
+		Type:      eventType,
+		TargetID:  targetID,
+		IP:        clientIP(r),
+		UserAgent: truncate(r.UserAgent(), 512),
+		RequestID: requestID(r),
+		Diff:      diff,
+	}
+
+	if actor := app.authenticatedUser(r); actor != nil {
+		event.ActorID = actor.UserID
+		event.ImpersonatorID = actor.ImpersonatedBy()
+	}
+
+	app.metrics.observeAuditEvent(eventType)
+
+	err := app.models.AuditEvent.Insert(event)
+	if err != nil {
+		app.requestLog(r).Error("cannot record audit event", "event", eventType, "error", err)
+	}
+}
+
+// auditAs records an event for an actor that is not (yet) in the request
+// context, such as a user who has just logged in
+func (app *applicationConfig) auditAs(r *http.Request, actor *models.User, eventType, targetID string, diff models.AuditDiff) {
+	app.audit(withAuthenticatedUser(r, actor), eventType, targetID, diff)
+}
+
+// userDiff returns the fields that differ between two versions of a user.
+// Secrets such as the password hash are never part of it.
+func userDiff(before, after *models.User) models.AuditDiff {
+	diff := models.AuditDiff{}
+	if before == nil {
+		before = &models.User{}
+	}
+
+	add := func(field string, from, to interface{}) {
+		if from != to {
+			diff[field] = models.AuditChange{From: from, To: to}
+		}
+	}
+
+	add("email", before.Email, after.Email)
+	add("first_name", before.FirstName, after.FirstName)
+	add("last_name", before.LastName, after.LastName)
+	add("role", before.Role, after.Role)
+	add("email_verified", before.EmailVerifiedAt.Valid, after.EmailVerifiedAt.Valid)
+	add("deleted", before.DeletedAt.Valid, after.DeletedAt.Valid)
+
+	return diff
+}
+
+// tokenDetails describes a newly issued token for its audit event, without
+// the token itself
+func tokenDetails(token *models.Token) models.AuditDiff {
+	details := models.AuditDiff{
+		"scopes":    {To: token.Scopes.String()},
+		"expire_at": {To: token.ExpireAt},
+	}
+	if token.PasswordChangeOnly {
+		details["password_change_only"] = models.AuditChange{To: true}
+	}
+	if token.ClientID.Valid {
+		details["client_id"] = models.AuditChange{To: token.ClientID.String}
+	}
+
+	return details
+}
+
+// clientIP returns the address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+
+	return s
+}
+
+// AuditEvents lists audit events, newest first. They can be filtered by
+// type, actor, target and time range (RFC 3339), and are paged with the
+// next_cursor returned by the previous page.
+func (app *applicationConfig) AuditEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter := models.AuditFilter{
+		Type:     query.Get("type"),
+		ActorID:  query.Get("actor"),
+		TargetID: query.Get("target"),
+	}
+
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := query.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				app.errorJSON(w, errors.New(name+" must be an RFC 3339 time"))
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	var cursor int64
+	if v := query.Get("cursor"); v != "" {
+		c, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || c < 1 {
+			app.errorJSON(w, errors.New("invalid cursor"))
+			return
+		}
+		cursor = c
+	}
+
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = auditDefaultLimit
+	}
+	if limit > auditMaxLimit {
+		limit = auditMaxLimit
+	}
+
+	events, err := app.models.AuditEvent.Index(filter, cursor, limit)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// a full page means there may be more
+	nextCursor := ""
+	if len(events) == limit {
+		nextCursor = strconv.FormatInt(events[len(events)-1].ID, 10)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"events": events, "next_cursor": nextCursor},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// SetUserRole lets an admin change another user's role
+func (app *applicationConfig) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Role string `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	admin := app.authenticatedUser(r)
+
+	user, err := app.models.User.ShowByID(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// an admin demoting themselves could leave nobody to undo it
+	if user.UserID == admin.UserID {
+		app.errorJSON(w, errors.New("you cannot change your own role"), http.StatusForbidden)
+		return
+	}
+
+	before := *user
+	err = user.SetRole(requestPayload.Role)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if before.Role != user.Role {
+		app.audit(r, models.AuditRoleChanged, user.UserID, userDiff(&before, user))
+		app.audit(r, models.AuditTokenRevoked, user.UserID, models.AuditDiff{"reason": {To: "role changed"}})
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "role changed",
+		Data:    newUserView(user, visibilityAdmin),
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
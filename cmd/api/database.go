@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+)
+
+// dbStatsView is how the connection pool statistics are shown, along with
+// how many attempts it took to connect at startup. Durations are in
+// milliseconds.
+type dbStatsView struct {
+	ConnectAttempts    int   `json:"connect_attempts"`
+	MaxOpenConnections int   `json:"max_open_connections"`
+	OpenConnections    int   `json:"open_connections"`
+	InUse              int   `json:"in_use"`
+	Idle               int   `json:"idle"`
+	WaitCount          int64 `json:"wait_count"`
+	WaitDurationMS     int64 `json:"wait_duration_ms"`
+	MaxIdleClosed      int64 `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64 `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64 `json:"max_lifetime_closed"`
+}
+
+// DBStats shows the live statistics of the database connection pool, to
+// tell whether its size and timeouts suit the load
+func (app *applicationConfig) DBStats(w http.ResponseWriter, r *http.Request) {
+	stats := app.db.Stats()
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data: dbStatsView{
+			ConnectAttempts:    app.db.ConnectAttempts,
+			MaxOpenConnections: stats.MaxOpenConnections,
+			OpenConnections:    stats.OpenConnections,
+			InUse:              stats.InUse,
+			Idle:               stats.Idle,
+			WaitCount:          stats.WaitCount,
+			WaitDurationMS:     stats.WaitDuration.Milliseconds(),
+			MaxIdleClosed:      stats.MaxIdleClosed,
+			MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+			MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+		},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
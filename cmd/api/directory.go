@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/authenticator"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// directoryUser checks credentials against an external directory and returns
+// the matching local user. The directory is the source of truth: a user it
+// knows but we do not is created, and a changed name is copied over. The
+// user is matched by the address the directory returns, which must be in the
+// domain signed in with, so an entry cannot reach accounts of other domains.
+func (app *applicationConfig) directoryUser(r *http.Request, directory authenticator.Authenticator, email, password string) (*models.User, error) {
+	identity, err := directory.Authenticate(r.Context(), email, password)
+	if errors.Is(err, authenticator.ErrInvalidCredentials) {
+		return nil, errors.New("invalid username / password")
+	}
+	if err != nil {
+		app.requestLog(r).Error("directory is not available", "error", err)
+		return nil, errors.New("directory is not available")
+	}
+
+	if authenticator.Domain(identity.Email) != authenticator.Domain(email) {
+		app.requestLog(r).Warn("directory entry has an address outside the domain signed in with", "email", email, "directory_email", identity.Email)
+		return nil, errors.New("directory entry does not belong to this domain")
+	}
+
+	user, err := app.models.User.ShowByEmail(identity.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		userID, err := app.models.User.InsertWithoutPassword(models.User{
+			FirstName: identity.FirstName,
+			LastName:  identity.LastName,
+			Email:     identity.Email,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		user, err = app.models.User.ShowByID(userID)
+		if err != nil {
+			return nil, err
+		}
+
+		app.audit(r, models.AuditUserCreated, user.UserID, userDiff(nil, user))
+	} else if err != nil {
+		return nil, err
+	}
+
+	if user.FirstName == identity.FirstName && user.LastName == identity.LastName && user.EmailVerifiedAt.Valid {
+		return user, nil
+	}
+
+	before := *user
+
+	user.FirstName = identity.FirstName
+	user.LastName = identity.LastName
+	if !user.EmailVerifiedAt.Valid {
+		user.EmailVerifiedAt.Time = time.Now()
+		user.EmailVerifiedAt.Valid = true
+	}
+
+	err = user.Update()
+	if err != nil {
+		return nil, err
+	}
+
+	app.audit(r, models.AuditUserUpdated, user.UserID, userDiff(&before, user))
+
+	return user, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/authenticator"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+func TestDirectoryLogin(t *testing.T) {
+	app, mem := newTestApp(t)
+	app.authenticators = authenticator.Domains{"corp.example": stubDirectory{
+		"alice@corp.example": {Email: "Alice@Corp.example", FirstName: "Alice", LastName: "Corp"},
+		"evil@corp.example":  {Email: "victim@example.com", FirstName: "Evil", LastName: "Entry"},
+	}}
+	handler := app.routes()
+
+	victim := createTestUser(t, app, "victim@example.com", models.RoleUser)
+
+	// an entry whose address is in another domain reaches no account there
+	rr := doRequest(t, handler, http.MethodPost, "/auth/login", "", envelope{"email": "evil@corp.example", "password": testPassword})
+	if rr.Code == http.StatusOK {
+		t.Fatalf("signed in through an entry of another domain: %s", rr.Body)
+	}
+	after, err := app.models.User.ShowByID(victim.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.FirstName != victim.FirstName || len(mem.rows("tokens")) != 0 {
+		t.Fatalf("victim after the sign in %+v, tokens %v", after, mem.rows("tokens"))
+	}
+
+	// an entry of the domain signs in, however its address is cased
+	loginTestUser(t, handler, "alice@corp.example")
+	alice, err := app.models.User.ShowByEmail("Alice@Corp.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.FirstName != "Alice" || !alice.EmailVerifiedAt.Valid || alice.HasUsablePassword() {
+		t.Fatalf("provisioned user %+v", alice)
+	}
+
+	rr = doRequest(t, handler, http.MethodPost, "/auth/login", "", envelope{"email": "alice@corp.example", "password": "wrong"})
+	if rr.Code == http.StatusOK {
+		t.Fatalf("signed in with a wrong password: %s", rr.Body)
+	}
+}
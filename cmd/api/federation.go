@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/federation"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// errUnknownProvider is returned for a provider name we have no configuration for
+var errUnknownProvider = errors.New("unknown identity provider")
+
+// federatedStateCookie binds a login at an external provider to the browser
+// that started it. Without it anyone could send a victim to the callback with
+// a state and code of their own, signing the victim in as the attacker.
+const federatedStateCookie = "federated_login_state"
+
+// federatedStateCookiePath limits the state cookie to the callback of provider
+func federatedStateCookiePath(provider string) string {
+	return "/auth/federated/" + provider + "/"
+}
+
+// federationProvider returns the provider named in the URL
+func (app *applicationConfig) federationProvider(r *http.Request) (*federation.Provider, error) {
+	provider, ok := app.federationProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		return nil, errUnknownProvider
+	}
+
+	return provider, nil
+}
+
+// FederatedLoginStart begins a login at an external OpenID Connect provider.
+// It remembers a state, nonce and PKCE verifier for the callback, gives the
+// browser the state in a cookie, and returns the URL the client should send
+// the user to.
+func (app *applicationConfig) FederatedLoginStart(w http.ResponseWriter, r *http.Request) {
+	provider, err := app.federationProvider(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	loginState, err := app.models.LoginState.IssueLoginState(provider.Name)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	redirectTo, err := provider.AuthCodeURL(r.Context(), loginState.State, loginState.Nonce, loginState.CodeChallenge())
+	if err != nil {
+		app.requestLog(r).Error("identity provider is not available", "provider", provider.Name, "error", err)
+		app.errorJSON(w, errors.New("identity provider is not available"), http.StatusBadGateway)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     federatedStateCookie,
+		Value:    loginState.State,
+		Path:     federatedStateCookiePath(provider.Name),
+		MaxAge:   int(models.FederatedLoginTTL / time.Second),
+		Secure:   app.inProduction,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"redirect_to": redirectTo},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// FederatedLoginCallback completes a login at an external provider. The code
+// is exchanged for a verified ID token, the provider's subject is mapped to a
+// local user, and a token is issued for that user just like Login does. The
+// provider sends the browser here, so when a front end page is configured the
+// browser is sent on to it with the outcome, rather than shown JSON.
+func (app *applicationConfig) FederatedLoginCallback(w http.ResponseWriter, r *http.Request) {
+	if provider, err := app.federationProvider(r); err == nil {
+		http.SetCookie(w, &http.Cookie{
+			Name:     federatedStateCookie,
+			Path:     federatedStateCookiePath(provider.Name),
+			MaxAge:   -1,
+			Secure:   app.inProduction,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	if app.federationRedirect == "" {
+		app.federatedLoginCallback(w, r)
+		return
+	}
+
+	result := &loginResult{header: http.Header{}}
+	result.header.Set(requestIDHeader, w.Header().Get(requestIDHeader))
+	app.federatedLoginCallback(result, r)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, app.federationRedirect+"#"+result.fragment().Encode(), http.StatusFound)
+}
+
+func (app *applicationConfig) federatedLoginCallback(w http.ResponseWriter, r *http.Request) {
+	provider, err := app.federationProvider(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		app.errorJSON(w, errors.New("identity provider returned "+e), http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(federatedStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		app.errorJSON(w, errors.New("sign in was not started in this browser"), http.StatusBadRequest)
+		return
+	}
+
+	loginState, err := app.models.LoginState.ConsumeLoginState(query.Get("state"), provider.Name)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), query.Get("code"), loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		app.requestLog(r).Warn("cannot exchange code with identity provider", "provider", provider.Name, "error", err)
+		app.errorJSON(w, errors.New("could not sign in with identity provider"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.federatedUser(r, provider.Name, claims)
+	if err != nil {
+		app.federatedLoginFailed(r, provider.Name, "", err.Error())
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	app.federatedLogin(w, r, user, provider.Name)
+}
+
+// loginResult collects the JSON response of a login, so the callback can hand
+// it to the front end in a redirect instead
+type loginResult struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (lr *loginResult) Header() http.Header {
+	return lr.header
+}
+
+func (lr *loginResult) Write(b []byte) (int, error) {
+	return lr.body.Write(b)
+}
+
+func (lr *loginResult) WriteHeader(status int) {}
+
+// fragment returns the parameters the front end gets: the token, a step-up
+// challenge, or an error with the request ID
+func (lr *loginResult) fragment() url.Values {
+	var response struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+		Data    struct {
+			Token struct {
+				Token    string    `json:"token"`
+				ExpireAt time.Time `json:"expire_at"`
+			} `json:"token"`
+			State     string `json:"state"`
+			Challenge string `json:"challenge"`
+			ExpiresIn int    `json:"expires_in"`
+		} `json:"data"`
+	}
+
+	params := url.Values{}
+
+	err := json.Unmarshal(lr.body.Bytes(), &response)
+	switch {
+	case err != nil || response.Error:
+		params.Set("error", response.Message)
+		if response.Message == "" {
+			params.Set("error", "could not sign in with identity provider")
+		}
+		params.Set("request_id", lr.header.Get(requestIDHeader))
+	case response.Data.State == "step_up_required":
+		params.Set("state", response.Data.State)
+		params.Set("challenge", response.Data.Challenge)
+		params.Set("expires_in", strconv.Itoa(response.Data.ExpiresIn))
+	default:
+		params.Set("token", response.Data.Token.Token)
+		params.Set("expire_at", response.Data.Token.ExpireAt.Format(time.RFC3339))
+	}
+
+	return params
+}
+
+// federatedLogin finishes the login of a user who signed in at an external
+// provider, just like Login does for a password
+func (app *applicationConfig) federatedLogin(w http.ResponseWriter, r *http.Request, user *models.User, provider string) {
+	// closed accounts cannot log in
+	if user.DeletedAt.Valid {
+		app.federatedLoginFailed(r, provider, user.UserID, "account closed")
+		app.errorJSON(w, errors.New("account is closed"), http.StatusForbidden)
+		return
+	}
+
+	app.completeLogin(w, r, user, provider, user.AllowedScopes())
+}
+
+// federatedLoginFailed records a sign in through provider that was
+// refused, with the user it was for if we know them
+func (app *applicationConfig) federatedLoginFailed(r *http.Request, provider, targetID, reason string) {
+	app.recordLoginAttempt(r, targetID, "", provider, models.LoginFailed, nil)
+	app.audit(r, models.AuditLoginFailed, targetID, models.AuditDiff{
+		"provider": {To: provider},
+		"reason":   {To: reason},
+	})
+}
+
+// federatedUser finds the local user for a provider's subject. A subject seen
+// before maps to the user it was linked to. Otherwise it is linked to the user
+// with the same email address, but only if both the provider and we have
+// verified that address, and when there is no such user an account is
+// created for it. Linking to an unverified account would hand it to whoever
+// signs in with the address first, e.g. someone who registered it beforehand.
+func (app *applicationConfig) federatedUser(r *http.Request, provider string, claims *federation.Claims) (*models.User, error) {
+	identity, err := app.models.FederatedIdentity.ShowBySubject(provider, claims.Subject)
+	if err == nil {
+		return app.models.User.ShowByID(identity.UserID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if claims.Email == "" {
+		return nil, errors.New("identity provider did not share an email address")
+	}
+
+	user, err := app.models.User.ShowByEmail(claims.Email)
+	switch {
+	case err == nil && !claims.EmailVerified:
+		// anyone can claim an address at a provider that does not verify it
+		return nil, errors.New("email address is not verified by the identity provider")
+	case err == nil && !user.EmailVerifiedAt.Valid:
+		// nor do we know the local account belongs to whoever owns the address
+		return nil, errors.New("an account with this email address exists, but its address is not verified")
+	case errors.Is(err, sql.ErrNoRows):
+		user, err = app.provisionFederatedUser(r, claims)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	err = app.models.FederatedIdentity.Insert(models.FederatedIdentity{
+		Provider: provider,
+		Subject:  claims.Subject,
+		UserID:   user.UserID,
+		Email:    claims.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// provisionFederatedUser creates an account for someone signing in through an
+// external provider for the first time. The account has no usable password.
+func (app *applicationConfig) provisionFederatedUser(r *http.Request, claims *federation.Claims) (*models.User, error) {
+	userID, err := app.models.User.InsertWithoutPassword(models.User{
+		FirstName: claims.GivenName,
+		LastName:  claims.FamilyName,
+		Email:     claims.Email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := app.models.User.ShowByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.EmailVerified {
+		user.EmailVerifiedAt.Time = time.Now()
+		user.EmailVerifiedAt.Valid = true
+		err = user.Update()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	app.audit(r, models.AuditUserCreated, user.UserID, userDiff(nil, user))
+
+	return user, nil
+}
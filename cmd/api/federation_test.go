@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/federation"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/oidc"
+)
+
+// stubIdP is an OpenID Connect provider that signs in whoever the test says,
+// with discovery, a token endpoint checking the client and PKCE, and ID
+// tokens signed with a key generated for the test
+type stubIdP struct {
+	*httptest.Server
+	clientID, clientSecret string
+	signer                 *oidc.Signer
+
+	mu    sync.Mutex
+	codes map[string]stubCode
+}
+
+type stubCode struct {
+	nonce, challenge string
+	identity         envelope
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	t.Helper()
+
+	signer, err := oidc.GenerateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &stubIdP{
+		clientID:     "api",
+		clientSecret: "stub-secret",
+		signer:       signer,
+		codes:        make(map[string]stubCode),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(envelope{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(idp.signer.JWKS())
+	})
+	mux.HandleFunc("/token", idp.token)
+
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	return idp
+}
+
+// signIn plays the user signing in at the authorization URL the API sent
+// them to, and returns the callback query the IdP redirects back with
+func (idp *stubIdP) signIn(t *testing.T, authURL string, identity envelope) url.Values {
+	t.Helper()
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := u.Query()
+	if params.Get("client_id") != idp.clientID || params.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	code := "code-" + params.Get("state")
+
+	idp.mu.Lock()
+	idp.codes[code] = stubCode{nonce: params.Get("nonce"), challenge: params.Get("code_challenge"), identity: identity}
+	idp.mu.Unlock()
+
+	return url.Values{"code": {code}, "state": {params.Get("state")}}
+}
+
+func (idp *stubIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, _ := r.BasicAuth()
+	if clientID != idp.clientID || secret != idp.clientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(envelope{"error": "invalid_client"})
+		return
+	}
+
+	idp.mu.Lock()
+	code, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || r.PostFormValue("grant_type") != "authorization_code" || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(envelope{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := envelope{
+		"iss":   idp.URL,
+		"aud":   idp.clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": code.nonce,
+	}
+	for k, v := range code.identity {
+		if k != "tampered_sub" {
+			claims[k] = v
+		}
+	}
+
+	idToken, err := idp.signer.Sign(claims)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// swap the subject after signing, as someone in the middle would
+	if sub, ok := code.identity["tampered_sub"]; ok {
+		claims["sub"] = sub
+		payload, _ := json.Marshal(claims)
+		parts := strings.Split(idToken, ".")
+		idToken = parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	}
+
+	_ = json.NewEncoder(w).Encode(envelope{"access_token": "unused", "token_type": "Bearer", "id_token": idToken})
+}
+
+// federatedLogin runs a whole sign in through the stub and returns the
+// response of the callback
+func federatedLogin(t *testing.T, handler http.Handler, idp *stubIdP, identity envelope) *httptest.ResponseRecorder {
+	t.Helper()
+
+	callback, cookies := startFederatedLogin(t, handler, idp, identity)
+
+	return federatedCallback(handler, callback, cookies)
+}
+
+// startFederatedLogin starts a sign in and plays it at the stub, returning
+// the callback query and the cookies the browser got at the start
+func startFederatedLogin(t *testing.T, handler http.Handler, idp *stubIdP, identity envelope) (url.Values, []*http.Cookie) {
+	t.Helper()
+
+	rr := doRequest(t, handler, http.MethodGet, "/auth/federated/stub/start", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("start: status %d: %s", rr.Code, rr.Body)
+	}
+
+	var start struct {
+		Data struct {
+			RedirectTo string `json:"redirect_to"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return idp.signIn(t, start.Data.RedirectTo, identity), rr.Result().Cookies()
+}
+
+// federatedCallback sends the browser with cookies back to the callback
+func federatedCallback(handler http.Handler, callback url.Values, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth/federated/stub/callback?"+callback.Encode(), nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+// newStubFederation returns the API with the stub as its provider "stub"
+func newStubFederation(t *testing.T) (*applicationConfig, *memDB, *stubIdP) {
+	t.Helper()
+
+	app, mem := newTestApp(t)
+	idp := newStubIdP(t)
+	app.federationProviders["stub"] = federation.NewProvider(federation.Config{
+		Name:         "stub",
+		Issuer:       idp.URL,
+		ClientID:     idp.clientID,
+		ClientSecret: idp.clientSecret,
+		RedirectURL:  "http://api.test/auth/federated/stub/callback",
+	}, idp.Client())
+
+	return app, mem, idp
+}
+
+func TestFederatedLogin(t *testing.T) {
+	tests := []struct {
+		name string
+		// localEmail is the address of an account that already exists
+		localEmail    string
+		localVerified bool
+		identity      envelope
+		status        int
+		// linked tells the sign in must end up in the local account
+		linked bool
+	}{
+		{
+			name:     "new user is provisioned",
+			identity: envelope{"sub": "new-1", "email": "new@example.com", "email_verified": true, "given_name": "New", "family_name": "Person"},
+			status:   http.StatusOK,
+		},
+		{
+			name:          "verified account is linked",
+			localEmail:    "both@example.com",
+			localVerified: true,
+			identity:      envelope{"sub": "both-1", "email": "both@example.com", "email_verified": true},
+			status:        http.StatusOK,
+			linked:        true,
+		},
+		{
+			name:          "address not verified by the IdP",
+			localEmail:    "idp-unverified@example.com",
+			localVerified: true,
+			identity:      envelope{"sub": "idp-unverified-1", "email": "idp-unverified@example.com", "email_verified": false},
+			status:        http.StatusForbidden,
+		},
+		{
+			name:       "local address not verified",
+			localEmail: "victim@example.com",
+			identity:   envelope{"sub": "victim-1", "email": "victim@example.com", "email_verified": true},
+			status:     http.StatusForbidden,
+		},
+		{
+			name:     "ID token changed after signing",
+			identity: envelope{"sub": "honest-1", "email": "honest@example.com", "email_verified": true, "tampered_sub": "forged-1"},
+			status:   http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mem, idp := newStubFederation(t)
+			handler := app.routes()
+
+			var local *models.User
+			if tt.localEmail != "" {
+				local = createTestUser(t, app, tt.localEmail, models.RoleUser)
+				if tt.localVerified {
+					local.EmailVerifiedAt.Time = time.Now()
+					local.EmailVerifiedAt.Valid = true
+					err := local.Update()
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			usersBefore := len(mem.rows("users"))
+
+			rr := federatedLogin(t, handler, idp, tt.identity)
+			if rr.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+
+			identities := mem.rows("federated_identities")
+			if tt.status != http.StatusOK {
+				if len(identities) != 0 || len(mem.rows("users")) != usersBefore {
+					t.Fatalf("refused sign in left %d identities and %d new users", len(identities), len(mem.rows("users"))-usersBefore)
+				}
+				return
+			}
+
+			if len(identities) != 1 || identities[0]["subject"] != tt.identity["sub"] {
+				t.Fatalf("identities = %v", identities)
+			}
+
+			user, err := app.models.User.ShowByID(toString(identities[0]["user_id"]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.linked && user.UserID != local.UserID {
+				t.Fatalf("linked to %s, want %s", user.UserID, local.UserID)
+			}
+			if !tt.linked {
+				if len(mem.rows("users")) != usersBefore+1 {
+					t.Fatal("no user was provisioned")
+				}
+				if user.HasUsablePassword() || !user.EmailVerifiedAt.Valid || user.FirstName != tt.identity["given_name"] {
+					t.Fatalf("provisioned user %+v", user)
+				}
+			}
+
+			// the next sign in finds the user through the subject alone
+			rr = federatedLogin(t, handler, idp, tt.identity)
+			if rr.Code != http.StatusOK || len(mem.rows("federated_identities")) != 1 {
+				t.Fatalf("second sign in: status %d: %s", rr.Code, rr.Body)
+			}
+		})
+	}
+}
+
+func TestFederatedLoginStateCookie(t *testing.T) {
+	app, mem, idp := newStubFederation(t)
+	handler := app.routes()
+
+	identity := envelope{"sub": "attacker-1", "email": "attacker@example.com", "email_verified": true}
+
+	// the attacker starts a sign in and stops before the callback
+	callback, cookies := startFederatedLogin(t, handler, idp, identity)
+	if len(cookies) != 1 || cookies[0].Name != federatedStateCookie || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode || cookies[0].MaxAge <= 0 || cookies[0].Value != callback.Get("state") {
+		t.Fatalf("state cookie %+v", cookies)
+	}
+
+	// a victim sent to the callback carries no such cookie, or their own
+	_, victimCookies := startFederatedLogin(t, handler, idp, envelope{"sub": "victim-1"})
+	for name, cookies := range map[string][]*http.Cookie{"no cookie": nil, "another login's cookie": victimCookies} {
+		rr := federatedCallback(handler, callback, cookies)
+		if rr.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status %d: %s", name, rr.Code, rr.Body)
+		}
+	}
+	if len(mem.rows("tokens")) != 0 {
+		t.Fatalf("tokens were issued: %v", mem.rows("tokens"))
+	}
+
+	// the browser that started the sign in finishes it, and the cookie goes
+	rr := federatedCallback(handler, callback, cookies)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rr.Code, rr.Body)
+	}
+	cleared := rr.Result().Cookies()
+	if len(cleared) != 1 || cleared[0].Name != federatedStateCookie || cleared[0].MaxAge >= 0 {
+		t.Fatalf("state cookie after the callback %+v", cleared)
+	}
+}
+
+func TestFederatedLoginRedirect(t *testing.T) {
+	app, _, idp := newStubFederation(t)
+	app.federationRedirect = "https://app.example/signed-in"
+	handler := app.routes()
+
+	redirected := func(t *testing.T, rr *httptest.ResponseRecorder) url.Values {
+		t.Helper()
+
+		location, err := url.Parse(rr.Header().Get("Location"))
+		if rr.Code != http.StatusFound || err != nil || !strings.HasPrefix(location.String(), app.federationRedirect+"#") {
+			t.Fatalf("status %d, Location %q: %s", rr.Code, rr.Header().Get("Location"), rr.Body)
+		}
+		params, err := url.ParseQuery(location.Fragment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return params
+	}
+
+	params := redirected(t, federatedLogin(t, handler, idp, envelope{"sub": "new-1", "email": "new@example.com", "email_verified": true}))
+	if params.Get("token") == "" || params.Get("expire_at") == "" || params.Get("error") != "" {
+		t.Fatalf("fragment %v", params)
+	}
+	if rr := doRequest(t, handler, http.MethodGet, "/users/me/", params.Get("token"), nil); rr.Code != http.StatusOK {
+		t.Fatalf("token from the fragment: status %d: %s", rr.Code, rr.Body)
+	}
+
+	callback, _ := startFederatedLogin(t, handler, idp, envelope{"sub": "new-1"})
+	params = redirected(t, federatedCallback(handler, callback, nil))
+	if params.Get("error") == "" || params.Get("request_id") == "" || params.Get("token") != "" {
+		t.Fatalf("fragment %v", params)
+	}
+}
@@ -3,19 +3,20 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/authenticator"
 	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
 )
 
 // jsonResponse is the type used for generic JSON responses
 type jsonResponse struct {
-	Error   bool        `json:"error"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+	Error     bool        `json:"error"`
+	Message   string      `json:"message"`
+	Data      interface{} `json:"data,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
 }
 
 type envelope map[string]interface{}
@@ -25,8 +26,9 @@ var users models.User
 // Login is the handler used to attempt to log a user into the api
 func (app *applicationConfig) Login(w http.ResponseWriter, r *http.Request) {
 	type credentials struct {
-		UserName string `json:"email"`
-		Password string `json:"password"`
+		UserName string   `json:"email"`
+		Password string   `json:"password"`
+		Scopes   []string `json:"scopes"`
 	}
 
 	var creds credentials
@@ -34,76 +36,445 @@ func (app *applicationConfig) Login(w http.ResponseWriter, r *http.Request) {
 
 	err := app.readJSON(w, r, &creds)
 	if err != nil {
-		app.errorLog.Println(err)
+		app.requestLog(r).Info("invalid login request", "error", err)
 		payload.Error = true
 		payload.Message = "invalid json supplied, or json missing entirely"
 		_ = app.writeJSON(w, http.StatusBadRequest, payload)
+		return
+	}
+
+	// every failed attempt is audited, with the user it was for if we know them
+	loginFailed := func(targetID, reason string, err error) {
+		app.recordLoginAttempt(r, targetID, creds.UserName, loginMethodPassword, models.LoginFailed, nil)
+		app.audit(r, models.AuditLoginFailed, targetID, models.AuditDiff{
+			"email":  {To: creds.UserName},
+			"reason": {To: reason},
+		})
+		app.errorJSON(w, err)
 	}
 
-	// TODO authenticate
-	app.infoLog.Println(creds.UserName, creds.Password)
+	// addresses in a directory's domains are checked against the directory,
+	// which also owns the password and its expiry
+	var user *models.User
+	if directory := app.authenticators.For(creds.UserName); directory != nil {
+		user, err = app.directoryUser(r, directory, creds.UserName, creds.Password)
+		if err != nil {
+			loginFailed("", "directory: "+err.Error(), err)
+			return
+		}
+
+		// closed accounts cannot log in
+		if user.DeletedAt.Valid {
+			loginFailed(user.UserID, "account closed", errors.New("invalid username / password"))
+			return
+		}
+	} else {
+		// look up the user by email
+		user, err = app.models.User.ShowByEmail(creds.UserName)
+		if err != nil {
+			loginFailed("", "unknown email", errors.New("invalid username / password"))
+			return
+		}
 
-	// look up the user by email
-	user, err := app.models.User.ShowByEmail(creds.UserName)
+		// closed accounts cannot log in
+		if user.DeletedAt.Valid {
+			loginFailed(user.UserID, "account closed", errors.New("invalid username / password"))
+			return
+		}
+
+		// validate the user's password
+		validPassword, err := user.PasswordMatches(creds.Password)
+		if err != nil || !validPassword {
+			loginFailed(user.UserID, "wrong password", errors.New("invalid username / password "))
+			return
+		}
+
+		// an expired password only gets a short lived token that can do
+		// nothing but change the password
+		if user.PasswordExpired(models.CurrentPasswordPolicy().MaxAge) {
+			app.recordLoginAttempt(r, user.UserID, user.Email, loginMethodPassword, models.LoginPasswordExpired, nil)
+			app.auditAs(r, user, models.AuditLoginSucceeded, user.UserID, models.AuditDiff{"password_expired": {To: true}})
+			app.passwordChangeRequired(w, r, user)
+			return
+		}
+	}
+
+	// the token gets every scope the user is allowed, unless a subset was asked for
+	scopes, err := requestedScopes(creds.Scopes, user.AllowedScopes())
 	if err != nil {
-		app.errorJSON(w, errors.New("invalid username / password"))
+		loginFailed(user.UserID, "scopes not allowed", err)
 		return
 	}
 
-	// validate the user's password
-	validPassword, err := user.PasswordMatches(creds.Password)
-	if err != nil || !validPassword {
-		app.errorJSON(w, errors.New("invalid username / password "))
+	app.completeLogin(w, r, user, loginMethodPassword, scopes)
+}
+
+// CreateToken issues an additional token for the authenticated user, carrying
+// a subset of the scopes of the credential used to call it. This is how a read
+// only dashboard gets a token that cannot change anything.
+func (app *applicationConfig) CreateToken(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Scopes    []string `json:"scopes"`
+		ExpiresIn int      `json:"expires_in"`
 	}
 
-	// we have a valid user, so generaet a token
-	token, err := app.models.Token.GenerateToken(user.UserID, 24*time.Hour)
+	err := app.readJSON(w, r, &requestPayload)
 	if err != nil {
 		app.errorJSON(w, err)
+		return
 	}
 
-	// make sure user is active
-	// if user.Active == 0 {
-	// 	app.errorJSON(w, errors.New("user is not active"))
-	// 	return
-	// }
+	user := app.authenticatedUser(r)
+	if err := checkAuthorizingUser(user); err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	scopes, err := requestedScopes(requestPayload.Scopes, user.GrantedScopes())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	ttl := 24 * time.Hour
+	if requestPayload.ExpiresIn > 0 {
+		ttl = time.Duration(requestPayload.ExpiresIn) * time.Second
+	}
+	if ttl > maxTokenTTL {
+		app.errorJSON(w, fmt.Errorf("expires_in must be at most %d seconds", int(maxTokenTTL.Seconds())))
+		return
+	}
+
+	token, err := app.models.Token.GenerateToken(user.UserID, ttl, scopes)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.Token.Insert(*token, *user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, models.AuditTokenIssued, user.UserID, tokenDetails(token))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "token created",
+		Data:    envelope{"token": token},
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
+
+// Register is the handler used to sign up a new user. The password has to
+// satisfy the password policy; if it does not, every violation is returned.
+func (app *applicationConfig) Register(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+		Password  string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if requestPayload.Email == "" {
+		app.errorJSON(w, errors.New("email is required"))
+		return
+	}
+
+	// accounts in a directory's domains are created by signing in
+	if app.authenticators.For(requestPayload.Email) != nil {
+		app.errorJSON(w, errors.New("accounts for this email domain are managed by a directory"), http.StatusForbidden)
+		return
+	}
+
+	newUser := models.User{
+		FirstName: requestPayload.FirstName,
+		LastName:  requestPayload.LastName,
+		Email:     requestPayload.Email,
+		Password:  requestPayload.Password,
+	}
+
+	userID, err := app.models.User.Insert(newUser)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, models.AuditUserCreated, userID, userDiff(nil, &newUser))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "user registered",
+		Data:    envelope{"user_id": userID},
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
+
+// passwordChangeRequired issues a token limited to the change-password
+// endpoint, and tells the client the password has to be changed first
+func (app *applicationConfig) passwordChangeRequired(w http.ResponseWriter, r *http.Request, user *models.User) {
+	token, err := app.models.Token.GenerateToken(user.UserID, 15*time.Minute, nil)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	token.PasswordChangeOnly = true
 
-	fmt.Println(*token)
-	fmt.Println(*user)
-	// save it to the database
 	err = app.models.Token.Insert(*token, *user)
 	if err != nil {
 		app.errorJSON(w, err)
+		return
+	}
+
+	app.auditAs(r, user, models.AuditTokenIssued, user.UserID, tokenDetails(token))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "password_change_required",
+		Data:    envelope{"state": "password_change_required", "token": token},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// ChangePassword is the handler used by an authenticated user to change their
+// own password. It requires the current password as well as the new one, and
+// revokes every other session, API key and OAuth refresh token of the user
+// while keeping the current token alive. When it is called with a token that was only good for changing an
+// expired password, a regular token is issued in its place.
+func (app *applicationConfig) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+
+	err = user.ChangePassword(requestPayload.CurrentPassword, requestPayload.NewPassword)
+	if errors.Is(err, models.ErrInvalidCurrentPassword) {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "password changed",
+	}
+
+	keepToken := user.Token.Token
+
+	if user.Token.PasswordChangeOnly {
+		token, err := app.models.Token.GenerateToken(user.UserID, 24*time.Hour, user.AllowedScopes())
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+
+		err = app.models.Token.Insert(*token, *user)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+
+		app.audit(r, models.AuditTokenIssued, user.UserID, tokenDetails(token))
+
+		keepToken = token.Token
+		payload.Data = envelope{"token": token}
+	}
+
+	err = app.models.Token.RevokeOtherCredentialsForUser(user.UserID, keepToken)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, models.AuditTokenRevoked, user.UserID, models.AuditDiff{"reason": {To: "password changed"}})
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// Me returns the profile of the authenticated user
+func (app *applicationConfig) Me(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	// an admin acting as the user is told so
+	view := newUserView(user, visibilitySelf)
+	view.ImpersonatedBy = user.ImpersonatedBy()
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    view,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// UpdateMe lets the authenticated user edit their own first name, last name
+// and email. Fields left out of the request are not changed. Changing the
+// email address means it has to be verified again. Directory accounts keep
+// the address the directory knows them by, and no account may move into a
+// directory's domains, where the directory's user would be signed into it.
+func (app *applicationConfig) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+		Email     *string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+	before := *user
+
+	if requestPayload.FirstName != nil {
+		user.FirstName = *requestPayload.FirstName
+	}
+	if requestPayload.LastName != nil {
+		user.LastName = *requestPayload.LastName
+	}
+	if requestPayload.Email != nil && *requestPayload.Email != user.Email {
+		if *requestPayload.Email == "" {
+			app.errorJSON(w, errors.New("email is required"))
+			return
+		}
+		if app.authenticators.For(user.Email) != nil {
+			app.errorJSON(w, errors.New("the email of this account is managed by a directory"), http.StatusForbidden)
+			return
+		}
+		if app.authenticators.For(*requestPayload.Email) != nil {
+			app.errorJSON(w, errors.New("accounts for this email domain are managed by a directory"), http.StatusForbidden)
+			return
+		}
+		user.Email = *requestPayload.Email
+		user.EmailVerifiedAt = models.NullTime{}
+	}
+
+	err = user.Update()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if diff := userDiff(&before, user); len(diff) > 0 {
+		app.audit(r, models.AuditUserUpdated, user.UserID, diff)
 	}
 
-	// send back a response
-	payload = jsonResponse{
+	payload := jsonResponse{
 		Error:   false,
-		Message: "logged in",
-		Data:    envelope{"token": token, "user": user},
+		Message: "profile updated",
+		Data:    newUserView(user, visibilitySelf),
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// recentSignIn is how old the token of a user without a local password may
+// be for closing the account with it
+const recentSignIn = 5 * time.Minute
+
+// DeleteMe closes the authenticated user's account. The password has to be
+// confirmed; the account is soft deleted and every session is revoked.
+// Accounts of a directory confirm the password against the directory, and
+// other accounts without a local password need a token from a sign-in
+// through their identity provider in the last few minutes.
+func (app *applicationConfig) DeleteMe(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Password string `json:"password"`
 	}
 
-	err = app.writeJSON(w, http.StatusOK, payload)
+	err := app.readJSON(w, r, &requestPayload)
 	if err != nil {
-		app.errorLog.Println(err)
+		app.errorJSON(w, err)
+		return
+	}
+
+	user := app.authenticatedUser(r)
+
+	switch directory := app.authenticators.For(user.Email); {
+	case user.HasUsablePassword():
+		validPassword, err := user.PasswordMatches(requestPayload.Password)
+		if err != nil || !validPassword {
+			app.errorJSON(w, errors.New("password is incorrect"), http.StatusUnauthorized)
+			return
+		}
+	case directory != nil:
+		_, err := directory.Authenticate(r.Context(), user.Email, requestPayload.Password)
+		if errors.Is(err, authenticator.ErrInvalidCredentials) {
+			app.errorJSON(w, errors.New("password is incorrect"), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			app.requestLog(r).Error("directory is not available", "error", err)
+			app.errorJSON(w, errors.New("directory is not available"), http.StatusServiceUnavailable)
+			return
+		}
+	case !signedInRecently(user):
+		app.errorJSON(w, errors.New("this account signs in through an identity provider; sign in through it again, then close the account within 5 minutes"), http.StatusConflict)
+		return
+	}
+
+	err = user.SoftDelete()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, models.AuditUserDeleted, user.UserID, nil)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "account closed",
 	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
 }
 
-func (app *applicationConfig) User(w http.ResponseWriter, _ *http.Request) {
-	io.WriteString(w, "user")
+// signedInRecently reports whether user authenticated with a token of their
+// own issued by a sign-in in the last few minutes, rather than with an API
+// key, a token of an OAuth client or an old session
+func signedInRecently(user *models.User) bool {
+	if user.APIKey != nil || user.Token.ClientID.Valid || user.ImpersonatedBy() != "" {
+		return false
+	}
+
+	return time.Since(user.Token.CreatedAt) < recentSignIn
 }
 
 func (app *applicationConfig) AllUsers(w http.ResponseWriter, r *http.Request) {
 	all, err := users.Index()
 	if err != nil {
-		app.errorLog.Println(err)
+		app.requestLog(r).Error("cannot list users", "error", err)
 		return
 	}
 
 	payload := jsonResponse{
 		Error:   false,
 		Message: "success",
-		Data:    all,
+		Data:    app.newUserViews(r, all),
 	}
 
 	app.writeJSON(w, http.StatusOK, payload)
@@ -122,7 +493,7 @@ func (app *applicationConfig) getUserByID(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, user)
+	_ = app.writeJSON(w, http.StatusOK, newUserView(user, app.visibilityFor(r, user)))
 }
 
 func (app *applicationConfig) DeleteUserByID(w http.ResponseWriter, r *http.Request) {
@@ -145,6 +516,8 @@ func (app *applicationConfig) DeleteUserByID(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	app.audit(r, models.AuditUserDeleted, userID, nil)
+
 	payload := jsonResponse{
 		Error:   false,
 		Message: "User deleted",
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/authenticator"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// stubDirectory accepts testPassword for the entries it holds, by email
+type stubDirectory map[string]authenticator.Identity
+
+func (d stubDirectory) Authenticate(ctx context.Context, email, password string) (*authenticator.Identity, error) {
+	identity, ok := d[strings.ToLower(email)]
+	if !ok || password != testPassword {
+		return nil, authenticator.ErrInvalidCredentials
+	}
+
+	return &identity, nil
+}
+
+func TestUpdateMeEmailAndDirectories(t *testing.T) {
+	app, mem := newTestApp(t)
+	app.authenticators = authenticator.Domains{"corp.example": stubDirectory{
+		"alice@corp.example": {Email: "alice@corp.example", FirstName: "Alice", LastName: "Corp"},
+	}}
+	handler := app.routes()
+
+	local := createTestUser(t, app, "mallory@example.com", models.RoleUser)
+	localToken := loginTestUser(t, handler, local.Email)
+
+	// a local account cannot take an address of the directory's domain
+	rr := doRequest(t, handler, http.MethodPatch, "/users/me/", localToken, envelope{"email": "Alice@Corp.example"})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("move into the directory's domain: status %d: %s", rr.Code, rr.Body)
+	}
+
+	// so the directory's user gets an account of their own
+	directoryToken := loginTestUser(t, handler, "alice@corp.example")
+	if len(mem.rows("users")) != 2 {
+		t.Fatalf("users = %v", mem.rows("users"))
+	}
+	alice, err := app.models.User.ShowByEmail("alice@corp.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.UserID == local.UserID {
+		t.Fatal("the directory's user signed into the local account")
+	}
+
+	// and the directory account keeps the directory's address
+	rr = doRequest(t, handler, http.MethodPatch, "/users/me/", directoryToken, envelope{"email": "alice@example.com"})
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("move out of the directory: status %d: %s", rr.Code, rr.Body)
+	}
+
+	// while names and other addresses can still be changed
+	rr = doRequest(t, handler, http.MethodPatch, "/users/me/", directoryToken, envelope{"first_name": "Alicia"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("rename a directory account: status %d: %s", rr.Code, rr.Body)
+	}
+	rr = doRequest(t, handler, http.MethodPatch, "/users/me/", localToken, envelope{"email": "mallory@example.org"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("change a local address: status %d: %s", rr.Code, rr.Body)
+	}
+
+	after, err := app.models.User.ShowByID(local.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Email != "mallory@example.org" || after.EmailVerifiedAt.Valid {
+		t.Fatalf("local user after the change %+v", after)
+	}
+}
+
+func TestChangePasswordRevokesCredentials(t *testing.T) {
+	app, mem := newTestApp(t)
+	handler := app.routes()
+
+	user := createTestUser(t, app, "alice@example.com", models.RoleUser)
+	otherToken := loginTestUser(t, handler, user.Email)
+	token := loginTestUser(t, handler, user.Email)
+
+	key, err := app.models.APIKey.GenerateAPIKey(user.UserID, "ci", user.AllowedScopes(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.APIKey.Insert(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.models.RefreshToken.IssueRefreshToken("client", user.UserID, user.AllowedScopes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := doRequest(t, handler, http.MethodPost, "/users/me/password", token, envelope{"current_password": testPassword, "new_password": "An0therHorseBattery"})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("change password: status %d: %s", rr.Code, rr.Body)
+	}
+
+	if n := len(mem.rows("api_keys")); n != 0 {
+		t.Errorf("%d API keys survived the change", n)
+	}
+	if n := len(mem.rows("oauth_refresh_tokens")); n != 0 {
+		t.Errorf("%d refresh tokens survived the change", n)
+	}
+	if rr := doRequest(t, handler, http.MethodGet, "/users/me/", otherToken, nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("other session: status %d", rr.Code)
+	}
+	if rr := doRequest(t, handler, http.MethodGet, "/users/me/", token, nil); rr.Code != http.StatusOK {
+		t.Errorf("current session: status %d: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestErrorsCarryRequestID(t *testing.T) {
+	app, _ := newTestApp(t)
+	handler := app.routes()
+
+	tests := []struct {
+		name, method, path string
+		body               interface{}
+	}{
+		{name: "no credentials", method: http.MethodGet, path: "/users/me/"},
+		{name: "bad request", method: http.MethodPost, path: "/auth/login", body: envelope{"email": "nobody@example.com", "password": "wrong"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			if tt.body != nil {
+				_ = json.NewEncoder(&body).Encode(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, tt.path, &body)
+			req.Header.Set(requestIDHeader, "report-me-42")
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			var response jsonResponse
+			err := json.Unmarshal(rr.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rr.Code < 400 || !response.Error || response.RequestID != "report-me-42" || rr.Header().Get(requestIDHeader) != "report-me-42" {
+				t.Fatalf("status %d, X-Request-ID %q: %s", rr.Code, rr.Header().Get(requestIDHeader), rr.Body)
+			}
+		})
+	}
+}
+
+func TestCloseAccountRevokesCredentials(t *testing.T) {
+	app, mem := newTestApp(t)
+	handler := app.routes()
+
+	user := createTestUser(t, app, "alice@example.com", models.RoleUser)
+	token := loginTestUser(t, handler, user.Email)
+
+	key, err := app.models.APIKey.GenerateAPIKey(user.UserID, "ci", user.AllowedScopes(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.APIKey.Insert(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = app.models.RefreshToken.IssueRefreshToken("client", user.UserID, user.AllowedScopes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := doRequest(t, handler, http.MethodDelete, "/users/me/", token, envelope{"password": testPassword})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("close account: status %d: %s", rr.Code, rr.Body)
+	}
+
+	for _, table := range []string{"tokens", "api_keys", "oauth_refresh_tokens"} {
+		if n := len(mem.rows(table)); n != 0 {
+			t.Errorf("%d rows of %s survived the account", n, table)
+		}
+	}
+}
+
+func TestPasswordPolicyViolations(t *testing.T) {
+	app, mem := newTestApp(t)
+	handler := app.routes()
+
+	rr := doRequest(t, handler, http.MethodPost, "/auth/register", "", envelope{"email": "weak@example.com", "password": "weak"})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, want %d: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+
+	var response struct {
+		Data struct {
+			Violations []models.PasswordViolation `json:"violations"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var codes []string
+	for _, v := range response.Data.Violations {
+		if v.Message == "" {
+			t.Errorf("violation %s has no message", v.Code)
+		}
+		codes = append(codes, v.Code)
+	}
+	if strings.Join(codes, ",") != "too_short,missing_upper,missing_digit" {
+		t.Fatalf("violations = %v", codes)
+	}
+	if len(mem.rows("users")) != 0 {
+		t.Fatal("the user was created")
+	}
+
+	// the debug route that created a fixed user is gone
+	rr = doRequest(t, handler, http.MethodGet, "/users/add", "", nil)
+	if rr.Code == http.StatusOK || len(mem.rows("users")) != 0 {
+		t.Fatalf("/users/add: status %d: %s", rr.Code, rr.Body)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// check statuses
+const (
+	checkOK   = "ok"
+	checkFail = "fail"
+)
+
+// checkResult is the outcome of one readiness check. /readyz is public, so
+// why a check failed only goes to the log.
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+// Healthz tells whether the process is alive. It checks nothing else, so a
+// database outage does not get the API restarted.
+func (app *applicationConfig) Healthz(w http.ResponseWriter, r *http.Request) {
+	payload := jsonResponse{
+		Error:   false,
+		Message: "alive",
+		Data:    envelope{"status": checkOK},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// Readyz tells whether the API should get traffic: the database answers, its
+// schema is migrated far enough, and the server is not shutting down. Each
+// check is reported with how long it took.
+func (app *applicationConfig) Readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), app.readinessTimeout)
+	defer cancel()
+
+	checks := map[string]checkResult{
+		"database":   app.timeCheck(r, "database", func() (envelope, error) { return nil, models.Ping(ctx) }),
+		"migrations": app.timeCheck(r, "migrations", func() (envelope, error) { return checkMigrations(ctx) }),
+		"shutdown":   app.timeCheck(r, "shutdown", app.checkShutdown),
+	}
+
+	ready := true
+	for _, check := range checks {
+		if check.Status != checkOK {
+			ready = false
+		}
+	}
+
+	status, message, state := http.StatusOK, "ready", checkOK
+	if !ready {
+		status, message, state = http.StatusServiceUnavailable, "not ready", checkFail
+	}
+
+	payload := jsonResponse{
+		Error:   !ready,
+		Message: message,
+		Data:    envelope{"status": state, "checks": checks},
+	}
+
+	_ = app.writeJSON(w, status, payload)
+}
+
+// timeCheck runs the check called name and times it. Failures are logged
+// with their error and details, which the response leaves out.
+func (app *applicationConfig) timeCheck(r *http.Request, name string, check func() (envelope, error)) checkResult {
+	start := time.Now()
+	details, err := check()
+
+	result := checkResult{
+		Status:    checkOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = checkFail
+		app.requestLog(r).Warn("readiness check failed", "check", name, "error", err, "details", details)
+	}
+
+	return result
+}
+
+// checkMigrations checks that the database is at least at the schema version
+// the models expect and that no migration failed half way. A newer schema is
+// fine, so instances of the previous release keep serving while the next
+// one rolls out.
+func checkMigrations(ctx context.Context) (envelope, error) {
+	migration, err := models.CurrentSchemaMigration(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("no migration has been applied")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	details := envelope{"version": migration.Version, "expected": models.SchemaVersion, "dirty": migration.Dirty}
+
+	switch {
+	case migration.Dirty:
+		return details, fmt.Errorf("migration %d failed and needs fixing", migration.Version)
+	case migration.Version < models.SchemaVersion:
+		return details, fmt.Errorf("schema is at version %d, need %d", migration.Version, models.SchemaVersion)
+	}
+
+	return details, nil
+}
+
+// checkShutdown fails once the server has started shutting down, so no new
+// traffic is sent while running requests drain
+func (app *applicationConfig) checkShutdown() (envelope, error) {
+	if app.draining.Load() {
+		return nil, errors.New("shutting down")
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReadyzHidesErrors makes sure the public /readyz tells which checks
+// failed, but not why
+func TestReadyzHidesErrors(t *testing.T) {
+	app, _ := newTestApp(t)
+	app.readinessTimeout = time.Second
+	app.draining.Store(true)
+	handler := app.routes()
+
+	rr := doRequest(t, handler, http.MethodGet, "/readyz", "", nil)
+	if rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), `"shutdown":{"status":"fail"`) {
+		t.Fatalf("status %d: %s", rr.Code, rr.Body)
+	}
+
+	for _, leak := range []string{"shutting down", "no migration", "version", "details"} {
+		if strings.Contains(rr.Body.String(), leak) {
+			t.Fatalf("response tells %q: %s", leak, rr.Body)
+		}
+	}
+}
@@ -1,13 +1,83 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
 )
 
+type contextKey string
+
+const authenticatedUserKey contextKey = "authenticatedUser"
+
+// authenticatedUser returns the user stored in the request context by the
+// authToken middleware, or nil when the request was not authenticated
+func (app *applicationConfig) authenticatedUser(r *http.Request) *models.User {
+	user, ok := r.Context().Value(authenticatedUserKey).(*models.User)
+	if !ok {
+		return nil
+	}
+
+	return user
+}
+
+// requestLog returns the logger for r, which adds the fields of the request
+// to every entry: its ID, method and path, set by the requestLogger
+// middleware, the route it matched and the authenticated user, if there is one
+func (app *applicationConfig) requestLog(r *http.Request) *logging.Logger {
+	logger := logging.FromContext(r.Context(), app.logger)
+
+	if route := chi.RouteContext(r.Context()); route != nil && route.RoutePattern() != "" {
+		logger = logger.With("route", route.RoutePattern())
+	}
+	if user := app.authenticatedUser(r); user != nil {
+		logger = logger.With("user_id", user.UserID)
+	}
+
+	return logger
+}
+
+// withAuthenticatedUser returns a copy of r with user stored as the
+// authenticated user
+func withAuthenticatedUser(r *http.Request, user *models.User) *http.Request {
+	if entry, ok := r.Context().Value(accessLogEntryKey).(*accessLogEntry); ok {
+		entry.userID = user.UserID
+	}
+
+	ctx := context.WithValue(r.Context(), authenticatedUserKey, user)
+
+	return r.WithContext(ctx)
+}
+
+// maxTokenTTL is the longest lifetime a client may ask for when creating a token
+const maxTokenTTL = 30 * 24 * time.Hour
+
+// requestedScopes checks the scopes a client asked for against the ones it may
+// have. Asking for nothing means asking for everything allowed.
+func requestedScopes(requested []string, allowed models.Scopes) (models.Scopes, error) {
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+
+	scopes := models.ParseScopes(strings.Join(requested, " "))
+	for _, scope := range scopes {
+		if !allowed.Has(scope) {
+			return nil, fmt.Errorf("scope %q is not allowed", scope)
+		}
+	}
+
+	return scopes, nil
+}
+
 // readJSON tries to read the body of a request and converts it into JSON
 func (app *applicationConfig) readJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
 	maxBytes := 1048576 // one megabyte
@@ -51,7 +121,9 @@ func (app *applicationConfig) writeJSON(w http.ResponseWriter, status int, data
 		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
 	w.WriteHeader(status)
 	_, err := w.Write(output)
 	if err != nil {
@@ -62,7 +134,8 @@ func (app *applicationConfig) writeJSON(w http.ResponseWriter, status int, data
 }
 
 // errorJSON takes an error, and optionally a response status code, and generates and sends
-// a json error response
+// a json error response. The response carries the request ID, so a user
+// reporting an error hands us what finds it in the logs.
 func (app *applicationConfig) errorJSON(w http.ResponseWriter, err error, status ...int) error {
 	statusCode := http.StatusBadRequest
 
@@ -71,8 +144,14 @@ func (app *applicationConfig) errorJSON(w http.ResponseWriter, err error, status
 	}
 
 	var customErr error
+	var data interface{}
+	var policyErr *models.PasswordPolicyError
 
 	switch {
+	case errors.As(err, &policyErr):
+		customErr = errors.New("password does not satisfy the password policy")
+		statusCode = http.StatusUnprocessableEntity
+		data = envelope{"violations": policyErr.Violations}
 	case strings.Contains(err.Error(), "SQLSTATE 23505"):
 		customErr = errors.New("duplicate value violates unique constraint")
 		statusCode = http.StatusForbidden
@@ -89,6 +168,8 @@ func (app *applicationConfig) errorJSON(w http.ResponseWriter, err error, status
 	var payload jsonResponse
 	payload.Error = true
 	payload.Message = customErr.Error()
+	payload.Data = data
+	payload.RequestID = w.Header().Get(requestIDHeader)
 
 	app.writeJSON(w, statusCode, payload)
 
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/authenticator"
+	apidriver "github.com/hiroshi-iwashita/20221202_golang/internal/driver"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/federation"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/loginrisk"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/oidc"
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testPassword satisfies the default password policy
+const testPassword = "Corr3ctHorseBattery"
+
+// newTestApp returns the API backed by an in-memory database, holding what
+// the migrations leave behind, and nothing configured beyond the defaults
+func newTestApp(t *testing.T) (*applicationConfig, *memDB) {
+	t.Helper()
+
+	mem := newMemDB()
+	mem.insert("audit_chain_head", map[string]driver.Value{"id": int64(1), "event_id": int64(0), "hash": ""})
+
+	sqlDB := mem.open()
+	t.Cleanup(func() { _ = sqlDB.Close() })
+	db := &apidriver.DB{SQL: sqlx.NewDb(sqlDB, "mysql")}
+
+	logger = logging.Discard()
+	models.SetLogger(logger)
+	models.SetPasswordPolicy(models.DefaultPasswordPolicy())
+
+	signer, err := oidc.GenerateSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	metrics, err := newAPIMetrics(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &applicationConfig{
+		port:                8080,
+		logger:              logger,
+		db:                  db,
+		models:              models.New(db.SQL),
+		environment:         "test",
+		issuer:              "http://api.test",
+		idTokenSigner:       signer,
+		federationProviders: map[string]*federation.Provider{},
+		samlProviders:       map[string]*federation.SAMLProvider{},
+		authenticators:      authenticator.Domains{},
+		loginAssessor:       loginrisk.NewAssessor(nil),
+		loginNotifier:       &loginrisk.LogNotifier{Log: logger},
+		metricsRegistry:     registry,
+		metrics:             metrics,
+	}
+
+	return app, mem
+}
+
+// createTestUser adds a user with testPassword and the given role
+func createTestUser(t *testing.T, app *applicationConfig, email, role string) *models.User {
+	t.Helper()
+
+	userID, err := app.models.User.Insert(models.User{
+		FirstName: "Test",
+		LastName:  "User",
+		Email:     email,
+		Password:  testPassword,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := app.models.User.ShowByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if role != models.RoleUser {
+		err = user.SetRole(role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return user
+}
+
+// loginTestUser logs in with testPassword and returns the token
+func loginTestUser(t *testing.T, handler http.Handler, email string) string {
+	t.Helper()
+
+	rr := doRequest(t, handler, http.MethodPost, "/auth/login", "", envelope{"email": email, "password": testPassword})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("login as %s: status %d: %s", email, rr.Code, rr.Body)
+	}
+
+	var response struct {
+		Data struct {
+			Token struct {
+				Token string `json:"token"`
+			} `json:"token"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response.Data.Token.Token
+}
+
+// doRequest sends a request to handler, with body as JSON and token as the
+// bearer token when they are given
+func doRequest(t *testing.T, handler http.Handler, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&reader).Encode(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, &reader)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// maxImpersonationTTL is the longest an impersonation token can live
+const maxImpersonationTTL = time.Hour
+
+// errImpersonating is returned for operations that are blocked while an
+// admin is acting as another user
+var errImpersonating = errors.New("not allowed while impersonating a user")
+
+// Impersonate issues an admin a short lived token that acts as another user,
+// so support can see exactly what that user sees. The token carries the
+// user's own scopes and records the admin as its impersonator.
+func (app *applicationConfig) Impersonate(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		ExpiresIn int `json:"expires_in"`
+	}
+
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &requestPayload)
+		if err != nil {
+			app.errorJSON(w, err)
+			return
+		}
+	}
+
+	admin := app.authenticatedUser(r)
+
+	subject, err := app.models.User.ShowByID(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errors.New("user not found"), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case subject.UserID == admin.UserID:
+		app.errorJSON(w, errors.New("you cannot impersonate yourself"))
+		return
+	case subject.IsAdmin():
+		app.errorJSON(w, errors.New("admins cannot be impersonated"), http.StatusForbidden)
+		return
+	case subject.DeletedAt.Valid:
+		app.errorJSON(w, errors.New("account is closed"), http.StatusForbidden)
+		return
+	}
+
+	ttl := maxImpersonationTTL
+	if requestPayload.ExpiresIn > 0 {
+		ttl = time.Duration(requestPayload.ExpiresIn) * time.Second
+	}
+	if ttl > maxImpersonationTTL {
+		ttl = maxImpersonationTTL
+	}
+
+	token, err := app.models.Token.GenerateToken(subject.UserID, ttl, subject.AllowedScopes())
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	token.ImpersonatorID = models.NullString{NullString: sql.NullString{String: admin.UserID, Valid: true}}
+
+	err = app.models.Token.Insert(*token, *subject)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	app.audit(r, models.AuditImpersonationStarted, subject.UserID, tokenDetails(token))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "acting as " + subject.Email,
+		Data:    envelope{"token": token, "user": newUserView(subject, visibilityAdmin)},
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
+
+// blockImpersonation refuses the request when the caller is an admin acting
+// as another user. It guards destructive operations, profile changes such as
+// the email address a password reset goes to, and anything that would mint
+// credentials outliving the impersonation token. It has to run after
+// authToken.
+func (app *applicationConfig) blockImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.authenticatedUser(r)
+		if user != nil && user.ImpersonatedBy() != "" {
+			app.errorJSON(w, errImpersonating, http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// auditImpersonation records every request made with an impersonation token
+// in the audit log, with the response status
+func (app *applicationConfig) auditImpersonation(next http.Handler, user *models.User) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		app.auditAs(r, user, models.AuditImpersonatedRequest, user.UserID, models.AuditDiff{
+			"method": {To: r.Method},
+			"path":   {To: r.URL.Path},
+			"status": {To: ww.Status()},
+		})
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// TestImpersonationIsReadOnly makes sure an admin acting as a user sees what
+// the user sees, but cannot change the account or mint credentials for it
+func TestImpersonationIsReadOnly(t *testing.T) {
+	app, _ := newTestApp(t)
+	handler := app.routes()
+
+	admin := createTestUser(t, app, "admin@example.com", models.RoleAdmin)
+	user := createTestUser(t, app, "user@example.com", models.RoleUser)
+
+	rr := doRequest(t, handler, http.MethodPost, "/admin/users/"+user.UserID+"/impersonate", loginTestUser(t, handler, admin.Email), nil)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("impersonate: status %d: %s", rr.Code, rr.Body)
+	}
+
+	var response struct {
+		Data struct {
+			Token struct {
+				Token string `json:"token"`
+			} `json:"token"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := response.Data.Token.Token
+
+	rr = doRequest(t, handler, http.MethodGet, "/users/me/", token, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("me: status %d: %s", rr.Code, rr.Body)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+	}{
+		{name: "change email", method: http.MethodPatch, path: "/users/me/", body: envelope{"email": "attacker@example.com"}},
+		{name: "change name", method: http.MethodPatch, path: "/users/me/", body: envelope{"first_name": "Renamed"}},
+		{name: "change password", method: http.MethodPost, path: "/users/me/password", body: envelope{"old_password": testPassword, "new_password": testPassword + "!"}},
+		{name: "close account", method: http.MethodDelete, path: "/users/me/", body: envelope{"password": testPassword}},
+		{name: "create API key", method: http.MethodPost, path: "/users/me/api-keys", body: envelope{"name": "kept"}},
+		{name: "create token", method: http.MethodPost, path: "/auth/tokens", body: envelope{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doRequest(t, handler, tt.method, tt.path, token, tt.body)
+			if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), errImpersonating.Error()) {
+				t.Fatalf("status %d, want %d: %s", rr.Code, http.StatusForbidden, rr.Body)
+			}
+		})
+	}
+
+	after, err := app.models.User.ShowByID(user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := after.PasswordMatches(testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Email != user.Email || after.FirstName != user.FirstName || after.DeletedAt.Valid || !matches {
+		t.Fatalf("user changed while impersonated: %+v", after)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/loginrisk"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// login history sizes
+const (
+	loginHistoryCompared = 50
+	loginHistoryDefault  = 20
+	loginHistoryMax      = 100
+)
+
+// loginMethodPassword is the method of logins with an email and password,
+// checked locally or against a directory
+const loginMethodPassword = "password"
+
+// notifyTimeout bounds how long sending a notice may take
+const notifyTimeout = 10 * time.Second
+
+// currentLogin describes the login request r is making
+func (app *applicationConfig) currentLogin(r *http.Request) loginrisk.Login {
+	ip := clientIP(r)
+
+	return loginrisk.Login{
+		IP:        ip,
+		UserAgent: truncate(r.UserAgent(), 512),
+		Time:      time.Now(),
+		Location:  app.loginAssessor.Locate(ip),
+	}
+}
+
+// recordLoginAttempt adds an attempt to the login history. Failing to
+// record it is logged, but does not fail the login.
+func (app *applicationConfig) recordLoginAttempt(r *http.Request, userID, email, method, outcome string, flags []string) {
+	app.metrics.logins.WithLabelValues(method, outcome).Inc()
+
+	login := app.currentLogin(r)
+
+	attempt := models.LoginAttempt{
+		UserID:    userID,
+		Email:     truncate(email, 191),
+		Method:    method,
+		Outcome:   outcome,
+		Flags:     flags,
+		IP:        login.IP,
+		UserAgent: login.UserAgent,
+	}
+	if login.Location != nil {
+		attempt.Latitude = sql.NullFloat64{Float64: login.Location.Latitude, Valid: true}
+		attempt.Longitude = sql.NullFloat64{Float64: login.Location.Longitude, Valid: true}
+	}
+
+	err := app.models.LoginAttempt.Insert(attempt)
+	if err != nil {
+		app.requestLog(r).Error("cannot record login attempt", "error", err)
+	}
+}
+
+// assessLogin compares a login by user to their earlier ones and returns
+// what is suspicious about it. When the history cannot be read the login
+// is let through unflagged.
+func (app *applicationConfig) assessLogin(r *http.Request, user *models.User, login loginrisk.Login) []string {
+	attempts, err := app.models.LoginAttempt.RecentSuccessful(user.UserID, loginHistoryCompared)
+	if err != nil {
+		app.requestLog(r).Error("cannot read login history", "error", err)
+		return nil
+	}
+
+	history := make([]loginrisk.Login, 0, len(attempts))
+	for _, attempt := range attempts {
+		previous := loginrisk.Login{
+			IP:        attempt.IP,
+			UserAgent: attempt.UserAgent,
+			Time:      attempt.CreatedAt,
+		}
+		if attempt.Latitude.Valid && attempt.Longitude.Valid {
+			previous.Location = &loginrisk.Location{Latitude: attempt.Latitude.Float64, Longitude: attempt.Longitude.Float64}
+		}
+		history = append(history, previous)
+	}
+
+	return app.loginAssessor.Assess(login, history)
+}
+
+// notice builds a notice of kind about a login by user
+func notice(kind string, user *models.User, login loginrisk.Login, flags []string) loginrisk.Notice {
+	return loginrisk.Notice{
+		Kind:      kind,
+		UserID:    user.UserID,
+		Email:     user.Email,
+		IP:        login.IP,
+		UserAgent: login.UserAgent,
+		Flags:     flags,
+		Time:      login.Time,
+	}
+}
+
+// completeLogin finishes a login by a user whose credentials have been
+// checked. Suspicious logins are reported to the user, and when step-up is
+// on they have to be confirmed with a code before a token is issued.
+func (app *applicationConfig) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User, method string, scopes models.Scopes) {
+	login := app.currentLogin(r)
+	flags := app.assessLogin(r, user, login)
+
+	if len(flags) > 0 {
+		// the user is told even when step-up stops the login
+		logger := app.requestLog(r)
+		go func(n loginrisk.Notice) {
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+
+			err := app.loginNotifier.Notify(ctx, n)
+			if err != nil {
+				logger.Error("cannot send login notice", "error", err)
+			}
+		}(notice(loginrisk.NoticeSuspiciousLogin, user, login, flags))
+
+		if app.loginStepUp {
+			app.requireStepUp(w, r, user, method, scopes, login, flags)
+			return
+		}
+	}
+
+	app.recordLoginAttempt(r, user.UserID, user.Email, method, models.LoginSucceeded, flags)
+	app.issueLoginToken(w, r, user, method, scopes, flags)
+}
+
+// requireStepUp holds back a suspicious login, sends the user a one-time
+// code, and tells the client to send it to the step-up endpoint
+func (app *applicationConfig) requireStepUp(w http.ResponseWriter, r *http.Request, user *models.User, method string, scopes models.Scopes, login loginrisk.Login, flags []string) {
+	challenge, err := app.models.LoginChallenge.IssueLoginChallenge(user.UserID, method, scopes, flags)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), notifyTimeout)
+	defer cancel()
+
+	stepUp := notice(loginrisk.NoticeStepUpCode, user, login, flags)
+	stepUp.Code = challenge.Code
+
+	err = app.loginNotifier.Notify(ctx, stepUp)
+	if err != nil {
+		app.requestLog(r).Error("cannot send step-up code", "error", err)
+		app.errorJSON(w, errors.New("cannot send a confirmation code, try again later"), http.StatusServiceUnavailable)
+		return
+	}
+
+	app.recordLoginAttempt(r, user.UserID, user.Email, method, models.LoginStepUpRequired, flags)
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "step_up_required",
+		Data: envelope{
+			"state":      "step_up_required",
+			"challenge":  challenge.Challenge,
+			"expires_in": int(models.LoginChallengeTTL.Seconds()),
+		},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// issueLoginToken issues the token a login ends with and sends it back
+// along with the user
+func (app *applicationConfig) issueLoginToken(w http.ResponseWriter, r *http.Request, user *models.User, method string, scopes models.Scopes, flags []string) {
+	token, err := app.models.Token.GenerateToken(user.UserID, 24*time.Hour, scopes)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.Token.Insert(*token, *user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	details := models.AuditDiff{"method": {To: method}}
+	if len(flags) > 0 {
+		details["flags"] = models.AuditChange{To: flags}
+	}
+	app.auditAs(r, user, models.AuditLoginSucceeded, user.UserID, details)
+	app.auditAs(r, user, models.AuditTokenIssued, user.UserID, tokenDetails(token))
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "logged in",
+		Data:    envelope{"token": token, "user": newUserView(user, visibilitySelf)},
+	}
+
+	err = app.writeJSON(w, http.StatusOK, payload)
+	if err != nil {
+		app.requestLog(r).Error("cannot write response", "error", err)
+	}
+}
+
+// StepUpLogin completes a login that was held back as suspicious, once the
+// user sends the code we sent them
+func (app *applicationConfig) StepUpLogin(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	challenge, err := app.models.LoginChallenge.ConsumeLoginChallenge(requestPayload.Challenge, requestPayload.Code)
+	if err != nil && !errors.Is(err, models.ErrWrongStepUpCode) {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	wrongCode := err
+
+	user, err := app.models.User.ShowByID(challenge.UserID)
+	if err != nil {
+		app.errorJSON(w, models.ErrInvalidLoginChallenge, http.StatusUnauthorized)
+		return
+	}
+
+	if wrongCode != nil {
+		app.recordLoginAttempt(r, user.UserID, user.Email, challenge.Method, models.LoginStepUpFailed, challenge.Flags)
+		app.audit(r, models.AuditLoginFailed, user.UserID, models.AuditDiff{
+			"method": {To: challenge.Method},
+			"reason": {To: "wrong step-up code"},
+		})
+		app.errorJSON(w, wrongCode, http.StatusUnauthorized)
+		return
+	}
+
+	// the account may have been closed while the code was on its way
+	if user.DeletedAt.Valid {
+		app.errorJSON(w, errors.New("account is closed"), http.StatusForbidden)
+		return
+	}
+
+	app.recordLoginAttempt(r, user.UserID, user.Email, challenge.Method, models.LoginStepUpPassed, challenge.Flags)
+	app.issueLoginToken(w, r, user, challenge.Method, challenge.Scopes, challenge.Flags)
+}
+
+// loginAttemptView is how a login attempt is shown to the user it was for
+type loginAttemptView struct {
+	Method    string    `json:"method"`
+	Outcome   string    `json:"outcome"`
+	Flags     []string  `json:"flags,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MyLogins lists the authenticated user's most recent login attempts,
+// newest first, so they can spot logins that were not theirs
+func (app *applicationConfig) MyLogins(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		limit = loginHistoryDefault
+	}
+	if limit > loginHistoryMax {
+		limit = loginHistoryMax
+	}
+
+	attempts, err := app.models.LoginAttempt.IndexForUser(user.UserID, limit)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	views := make([]loginAttemptView, 0, len(attempts))
+	for _, attempt := range attempts {
+		views = append(views, loginAttemptView{
+			Method:    attempt.Method,
+			Outcome:   attempt.Outcome,
+			Flags:     attempt.Flags,
+			IP:        attempt.IP,
+			UserAgent: attempt.UserAgent,
+			CreatedAt: attempt.CreatedAt,
+		})
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    views,
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
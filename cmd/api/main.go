@@ -1,100 +1,364 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/hiroshi-iwashita/20221202_golang/internal/authenticator"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/config"
 	"github.com/hiroshi-iwashita/20221202_golang/internal/driver"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/federation"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/loginrisk"
 	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
-	"github.com/jmoiron/sqlx"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/oidc"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // // application is the type for all data we want to share with the
 // // various parts of our application. We will share this information
 // // in most cases by using this type as the receiver for functions.
 type applicationConfig struct {
-	port         int
-	infoLog      *log.Logger
-	errorLog     *log.Logger
-	models       models.Models
-	environment  string
-	inProduction bool
+	port                int
+	logger              *logging.Logger
+	db                  *driver.DB
+	models              models.Models
+	environment         string
+	inProduction        bool
+	issuer              string
+	consentURL          string
+	federationRedirect  string
+	idTokenSigner       *oidc.Signer
+	federationProviders map[string]*federation.Provider
+	samlProviders       map[string]*federation.SAMLProvider
+	authenticators      authenticator.Domains
+	loginAssessor       *loginrisk.Assessor
+	loginNotifier       loginrisk.Notifier
+	loginStepUp         bool
+	readinessTimeout    time.Duration
+	metricsRegistry     *prometheus.Registry
+	metrics             *apiMetrics
+	draining            atomic.Bool
 }
 
-var port int
-var dbConnectRetryTimes int
-var infoLog *log.Logger
-var errorLog *log.Logger
-var environment string
-var inProduction bool
+var logger *logging.Logger
 
-func init() {
-	// fmt.Println("main.init")
+func main() {
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// set port number
-	eap := os.Getenv("API_PORT")
-	p, _ := strconv.Atoi(eap)
-	port = p
+	if cfg.PrintConfig {
+		err = cfg.Print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	// set DB connect retry times
-	dbcrt := os.Getenv("DB_CONNECT_RETRY")
-	dc, _ := strconv.Atoi(dbcrt)
-	dbConnectRetryTimes = dc
+	// setup logger, JSON in production and text otherwise
+	logger = cfg.Logger(os.Stdout)
+	models.SetLogger(logger)
 
-	// setup infoLog
-	infoLog = log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	// SIGINT or SIGTERM abandons the startup, even while waiting for the
+	// database, and once the server is up shuts it down gracefully. A second
+	// signal kills the process as usual.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	// setup errorLog
-	errorLog = log.New(os.Stdout, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	db, err := runDB(ctx, cfg)
+	if err != nil {
+		fatal("cannot connect to database", err)
+	}
+	logger.Info("connected to database", "attempts", db.ConnectAttempts)
+	models.SetDBTimeout(cfg.DB.Timeout)
 
-	// set environment
-	environment = os.Getenv("ENV")
+	passwordPolicy := cfg.PasswordPolicy()
+	if cfg.Password.BreachedFile != "" {
+		breached, err := models.LoadBreachedPasswords(cfg.Password.BreachedFile)
+		if err != nil {
+			fatal("cannot load breached passwords", err)
+		}
+		logger.Info("loaded breached password hashes", "count", breached.Len())
+		passwordPolicy.BreachedHashes = breached
+	}
+	models.SetPasswordPolicy(passwordPolicy)
 
-	// set inProduction
-	eip := os.Getenv("INPRODUCTION")
-	ip, _ := strconv.ParseBool(eip)
-	inProduction = ip
-}
+	idTokenSigner, err := loadIDTokenSigner(cfg)
+	if err != nil {
+		fatal("cannot load OIDC signing key", err)
+	}
 
-func main() {
-	dbPool, _ := runDB()
+	federationProviders, err := loadFederationProviders(cfg)
+	if err != nil {
+		fatal("cannot load federation providers", err)
+	}
+
+	samlProviders, err := loadSAMLProviders(ctx, cfg)
+	if err != nil {
+		fatal("cannot load SAML providers", err)
+	}
+
+	authenticators, err := loadAuthenticators(cfg)
+	if err != nil {
+		fatal("cannot load LDAP directories", err)
+	}
+
+	loginAssessor, loginNotifier, err := loadLoginRisk(cfg)
+	if err != nil {
+		fatal("cannot set up suspicious login detection", err)
+	}
+
+	metricsRegistry, err := newMetricsRegistry(db.SQL)
+	if err != nil {
+		fatal("cannot set up metrics", err)
+	}
+
+	metrics, err := newAPIMetrics(metricsRegistry)
+	if err != nil {
+		fatal("cannot set up metrics", err)
+	}
 
 	app := &applicationConfig{
-		port:         port,
-		infoLog:      infoLog,
-		errorLog:     errorLog,
-		models:       models.New(dbPool),
-		environment:  environment,
-		inProduction: inProduction,
+		port:                cfg.Server.Port,
+		logger:              logger,
+		db:                  db,
+		models:              models.New(db.SQL),
+		environment:         cfg.Environment,
+		inProduction:        cfg.InProduction,
+		issuer:              cfg.OIDC.Issuer,
+		consentURL:          cfg.OIDC.ConsentURL,
+		federationRedirect:  cfg.SSO.FederationRedirectURL,
+		idTokenSigner:       idTokenSigner,
+		federationProviders: federationProviders,
+		samlProviders:       samlProviders,
+		authenticators:      authenticators,
+		loginAssessor:       loginAssessor,
+		loginNotifier:       loginNotifier,
+		loginStepUp:         cfg.Login.StepUp,
+		readinessTimeout:    cfg.Server.ReadinessTimeout,
+		metricsRegistry:     metricsRegistry,
+		metrics:             metrics,
+	}
+
+	var metricsServer *http.Server
+	if cfg.Server.MetricsAddr != "" {
+		metricsServer, err = app.serveMetrics(cfg.Server)
+		if err != nil {
+			fatal("cannot serve metrics", err)
+		}
 	}
 
-	err := app.serveAPIPort()
+	serveErr := app.serveAPIPort(ctx, cfg.Server)
+	if serveErr != nil {
+		logger.Error("server stopped", "error", serveErr)
+	}
+
+	// metrics are scraped until the API has drained
+	if metricsServer != nil {
+		_ = metricsServer.Close()
+	}
+
+	err = db.SQL.Close()
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("cannot close database", "error", err)
+	}
+
+	logger.Info("stopped")
+	// logs are written straight to stdout; sync it in case it is a file
+	_ = os.Stdout.Sync()
+
+	if serveErr != nil {
+		os.Exit(1)
 	}
 }
 
-// runDB connects to database
-func runDB() (*sqlx.DB, error) {
-	db, err := driver.ConnectDB(dbConnectRetryTimes)
+// fatal logs an error that keeps the API from starting and exits
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// runDB connects to database, retrying until it answers or ctx is done
+func runDB(ctx context.Context, cfg *config.Config) (*driver.DB, error) {
+	return driver.ConnectDB(ctx, cfg.DB.Connection(), logger)
+}
+
+// loadIDTokenSigner loads the key ID tokens are signed with. Without a key
+// file a throwaway key is generated, which is refused in production.
+func loadIDTokenSigner(cfg *config.Config) (*oidc.Signer, error) {
+	if cfg.OIDC.SigningKeyFile != "" {
+		return oidc.LoadSigner(cfg.OIDC.SigningKeyFile)
+	}
+
+	if cfg.InProduction {
+		return nil, errors.New("OIDC_SIGNING_KEY_FILE must be set in production")
+	}
+
+	logger.Warn("OIDC_SIGNING_KEY_FILE not set, generating a temporary signing key")
+	return oidc.GenerateSigner()
+}
+
+// loadFederationProviders sets up the external OpenID Connect providers users
+// can sign in with. Without a providers file federated login is disabled.
+func loadFederationProviders(cfg *config.Config) (map[string]*federation.Provider, error) {
+	providers := make(map[string]*federation.Provider)
+	if cfg.SSO.FederationProvidersFile == "" {
+		return providers, nil
+	}
+
+	configs, err := federation.LoadConfigs(cfg.SSO.FederationProvidersFile)
 	if err != nil {
-		log.Fatal("Cannot connect to database")
+		return nil, err
 	}
 
-	return db.SQL, nil
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, config := range configs {
+		providers[config.Name] = federation.NewProvider(config, client)
+	}
+	logger.Info("loaded federation providers", "count", len(providers))
+
+	return providers, nil
 }
 
-// serveAPIPort starts the API server
-func (app *applicationConfig) serveAPIPort() error {
-	app.infoLog.Println("API listening on port", app.port)
+// loadSAMLProviders sets up the SAML identity providers users can sign in
+// with. Without a providers file SAML login is disabled.
+func loadSAMLProviders(ctx context.Context, cfg *config.Config) (map[string]*federation.SAMLProvider, error) {
+	providers := make(map[string]*federation.SAMLProvider)
+	if cfg.SSO.SAMLProvidersFile == "" {
+		return providers, nil
+	}
+
+	key, certificate, err := federation.LoadSAMLKeyPair(cfg.SSO.SAMLKeyFile, cfg.SSO.SAMLCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	configs, err := federation.LoadSAMLConfigs(cfg.SSO.SAMLProvidersFile)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, config := range configs {
+		provider, err := federation.NewSAMLProvider(ctx, config, key, certificate, client)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", config.Name, err)
+		}
+		providers[config.Name] = provider
+	}
+	logger.Info("loaded SAML providers", "count", len(providers))
+
+	return providers, nil
+}
+
+// loadAuthenticators sets up the directories that check the passwords of
+// some email domains. Without a directories file every account is local.
+func loadAuthenticators(cfg *config.Config) (authenticator.Domains, error) {
+	if cfg.SSO.LDAPDirectoriesFile == "" {
+		return authenticator.Domains{}, nil
+	}
+
+	domains, err := authenticator.LoadDomains(cfg.SSO.LDAPDirectoriesFile)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("loaded LDAP directories", "domains", len(domains))
+
+	return domains, nil
+}
+
+// loadLoginRisk sets up how suspicious logins are detected and who is told.
+// Without a locations file impossible travel is not detected, and without a
+// webhook notices are only logged, which rules out step-up.
+func loadLoginRisk(cfg *config.Config) (*loginrisk.Assessor, loginrisk.Notifier, error) {
+	var locator loginrisk.Locator
+	if cfg.Login.LocationsFile != "" {
+		ranges, err := loginrisk.LoadRangeLocator(cfg.Login.LocationsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Info("loaded IP ranges for login locations", "count", ranges.Len())
+		locator = ranges
+	}
+
+	var notifier loginrisk.Notifier = &loginrisk.LogNotifier{Log: logger}
+	if cfg.Login.WebhookURL != "" {
+		notifier = &loginrisk.WebhookNotifier{
+			URL:    cfg.Login.WebhookURL,
+			Secret: cfg.Login.WebhookSecret,
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+
+	if cfg.Login.StepUp && !notifier.DeliversCodes() {
+		return nil, nil, errors.New("LOGIN_STEP_UP needs LOGIN_WEBHOOK_URL to deliver codes")
+	}
+
+	return loginrisk.NewAssessor(locator), notifier, nil
+}
+
+// serveAPIPort starts the API server and runs it until ctx is done. It then
+// stops accepting connections and gives running requests the grace period
+// to finish, after which the remaining connections are closed.
+func (app *applicationConfig) serveAPIPort(ctx context.Context, cfg config.Server) error {
+	app.logger.Info("API listening", "port", app.port)
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%d", app.port),
-		Handler: app.routes(),
+		Addr:              fmt.Sprintf(":%d", app.port),
+		Handler:           app.routes(),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          app.logger.With("component", "http").StdLogger(logging.LevelWarn),
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	// tell the orchestrator to stop sending traffic before stopping to accept it
+	app.draining.Store(true)
+	if cfg.DrainDelay > 0 {
+		app.logger.Info("shutting down, reporting not ready before draining", "delay", cfg.DrainDelay)
+		time.Sleep(cfg.DrainDelay)
+	}
+
+	app.logger.Info("shutting down, draining running requests", "grace_period", cfg.ShutdownGrace)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGrace)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		_ = srv.Close()
+		return fmt.Errorf("requests still running after the grace period were cut off: %w", err)
 	}
 
-	return srv.ListenAndServe()
+	return nil
 }
@@ -0,0 +1,777 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// memDB is an in-memory stand-in for MySQL, for the handler tests. It is not
+// a SQL engine: it understands only the statement shapes the models run, and
+// anything else fails with a "memdb:" error, so SQL that outgrows it breaks
+// the tests instead of passing them wrongly. The shapes are:
+//
+//   - INSERT INTO table (columns) VALUES (operands)
+//   - SELECT *, columns with an optional AS alias, or COUNT(*) on its own,
+//     FROM one table, with an optional WHERE, ORDER BY one column ASC or DESC,
+//     LIMIT with an optional OFFSET, and FOR UPDATE
+//   - UPDATE table SET column = operand, or operand + operand, with an
+//     optional WHERE
+//   - DELETE FROM table with an optional WHERE
+//
+// A WHERE is made of =, <>, !=, <, <=, >, >=, IS NULL, IS NOT NULL, IN (list)
+// and LIKE, joined by AND and OR and grouped with parentheses. Operands are
+// columns, ? arguments, NULL, quoted strings and integers, and comparisons
+// with NULL are false, as in SQL. Every table gets an auto increment id.
+//
+// Joins, subqueries, GROUP BY, functions other than COUNT(*), ON DUPLICATE
+// KEY UPDATE, unique and foreign keys, column types and defaults (beyond
+// the ones set in newMemDB) are not supported. Transactions are accepted but
+// write straight through: Rollback undoes nothing and locks are not taken.
+// Constraints, locking and isolation need testing against MySQL.
+type memDB struct {
+	mu       sync.Mutex
+	tables   map[string][]map[string]driver.Value
+	defaults map[string]map[string]driver.Value
+	nextID   map[string]int64
+}
+
+func newMemDB() *memDB {
+	return &memDB{
+		tables: make(map[string][]map[string]driver.Value),
+		defaults: map[string]map[string]driver.Value{
+			"users": {
+				"role":              "user",
+				"email_verified_at": nil,
+				"deleted_at":        nil,
+			},
+		},
+		nextID: make(map[string]int64),
+	}
+}
+
+// open returns a database/sql handle on m
+func (m *memDB) open() *sql.DB {
+	return sql.OpenDB(memConnector{m})
+}
+
+// rows returns a copy of the rows of table
+func (m *memDB) rows(table string) []map[string]driver.Value {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var rows []map[string]driver.Value
+	for _, row := range m.tables[table] {
+		rows = append(rows, copyRow(row))
+	}
+
+	return rows
+}
+
+// insert adds a row to table, filling in the defaults and the id
+func (m *memDB) insert(table string, values map[string]driver.Value) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.insertLocked(table, values)
+}
+
+func (m *memDB) insertLocked(table string, values map[string]driver.Value) int64 {
+	row := make(map[string]driver.Value)
+	for column, value := range m.defaults[table] {
+		row[column] = value
+	}
+	for column, value := range values {
+		row[column] = value
+	}
+
+	// like a MySQL AUTO_INCREMENT column outside strict mode, an id that is
+	// not a number is replaced with the next one
+	m.nextID[table]++
+	id, ok := toInt(row["id"])
+	if !ok {
+		id = m.nextID[table]
+		row["id"] = id
+	}
+
+	m.tables[table] = append(m.tables[table], row)
+
+	return id
+}
+
+// columns lists the columns of table, known from its defaults and rows
+func (m *memDB) columns(table string) []string {
+	set := map[string]bool{"id": true}
+	for column := range m.defaults[table] {
+		set[column] = true
+	}
+	for _, row := range m.tables[table] {
+		for column := range row {
+			set[column] = true
+		}
+	}
+
+	columns := make([]string, 0, len(set))
+	for column := range set {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	return columns
+}
+
+func copyRow(row map[string]driver.Value) map[string]driver.Value {
+	c := make(map[string]driver.Value, len(row))
+	for k, v := range row {
+		c[k] = v
+	}
+	return c
+}
+
+type memConnector struct{ db *memDB }
+
+func (c memConnector) Connect(context.Context) (driver.Conn, error) { return &memConn{c.db}, nil }
+func (c memConnector) Driver() driver.Driver                        { return memDriver{} }
+
+type memDriver struct{}
+
+func (memDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("memdb: open through memDB.open")
+}
+
+type memConn struct{ db *memDB }
+
+func (c *memConn) Prepare(query string) (driver.Stmt, error) { return &memStmt{c, query}, nil }
+func (c *memConn) Close() error                              { return nil }
+func (c *memConn) Begin() (driver.Tx, error)                 { return memTx{}, nil }
+
+func (c *memConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.db.exec(query, namedValues(args))
+}
+
+func (c *memConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.db.query(query, namedValues(args))
+}
+
+func namedValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+type memTx struct{}
+
+func (memTx) Commit() error   { return nil }
+func (memTx) Rollback() error { return nil }
+
+type memStmt struct {
+	conn  *memConn
+	query string
+}
+
+func (s *memStmt) Close() error  { return nil }
+func (s *memStmt) NumInput() int { return -1 }
+
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.db.exec(s.query, args)
+}
+
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.db.query(s.query, args)
+}
+
+type memResult struct{ lastID, affected int64 }
+
+func (r memResult) LastInsertId() (int64, error) { return r.lastID, nil }
+func (r memResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+type memRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *memRows) Columns() []string { return r.columns }
+func (r *memRows) Close() error      { return nil }
+
+func (r *memRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func (m *memDB) exec(query string, args []driver.Value) (driver.Result, error) {
+	p := newMemParser(query, args)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch p.keyword() {
+	case "INSERT":
+		p.expect("INTO")
+		table := p.ident()
+		columns := p.identList()
+		p.expect("VALUES")
+		values := p.operandList()
+		if len(columns) != len(values) {
+			return nil, fmt.Errorf("memdb: %d columns but %d values", len(columns), len(values))
+		}
+
+		row := make(map[string]driver.Value)
+		for i, column := range columns {
+			row[column] = values[i].eval(nil)
+		}
+
+		if err := p.finish(query); err != nil {
+			return nil, err
+		}
+
+		return memResult{lastID: m.insertLocked(table, row), affected: 1}, nil
+
+	case "UPDATE":
+		table := p.ident()
+		p.expect("SET")
+		type assignment struct {
+			column string
+			value  memExpr
+		}
+		var set []assignment
+		for {
+			column := p.ident()
+			p.expect("=")
+			set = append(set, assignment{column, p.sum()})
+			if !p.accept(",") {
+				break
+			}
+		}
+		where := p.where()
+		if err := p.finish(query); err != nil {
+			return nil, err
+		}
+
+		var affected int64
+		for _, row := range m.tables[table] {
+			if where.eval(row) != true {
+				continue
+			}
+			values := make([]driver.Value, len(set))
+			for i, a := range set {
+				values[i] = a.value.eval(row)
+			}
+			for i, a := range set {
+				row[a.column] = values[i]
+			}
+			affected++
+		}
+
+		return memResult{affected: affected}, nil
+
+	case "DELETE":
+		p.expect("FROM")
+		table := p.ident()
+		where := p.where()
+		if err := p.finish(query); err != nil {
+			return nil, err
+		}
+
+		var kept []map[string]driver.Value
+		for _, row := range m.tables[table] {
+			if where.eval(row) != true {
+				kept = append(kept, row)
+			}
+		}
+		affected := int64(len(m.tables[table]) - len(kept))
+		m.tables[table] = kept
+
+		return memResult{affected: affected}, nil
+	}
+
+	return nil, fmt.Errorf("memdb: cannot exec %q", query)
+}
+
+func (m *memDB) query(query string, args []driver.Value) (driver.Rows, error) {
+	p := newMemParser(query, args)
+	if p.keyword() != "SELECT" {
+		return nil, fmt.Errorf("memdb: cannot query %q", query)
+	}
+
+	type selected struct {
+		name  string
+		expr  memExpr
+		star  bool
+		count bool
+	}
+	var list []selected
+	for {
+		switch {
+		case p.accept("*"):
+			list = append(list, selected{star: true})
+		case p.acceptKeyword("COUNT"):
+			p.expect("(")
+			p.expect("*")
+			p.expect(")")
+			list = append(list, selected{name: "COUNT(*)", count: true})
+		default:
+			name := p.ident()
+			s := selected{name: name, expr: memColumn(name)}
+			if p.acceptKeyword("AS") {
+				s.name = p.ident()
+			}
+			list = append(list, s)
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+
+	p.expect("FROM")
+	table := p.ident()
+	where := p.where()
+
+	orderBy, desc := "", false
+	if p.acceptKeyword("ORDER") {
+		p.expect("BY")
+		orderBy = p.ident()
+		if p.acceptKeyword("DESC") {
+			desc = true
+		} else {
+			p.acceptKeyword("ASC")
+		}
+	}
+
+	limit, offset := -1, 0
+	if p.acceptKeyword("LIMIT") {
+		limit = p.intOperand()
+		if p.acceptKeyword("OFFSET") {
+			offset = p.intOperand()
+		}
+	}
+	if p.acceptKeyword("FOR") {
+		p.expect("UPDATE")
+	}
+	if err := p.finish(query); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []map[string]driver.Value
+	for _, row := range m.tables[table] {
+		if where.eval(row) == true {
+			matches = append(matches, row)
+		}
+	}
+
+	if orderBy != "" {
+		sort.SliceStable(matches, func(i, j int) bool {
+			c := compareValues(matches[i][orderBy], matches[j][orderBy])
+			if desc {
+				return c > 0
+			}
+			return c < 0
+		})
+	}
+
+	if offset > len(matches) {
+		offset = len(matches)
+	}
+	matches = matches[offset:]
+	if limit >= 0 && limit < len(matches) {
+		matches = matches[:limit]
+	}
+
+	rows := &memRows{}
+	for _, s := range list {
+		switch {
+		case s.star:
+			rows.columns = append(rows.columns, m.columns(table)...)
+		default:
+			rows.columns = append(rows.columns, s.name)
+		}
+	}
+
+	if len(list) == 1 && list[0].count {
+		rows.values = [][]driver.Value{{int64(len(matches))}}
+		return rows, nil
+	}
+
+	for _, row := range matches {
+		var values []driver.Value
+		for _, s := range list {
+			if s.star {
+				for _, column := range m.columns(table) {
+					values = append(values, row[column])
+				}
+				continue
+			}
+			values = append(values, s.expr.eval(row))
+		}
+		rows.values = append(rows.values, values)
+	}
+
+	return rows, nil
+}
+
+// memExpr is a parsed expression, evaluated against a row
+type memExpr interface {
+	eval(row map[string]driver.Value) driver.Value
+}
+
+type memColumn string
+
+func (c memColumn) eval(row map[string]driver.Value) driver.Value { return row[string(c)] }
+
+type memValue struct{ v driver.Value }
+
+func (v memValue) eval(map[string]driver.Value) driver.Value { return v.v }
+
+type memFunc func(row map[string]driver.Value) driver.Value
+
+func (f memFunc) eval(row map[string]driver.Value) driver.Value { return f(row) }
+
+// memParser reads one statement, handing out the arguments in the order
+// their placeholders appear
+type memParser struct {
+	tokens []string
+	pos    int
+	args   []driver.Value
+	arg    int
+	err    error
+}
+
+var memTokenPattern = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|<>|<=|>=|!=|[(),*=<>+?]|[A-Za-z_][A-Za-z0-9_.]*|-?[0-9]+`)
+
+func newMemParser(query string, args []driver.Value) *memParser {
+	return &memParser{tokens: memTokenPattern.FindAllString(query, -1), args: args}
+}
+
+func (p *memParser) fail(format string, a ...interface{}) {
+	if p.err == nil {
+		p.err = fmt.Errorf("memdb: "+format, a...)
+	}
+}
+
+func (p *memParser) done() bool { return p.pos >= len(p.tokens) }
+
+// finish returns the first error parsing query, or one if any of it is left
+// that was not understood
+func (p *memParser) finish(query string) error {
+	if p.err == nil && !p.done() {
+		p.err = fmt.Errorf("memdb: cannot parse %q after %q", query, p.tokens[p.pos])
+	}
+	return p.err
+}
+
+func (p *memParser) peek() string {
+	if p.done() {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *memParser) next() string {
+	t := p.peek()
+	if !p.done() {
+		p.pos++
+	}
+	return t
+}
+
+func (p *memParser) accept(token string) bool {
+	if p.peek() == token {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *memParser) acceptKeyword(keyword string) bool {
+	if strings.EqualFold(p.peek(), keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *memParser) expect(token string) {
+	if !p.acceptKeyword(token) {
+		p.fail("expected %s, got %q", token, p.peek())
+	}
+}
+
+func (p *memParser) keyword() string { return strings.ToUpper(p.next()) }
+
+func (p *memParser) ident() string {
+	t := p.next()
+	if t == "" || !(unicode.IsLetter(rune(t[0])) || t[0] == '_') {
+		p.fail("expected a name, got %q", t)
+	}
+	return t
+}
+
+func (p *memParser) identList() []string {
+	p.expect("(")
+	var names []string
+	for {
+		names = append(names, p.ident())
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(")")
+	return names
+}
+
+func (p *memParser) operandList() []memExpr {
+	p.expect("(")
+	var operands []memExpr
+	for {
+		operands = append(operands, p.operand())
+		if !p.accept(",") {
+			break
+		}
+	}
+	p.expect(")")
+	return operands
+}
+
+func (p *memParser) intOperand() int {
+	switch v := p.operand().eval(nil).(type) {
+	case int64:
+		return int(v)
+	default:
+		p.fail("expected a number, got %v", v)
+		return 0
+	}
+}
+
+func (p *memParser) operand() memExpr {
+	t := p.next()
+	switch {
+	case t == "?":
+		if p.arg >= len(p.args) {
+			p.fail("not enough arguments")
+			return memValue{}
+		}
+		p.arg++
+		return memValue{p.args[p.arg-1]}
+	case strings.EqualFold(t, "NULL"):
+		return memValue{nil}
+	case strings.HasPrefix(t, "'"):
+		return memValue{strings.ReplaceAll(t[1:len(t)-1], `\'`, `'`)}
+	case t != "" && (t[0] == '-' || unicode.IsDigit(rune(t[0]))):
+		n, _ := strconv.ParseInt(t, 10, 64)
+		return memValue{n}
+	default:
+		if t == "" || !(unicode.IsLetter(rune(t[0])) || t[0] == '_') {
+			p.fail("expected an operand, got %q", t)
+		}
+		return memColumn(t)
+	}
+}
+
+// sum reads an operand, or two added together
+func (p *memParser) sum() memExpr {
+	left := p.operand()
+	if !p.accept("+") {
+		return left
+	}
+	right := p.operand()
+	return memFunc(func(row map[string]driver.Value) driver.Value {
+		a, _ := toInt(left.eval(row))
+		b, _ := toInt(right.eval(row))
+		return a + b
+	})
+}
+
+func (p *memParser) where() memExpr {
+	if !p.acceptKeyword("WHERE") {
+		return memValue{true}
+	}
+	return p.or()
+}
+
+func (p *memParser) or() memExpr {
+	left := p.and()
+	for p.acceptKeyword("OR") {
+		a, b := left, p.and()
+		left = memFunc(func(row map[string]driver.Value) driver.Value {
+			return a.eval(row) == true || b.eval(row) == true
+		})
+	}
+	return left
+}
+
+func (p *memParser) and() memExpr {
+	left := p.condition()
+	for p.acceptKeyword("AND") {
+		a, b := left, p.condition()
+		left = memFunc(func(row map[string]driver.Value) driver.Value {
+			return a.eval(row) == true && b.eval(row) == true
+		})
+	}
+	return left
+}
+
+func (p *memParser) condition() memExpr {
+	if p.accept("(") {
+		e := p.or()
+		p.expect(")")
+		return e
+	}
+
+	left := p.operand()
+
+	switch {
+	case p.acceptKeyword("IS"):
+		not := p.acceptKeyword("NOT")
+		p.expect("NULL")
+		return memFunc(func(row map[string]driver.Value) driver.Value {
+			return (left.eval(row) == nil) != not
+		})
+	case p.acceptKeyword("IN"):
+		list := p.operandList()
+		return memFunc(func(row map[string]driver.Value) driver.Value {
+			v := left.eval(row)
+			for _, e := range list {
+				if v != nil && compareValues(v, e.eval(row)) == 0 {
+					return true
+				}
+			}
+			return false
+		})
+	case p.acceptKeyword("LIKE"):
+		right := p.operand()
+		return memFunc(func(row map[string]driver.Value) driver.Value {
+			v, pattern := left.eval(row), right.eval(row)
+			if v == nil || pattern == nil {
+				return false
+			}
+			return likePattern(toString(pattern)).MatchString(toString(v))
+		})
+	}
+
+	op := p.next()
+	right := p.operand()
+
+	return memFunc(func(row map[string]driver.Value) driver.Value {
+		a, b := left.eval(row), right.eval(row)
+		if a == nil || b == nil {
+			return false
+		}
+		c := compareValues(a, b)
+		switch op {
+		case "=":
+			return c == 0
+		case "<>", "!=":
+			return c != 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		case ">=":
+			return c >= 0
+		}
+		return false
+	})
+}
+
+// likePattern turns a LIKE pattern, with \ escaping, into a regexp
+func likePattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("(?s)^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
+
+func toInt(v driver.Value) (int64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case []byte:
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		return n, err == nil
+	case string:
+		n, err := strconv.ParseInt(v, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func toString(v driver.Value) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// compareValues orders two non-NULL values the way MySQL roughly would
+func compareValues(a, b driver.Value) int {
+	if ta, ok := a.(time.Time); ok {
+		if tb, ok := b.(time.Time); ok {
+			switch {
+			case ta.Before(tb):
+				return -1
+			case ta.After(tb):
+				return 1
+			}
+			return 0
+		}
+	}
+
+	_, aString := a.(string)
+	_, bString := b.(string)
+	if !aString && !bString {
+		ia, okA := toInt(a)
+		ib, okB := toInt(b)
+		if okA && okB {
+			switch {
+			case ia < ib:
+				return -1
+			case ia > ib:
+				return 1
+			}
+			return 0
+		}
+	}
+
+	return strings.Compare(toString(a), toString(b))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/config"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// unmatchedRoute labels requests no route matched, so unknown paths do not
+// each get their own series
+const unmatchedRoute = "unmatched"
+
+// apiMetrics are the metrics the API keeps about itself
+type apiMetrics struct {
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	logins          *prometheus.CounterVec
+	tokensIssued    prometheus.Counter
+	tokensRevoked   prometheus.Counter
+}
+
+// newAPIMetrics creates the API's metrics and registers them with reg
+func newAPIMetrics(reg prometheus.Registerer) (*apiMetrics, error) {
+	m := &apiMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests served, by route pattern and status.",
+		}, []string{"method", "route", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time spent serving HTTP requests, by route pattern and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "login_attempts_total",
+			Help: "Login attempts, by method and outcome.",
+		}, []string{"method", "outcome"}),
+		tokensIssued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tokens_issued_total",
+			Help: "Tokens and API keys issued.",
+		}),
+		tokensRevoked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tokens_revoked_total",
+			Help: "Tokens and API keys revoked.",
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{m.requests, m.requestDuration, m.logins, m.tokensIssued, m.tokensRevoked} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// newMetricsRegistry returns the registry /metrics exposes, holding the
+// runtime and process metrics, the database pool statistics and the metrics
+// of the models. Handlers add theirs with newAPIMetrics.
+func newMetricsRegistry(db *sqlx.DB) (*prometheus.Registry, error) {
+	reg := prometheus.NewRegistry()
+
+	for _, c := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db.DB, "api"),
+	} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := models.RegisterMetrics(reg)
+	if err != nil {
+		return nil, err
+	}
+
+	return reg, nil
+}
+
+// observeRequest records a served request
+func (m *apiMetrics) observeRequest(method, route string, status int, seconds float64) {
+	if route == "" {
+		route = unmatchedRoute
+	}
+
+	labels := prometheus.Labels{"method": method, "route": route, "status": strconv.Itoa(status)}
+	m.requests.With(labels).Inc()
+	m.requestDuration.With(labels).Observe(seconds)
+}
+
+// observeAuditEvent counts the token events among audited ones. Every token
+// and API key issued or revoked is audited, so counting here misses none.
+func (m *apiMetrics) observeAuditEvent(eventType string) {
+	switch eventType {
+	case models.AuditTokenIssued:
+		m.tokensIssued.Inc()
+	case models.AuditTokenRevoked:
+		m.tokensRevoked.Inc()
+	}
+}
+
+// metricsHandler exposes the metrics in the Prometheus text format
+func (app *applicationConfig) metricsHandler() http.Handler {
+	return promhttp.HandlerFor(app.metricsRegistry, promhttp.HandlerOpts{
+		ErrorLog: app.logger.With("component", "metrics").StdLogger(logging.LevelError),
+	})
+}
+
+// serveMetrics serves /metrics on its own listener, apart from the API, so
+// it can be kept off the public network. The address is taken before it
+// returns, so a taken address keeps the API from starting. The server is
+// closed by the caller once the API has stopped.
+func (app *applicationConfig) serveMetrics(cfg config.Server) (*http.Server, error) {
+	listener, err := net.Listen("tcp", cfg.MetricsAddr)
+	if err != nil {
+		return nil, err
+	}
+	app.logger.Info("metrics listening", "addr", listener.Addr().String())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", app.metricsHandler())
+
+	srv := &http.Server{
+		Addr:              listener.Addr().String(),
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          app.logger.With("component", "metrics").StdLogger(logging.LevelWarn),
+	}
+
+	go func() {
+		err := srv.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.logger.Error("metrics server stopped", "error", err)
+		}
+	}()
+
+	return srv, nil
+}
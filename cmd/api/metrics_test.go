@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/config"
+)
+
+// TestMetricsListener makes sure metrics are only served on their own
+// listener, not next to the API
+func TestMetricsListener(t *testing.T) {
+	app, _ := newTestApp(t)
+	handler := app.routes()
+
+	rr := doRequest(t, handler, http.MethodGet, "/healthz", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("healthz: status %d: %s", rr.Code, rr.Body)
+	}
+
+	rr = doRequest(t, handler, http.MethodGet, "/metrics", "", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("/metrics on the API: status %d, want %d", rr.Code, http.StatusNotFound)
+	}
+
+	cfg := config.Default().Server
+	cfg.MetricsAddr = "127.0.0.1:0"
+	srv, err := app.serveMetrics(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + srv.Addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "http_requests_total") {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
 	"github.com/justinas/nosurf"
 )
 
@@ -19,23 +23,110 @@ func (app *applicationConfig) noSurf(next http.Handler) http.Handler {
 	return csrfHandler
 }
 
+// requestLogger gives the request a logger that adds its ID, method and
+// path to every entry. It has to run after assignRequestID. Use requestLog
+// to get it.
+func (app *applicationConfig) requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := app.logger.With("request_id", requestID(r), "method", r.Method, "path", r.URL.Path)
+
+		next.ServeHTTP(w, r.WithContext(logging.NewContext(r.Context(), logger)))
+	})
+}
+
 // SessionLoad loads and saves session data for current request
 // func SessionLoad(next http.Handler) http.Handler {
 // 	return session.LoadAndSave(next)
 // }
 
-// func (app *application) AuthTokenMiddleware(next http.Handler) http.Handler {
-// 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		_, err := app.models.Token.AuthenticateToken(r)
-// 		if err != nil {
-// 			payload := jsonResponse{
-// 				Error:   true,
-// 				Message: "invalid authentication credentials",
-// 			}
-
-// 			_ = app.writeJSON(w, http.StatusUnauthorized, payload)
-// 			return
-// 		}
-// 		next.ServeHTTP(w, r)
-// 	})
-// }
+// authenticateRequest finds the user behind the credentials sent with r. An
+// API key (X-API-Key or "Authorization: ApiKey ...") is tried first, then a
+// bearer token.
+func (app *applicationConfig) authenticateRequest(r *http.Request) (*models.User, error) {
+	if key, ok := models.APIKeyFromRequest(r); ok {
+		return app.models.APIKey.AuthenticateAPIKey(key)
+	}
+
+	return app.models.Token.AuthenticateToken(r)
+}
+
+// authToken makes sure the request carries a valid bearer token or API key,
+// and stores the authenticated user in the request context. Tokens that were
+// only issued so an expired password can be changed are refused.
+func (app *applicationConfig) authToken(next http.Handler) http.Handler {
+	return app.authenticate(next, false)
+}
+
+// authTokenForPasswordChange is like authToken, but also lets through tokens
+// that may only be used to change an expired password
+func (app *applicationConfig) authTokenForPasswordChange(next http.Handler) http.Handler {
+	return app.authenticate(next, true)
+}
+
+// optionalAuthToken stores the authenticated user in the request context when
+// the request carries a valid bearer token, and lets the request through as
+// anonymous otherwise. It is used where the response depends on who is asking.
+func (app *applicationConfig) optionalAuthToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.authenticateRequest(r)
+		if err != nil || user.Token.PasswordChangeOnly {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		app.serveAuthenticated(w, r, next, user)
+	})
+}
+
+// serveAuthenticated passes the request on with user stored in its context.
+// Requests made by an admin impersonating user are audit logged.
+func (app *applicationConfig) serveAuthenticated(w http.ResponseWriter, r *http.Request, next http.Handler, user *models.User) {
+	if user.ImpersonatedBy() != "" {
+		next = app.auditImpersonation(next, user)
+	}
+
+	next.ServeHTTP(w, withAuthenticatedUser(r, user))
+}
+
+// requireScopes only lets the request through when the credential it was
+// authenticated with carries every one of the given scopes, and the user is
+// still allowed them with their current role. It has to run after authToken.
+// Password change only tokens carry no scopes; they are already confined to
+// the change-password route by authToken.
+func (app *applicationConfig) requireScopes(scopes ...string) func(http.Handler) http.Handler {
+	required := models.Scopes(scopes)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.authenticatedUser(r)
+			if user == nil {
+				app.errorJSON(w, errors.New("invalid authentication credentials"), http.StatusUnauthorized)
+				return
+			}
+
+			if !user.Token.PasswordChangeOnly && !user.GrantedScopes().Contains(required) {
+				app.errorJSON(w, fmt.Errorf("credentials are missing a required scope: %s", required.String()), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (app *applicationConfig) authenticate(next http.Handler, allowPasswordChangeOnly bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.authenticateRequest(r)
+		if err != nil {
+			app.errorJSON(w, errors.New("invalid authentication credentials"), http.StatusUnauthorized)
+			return
+		}
+
+		if user.Token.PasswordChangeOnly && !allowPasswordChangeOnly {
+			app.errorJSON(w, errors.New("password_change_required"), http.StatusForbidden)
+			return
+		}
+
+		app.serveAuthenticated(w, r, next, user)
+	})
+}
@@ -0,0 +1,673 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// oauthError is the error response format of RFC 6749 section 5.2
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func newOAuthError(code, description string) *oauthError {
+	return &oauthError{Code: code, Description: description}
+}
+
+// writeOAuthJSON writes a token endpoint style response, which must never be cached
+func (app *applicationConfig) writeOAuthJSON(w http.ResponseWriter, status int, data interface{}) {
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-store")
+	headers.Set("Pragma", "no-cache")
+
+	if status == http.StatusUnauthorized {
+		headers.Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	_ = app.writeJSON(w, status, data, headers)
+}
+
+// oauthClientFromRequest authenticates the client calling the token,
+// introspection or revocation endpoint, using HTTP Basic authentication or
+// client_id and client_secret in the form body (RFC 6749 section 2.3.1)
+func (app *applicationConfig) oauthClientFromRequest(r *http.Request) (*models.OAuthClient, *oauthError) {
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		var err error
+		clientID, err = url.QueryUnescape(clientID)
+		if err != nil {
+			return nil, newOAuthError("invalid_client", "malformed client credentials")
+		}
+		secret, err = url.QueryUnescape(secret)
+		if err != nil {
+			return nil, newOAuthError("invalid_client", "malformed client credentials")
+		}
+	} else {
+		clientID = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+
+	if clientID == "" {
+		return nil, newOAuthError("invalid_client", "client authentication is required")
+	}
+
+	client, err := app.models.OAuthClient.Authenticate(clientID, secret)
+	if err != nil {
+		return nil, newOAuthError("invalid_client", err.Error())
+	}
+
+	return client, nil
+}
+
+// authorizeRequest is a validated request to the authorization endpoint
+type authorizeRequest struct {
+	Client              *models.OAuthClient
+	RedirectURI         string
+	Scopes              models.Scopes
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// redirectWith builds the redirect back to the client with the given parameters
+func (ar *authorizeRequest) redirectWith(params url.Values) string {
+	if ar.State != "" {
+		params.Set("state", ar.State)
+	}
+
+	separator := "?"
+	if strings.Contains(ar.RedirectURI, "?") {
+		separator = "&"
+	}
+
+	return ar.RedirectURI + separator + params.Encode()
+}
+
+// parseAuthorizeRequest validates the parameters of an authorization request
+// made by user. Problems with the client or redirect URI cannot be reported
+// to the client and come back as an error; everything else is returned as an
+// oauthError to be sent to the redirect URI.
+func (app *applicationConfig) parseAuthorizeRequest(r *http.Request, user *models.User) (*authorizeRequest, *oauthError, error) {
+	client, err := app.models.OAuthClient.ShowByClientID(r.FormValue("client_id"))
+	if err != nil {
+		return nil, nil, errors.New("unknown client")
+	}
+
+	redirectURI := r.FormValue("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIList()) == 1 {
+		redirectURI = client.RedirectURIList()[0]
+	}
+	if !client.HasRedirectURI(redirectURI) {
+		return nil, nil, errors.New("redirect_uri is not registered for this client")
+	}
+
+	ar := &authorizeRequest{
+		Client:              client,
+		RedirectURI:         redirectURI,
+		State:               r.FormValue("state"),
+		Nonce:               r.FormValue("nonce"),
+		CodeChallenge:       r.FormValue("code_challenge"),
+		CodeChallengeMethod: r.FormValue("code_challenge_method"),
+	}
+
+	if r.FormValue("response_type") != "code" {
+		return ar, newOAuthError("unsupported_response_type", "only the code response type is supported"), nil
+	}
+
+	if ar.CodeChallenge == "" {
+		if !client.Confidential() {
+			return ar, newOAuthError("invalid_request", "public clients must use PKCE"), nil
+		}
+	} else {
+		// plain sends the verifier itself, so only S256 is accepted
+		if ar.CodeChallengeMethod != models.PKCEMethodS256 {
+			return ar, newOAuthError("invalid_request", "code_challenge_method must be S256"), nil
+		}
+		if len(ar.CodeChallenge) < 43 || len(ar.CodeChallenge) > 128 {
+			return ar, newOAuthError("invalid_request", "code_challenge must be 43 to 128 characters long"), nil
+		}
+	}
+
+	scopes, oerr := grantableScopes(r.FormValue("scope"), client, user)
+	if oerr != nil {
+		return ar, oerr, nil
+	}
+	ar.Scopes = scopes
+
+	return ar, nil, nil
+}
+
+// grantableScopes checks the requested scopes against what both the client
+// and the user are allowed. An empty request means everything they share.
+func grantableScopes(requested string, client *models.OAuthClient, user *models.User) (models.Scopes, *oauthError) {
+	scopes, err := requestedScopes(strings.Fields(requested), client.Scopes.Intersect(user.AllowedScopes()))
+	if err != nil {
+		return nil, newOAuthError("invalid_scope", err.Error())
+	}
+
+	return scopes, nil
+}
+
+// checkAuthorizingUser makes sure the authorization endpoint, and anything
+// else that hands out new credentials, is called with the user's own session,
+// not with a credential that was itself delegated. Otherwise a client could
+// outlive the revocation of its grant through the credentials it minted.
+func checkAuthorizingUser(user *models.User) error {
+	if user.APIKey != nil || user.Token.ClientID.Valid {
+		return errors.New("this must be done with a user session")
+	}
+
+	return nil
+}
+
+// redirectToConsent sends a browser that a client directed to the
+// authorization endpoint on to the consent page of the front end, with the
+// request's parameters. The API has no browser session; the front end signs
+// the user in and then calls the endpoint itself with the user's token.
+// Requests that carry credentials are passed on.
+func (app *applicationConfig) redirectToConsent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, hasAPIKey := models.APIKeyFromRequest(r)
+		if app.consentURL == "" || r.Header.Get("Authorization") != "" || hasAPIKey {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		separator := "?"
+		if strings.Contains(app.consentURL, "?") {
+			separator = "&"
+		}
+
+		http.Redirect(w, r, app.consentURL+separator+r.URL.RawQuery, http.StatusFound)
+	})
+}
+
+// OAuthAuthorizeInfo validates an authorization request and describes it, so
+// the front end can show the user a consent screen
+func (app *applicationConfig) OAuthAuthorizeInfo(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if err := checkAuthorizingUser(user); err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	ar, oerr, err := app.parseAuthorizeRequest(r, user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if oerr != nil {
+		params := url.Values{}
+		params.Set("error", oerr.Code)
+		params.Set("error_description", oerr.Description)
+		app.writeJSON(w, http.StatusBadRequest, jsonResponse{
+			Error:     true,
+			Message:   oerr.Description,
+			Data:      envelope{"redirect_to": ar.redirectWith(params)},
+			RequestID: w.Header().Get(requestIDHeader),
+		})
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data: envelope{
+			"client_id":    ar.Client.ClientID,
+			"client_name":  ar.Client.Name,
+			"redirect_uri": ar.RedirectURI,
+			"scopes":       ar.Scopes,
+			"state":        ar.State,
+		},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// OAuthAuthorize is called once the user has decided on an authorization
+// request. It takes the same parameters as OAuthAuthorizeInfo plus
+// decision=approve or decision=deny, and returns the URL the user agent
+// should be sent to, carrying either an authorization code or an error.
+func (app *applicationConfig) OAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if err := checkAuthorizingUser(user); err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	ar, oerr, err := app.parseAuthorizeRequest(r, user)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	params := url.Values{}
+
+	switch {
+	case oerr != nil:
+		params.Set("error", oerr.Code)
+		params.Set("error_description", oerr.Description)
+	case r.FormValue("decision") != "approve":
+		params.Set("error", "access_denied")
+		params.Set("error_description", "the user denied the request")
+	default:
+		code, err := app.models.AuthorizationCode.IssueAuthorizationCode(models.AuthorizationCode{
+			ClientID:            ar.Client.ClientID,
+			UserID:              user.UserID,
+			RedirectURI:         ar.RedirectURI,
+			Scopes:              ar.Scopes,
+			CodeChallenge:       ar.CodeChallenge,
+			CodeChallengeMethod: ar.CodeChallengeMethod,
+			Nonce:               ar.Nonce,
+		})
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		params.Set("code", code)
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"redirect_to": ar.redirectWith(params)},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// tokenResponse is the successful token endpoint response (RFC 6749 section 5.1)
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// tokenGrant says what else comes with the access token. ID tokens are only
+// issued when the openid scope was granted as well.
+type tokenGrant struct {
+	refreshToken bool
+	idToken      bool
+	nonce        string
+}
+
+// OAuthToken is the token endpoint. It supports the authorization_code (with
+// PKCE), client_credentials and refresh_token grants.
+func (app *applicationConfig) OAuthToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.writeOAuthJSON(w, http.StatusBadRequest, newOAuthError("invalid_request", "malformed form body"))
+		return
+	}
+
+	client, oerr := app.oauthClientFromRequest(r)
+	if oerr != nil {
+		app.writeOAuthJSON(w, http.StatusUnauthorized, oerr)
+		return
+	}
+
+	var response *tokenResponse
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		response, oerr = app.authorizationCodeGrant(r, client)
+	case "client_credentials":
+		response, oerr = app.clientCredentialsGrant(r, client)
+	case "refresh_token":
+		response, oerr = app.refreshTokenGrant(r, client)
+	default:
+		oerr = newOAuthError("unsupported_grant_type", "")
+	}
+
+	if oerr != nil {
+		app.writeOAuthJSON(w, http.StatusBadRequest, oerr)
+		return
+	}
+
+	app.writeOAuthJSON(w, http.StatusOK, response)
+}
+
+func (app *applicationConfig) authorizationCodeGrant(r *http.Request, client *models.OAuthClient) (*tokenResponse, *oauthError) {
+	code, err := app.models.AuthorizationCode.ConsumeAuthorizationCode(r.PostForm.Get("code"), client.ClientID)
+	if err != nil {
+		return nil, newOAuthError("invalid_grant", "invalid authorization code")
+	}
+
+	if code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		return nil, newOAuthError("invalid_grant", "redirect_uri does not match the authorization request")
+	}
+
+	if !code.VerifyPKCE(r.PostForm.Get("code_verifier")) {
+		return nil, newOAuthError("invalid_grant", "code_verifier does not match the code_challenge")
+	}
+
+	user, err := app.models.User.ShowByID(code.UserID)
+	if err != nil || user.DeletedAt.Valid {
+		return nil, newOAuthError("invalid_grant", "the user no longer exists")
+	}
+
+	return app.issueOAuthTokens(r, client, user, code.Scopes.Intersect(user.AllowedScopes()), tokenGrant{refreshToken: true, idToken: true, nonce: code.Nonce})
+}
+
+func (app *applicationConfig) clientCredentialsGrant(r *http.Request, client *models.OAuthClient) (*tokenResponse, *oauthError) {
+	if !client.Confidential() {
+		return nil, newOAuthError("unauthorized_client", "public clients cannot use the client_credentials grant")
+	}
+
+	owner, err := app.models.User.ShowByID(client.UserID)
+	if err != nil || owner.DeletedAt.Valid {
+		return nil, newOAuthError("invalid_client", "the owner of this client no longer exists")
+	}
+
+	scopes, oerr := grantableScopes(r.PostForm.Get("scope"), client, owner)
+	if oerr != nil {
+		return nil, oerr
+	}
+
+	return app.issueOAuthTokens(r, client, owner, scopes, tokenGrant{})
+}
+
+func (app *applicationConfig) refreshTokenGrant(r *http.Request, client *models.OAuthClient) (*tokenResponse, *oauthError) {
+	refreshToken, err := app.models.RefreshToken.ConsumeRefreshToken(r.PostForm.Get("refresh_token"), client.ClientID)
+	if err != nil {
+		return nil, newOAuthError("invalid_grant", "invalid refresh token")
+	}
+
+	user, err := app.models.User.ShowByID(refreshToken.UserID)
+	if err != nil || user.DeletedAt.Valid {
+		return nil, newOAuthError("invalid_grant", "the user no longer exists")
+	}
+
+	// the client may ask for fewer scopes than originally granted, never more,
+	// and never any the user has lost since
+	scopes, err := requestedScopes(strings.Fields(r.PostForm.Get("scope")), refreshToken.Scopes.Intersect(user.AllowedScopes()))
+	if err != nil {
+		return nil, newOAuthError("invalid_scope", err.Error())
+	}
+
+	return app.issueOAuthTokens(r, client, user, scopes, tokenGrant{refreshToken: true, idToken: true})
+}
+
+// issueOAuthTokens creates an access token, and optionally a refresh token
+// and an ID token, for user on behalf of client
+func (app *applicationConfig) issueOAuthTokens(r *http.Request, client *models.OAuthClient, user *models.User, scopes models.Scopes, grant tokenGrant) (*tokenResponse, *oauthError) {
+	token, err := app.models.Token.GenerateToken(user.UserID, models.OAuthAccessTokenTTL, scopes)
+	if err != nil {
+		app.requestLog(r).Error("cannot generate access token", "error", err)
+		return nil, newOAuthError("server_error", "")
+	}
+	token.ClientID = models.NullString{NullString: sql.NullString{String: client.ClientID, Valid: true}}
+
+	err = app.models.Token.Insert(*token, *user)
+	if err != nil {
+		app.requestLog(r).Error("cannot store access token", "error", err)
+		return nil, newOAuthError("server_error", "")
+	}
+
+	app.auditAs(r, user, models.AuditTokenIssued, user.UserID, tokenDetails(token))
+
+	response := &tokenResponse{
+		AccessToken: token.Token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(models.OAuthAccessTokenTTL / time.Second),
+		Scope:       scopes.String(),
+	}
+
+	if grant.refreshToken {
+		response.RefreshToken, err = app.models.RefreshToken.IssueRefreshToken(client.ClientID, user.UserID, scopes)
+		if err != nil {
+			app.requestLog(r).Error("cannot issue refresh token", "error", err)
+			return nil, newOAuthError("server_error", "")
+		}
+	}
+
+	if grant.idToken && scopes.Has(models.ScopeOpenID) {
+		response.IDToken, err = app.signIDToken(client.ClientID, user, scopes, grant.nonce, token.Token)
+		if err != nil {
+			app.requestLog(r).Error("cannot sign ID token", "error", err)
+			return nil, newOAuthError("server_error", "")
+		}
+	}
+
+	return response, nil
+}
+
+// introspectionResponse is the token introspection response (RFC 7662 section 2.2)
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Exp       int64  `json:"exp,omitempty"`
+	Iat       int64  `json:"iat,omitempty"`
+	Sub       string `json:"sub,omitempty"`
+}
+
+// OAuthIntrospect is the token introspection endpoint (RFC 7662). Only
+// confidential clients may call it. Anything that is not a live token is
+// reported as inactive, without saying why.
+func (app *applicationConfig) OAuthIntrospect(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.writeOAuthJSON(w, http.StatusBadRequest, newOAuthError("invalid_request", "malformed form body"))
+		return
+	}
+
+	client, oerr := app.oauthClientFromRequest(r)
+	if oerr != nil {
+		app.writeOAuthJSON(w, http.StatusUnauthorized, oerr)
+		return
+	}
+	if !client.Confidential() {
+		app.writeOAuthJSON(w, http.StatusUnauthorized, newOAuthError("invalid_client", "public clients cannot introspect tokens"))
+		return
+	}
+
+	lookups := []func(string) (introspectionResponse, bool){
+		app.introspectAccessToken,
+		app.introspectRefreshToken,
+	}
+	if r.PostForm.Get("token_type_hint") == "refresh_token" {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+
+	for _, lookup := range lookups {
+		if response, ok := lookup(r.PostForm.Get("token")); ok {
+			app.writeOAuthJSON(w, http.StatusOK, response)
+			return
+		}
+	}
+
+	app.writeOAuthJSON(w, http.StatusOK, introspectionResponse{Active: false})
+}
+
+func (app *applicationConfig) introspectAccessToken(plainText string) (introspectionResponse, bool) {
+	token, err := app.models.Token.GetByToken(plainText)
+	if err != nil || token.ExpireAt.Before(time.Now()) || token.PasswordChangeOnly {
+		return introspectionResponse{}, false
+	}
+
+	user, err := app.models.Token.GetUserForToken(*token)
+	if err != nil || user.DeletedAt.Valid {
+		return introspectionResponse{}, false
+	}
+
+	return introspectionResponse{
+		Active:    true,
+		Scope:     token.Scopes.String(),
+		ClientID:  token.ClientID.String,
+		Username:  user.Email,
+		TokenType: "Bearer",
+		Exp:       token.ExpireAt.Unix(),
+		Iat:       token.CreatedAt.Unix(),
+		Sub:       user.UserID,
+	}, true
+}
+
+func (app *applicationConfig) introspectRefreshToken(plainText string) (introspectionResponse, bool) {
+	refreshToken, err := app.models.RefreshToken.ShowByRefreshToken(plainText)
+	if err != nil || refreshToken.ExpireAt.Before(time.Now()) {
+		return introspectionResponse{}, false
+	}
+
+	user, err := app.models.User.ShowByID(refreshToken.UserID)
+	if err != nil || user.DeletedAt.Valid {
+		return introspectionResponse{}, false
+	}
+
+	return introspectionResponse{
+		Active:    true,
+		Scope:     refreshToken.Scopes.String(),
+		ClientID:  refreshToken.ClientID,
+		Username:  user.Email,
+		TokenType: "refresh_token",
+		Exp:       refreshToken.ExpireAt.Unix(),
+		Iat:       refreshToken.CreatedAt.Unix(),
+		Sub:       user.UserID,
+	}, true
+}
+
+// OAuthRevoke is the token revocation endpoint (RFC 7009). A client can only
+// revoke tokens that were issued to it; as the RFC requires, the response is
+// the same whether or not there was anything to revoke. Revoking a refresh
+// token also revokes the access tokens the client holds for the same user.
+func (app *applicationConfig) OAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.writeOAuthJSON(w, http.StatusBadRequest, newOAuthError("invalid_request", "malformed form body"))
+		return
+	}
+
+	client, oerr := app.oauthClientFromRequest(r)
+	if oerr != nil {
+		app.writeOAuthJSON(w, http.StatusUnauthorized, oerr)
+		return
+	}
+
+	plainText := r.PostForm.Get("token")
+
+	token, err := app.models.Token.GetByToken(plainText)
+	if err == nil && token.ClientID.Valid && token.ClientID.String == client.ClientID {
+		err = app.models.Token.DeleteByToken(plainText)
+		if err != nil {
+			app.writeOAuthJSON(w, http.StatusServiceUnavailable, newOAuthError("server_error", ""))
+			return
+		}
+
+		app.audit(r, models.AuditTokenRevoked, token.UserID, models.AuditDiff{"client_id": {To: client.ClientID}})
+	}
+
+	refreshToken, err := app.models.RefreshToken.ShowByRefreshToken(plainText)
+	if err == nil && refreshToken.ClientID == client.ClientID {
+		err = app.models.RefreshToken.DeleteRefreshToken(refreshToken.ID)
+		if err != nil && !errors.Is(err, models.ErrInvalidGrant) {
+			app.writeOAuthJSON(w, http.StatusServiceUnavailable, newOAuthError("server_error", ""))
+			return
+		}
+
+		err = app.models.Token.DeleteClientTokensForUser(client.ClientID, refreshToken.UserID)
+		if err != nil {
+			app.writeOAuthJSON(w, http.StatusServiceUnavailable, newOAuthError("server_error", ""))
+			return
+		}
+
+		app.audit(r, models.AuditTokenRevoked, refreshToken.UserID, models.AuditDiff{
+			"client_id":     {To: client.ClientID},
+			"refresh_token": {To: true},
+		})
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// oauthClientView is how a registered client is shown to the admin who
+// registered it. The secret is only included right after registration.
+type oauthClientView struct {
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	Confidential bool     `json:"confidential"`
+}
+
+// CreateOAuthClient registers a new OAuth client owned by the calling admin
+func (app *applicationConfig) CreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if requestPayload.Name == "" {
+		app.errorJSON(w, errors.New("name is required"))
+		return
+	}
+
+	for _, uri := range requestPayload.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" || strings.ContainsAny(uri, " ") {
+			app.errorJSON(w, errors.New("redirect_uris must be absolute URIs without a fragment"))
+			return
+		}
+	}
+
+	user := app.authenticatedUser(r)
+
+	scopes, err := requestedScopes(requestPayload.Scopes, user.AllowedScopes())
+	if err != nil {
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	client, err := app.models.OAuthClient.GenerateClient(user.UserID, requestPayload.Name, requestPayload.RedirectURIs, scopes, requestPayload.Confidential)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.models.OAuthClient.Insert(client)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "client registered",
+		Data: oauthClientView{
+			ClientID:     client.ClientID,
+			ClientSecret: client.Secret,
+			Name:         client.Name,
+			RedirectURIs: client.RedirectURIList(),
+			Scopes:       client.Scopes,
+			Confidential: client.Confidential(),
+		},
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, payload)
+}
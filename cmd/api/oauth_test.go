@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+const (
+	testRedirectURI  = "https://client.example/callback"
+	testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// testOAuthClient is a client registered by an admin for the tests
+type testOAuthClient struct {
+	ID     string `json:"client_id"`
+	Secret string `json:"client_secret"`
+}
+
+// credentials are the form fields the client authenticates with
+func (c testOAuthClient) credentials(form url.Values) url.Values {
+	form.Set("client_id", c.ID)
+	if c.Secret != "" {
+		form.Set("client_secret", c.Secret)
+	}
+	return form
+}
+
+// registerOAuthClient registers a client redirecting to testRedirectURI
+func registerOAuthClient(t *testing.T, handler http.Handler, adminToken string, confidential bool) testOAuthClient {
+	t.Helper()
+
+	rr := doRequest(t, handler, http.MethodPost, "/admin/oauth/clients", adminToken, envelope{
+		"name":          "client",
+		"redirect_uris": []string{testRedirectURI},
+		"confidential":  confidential,
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("register client: status %d: %s", rr.Code, rr.Body)
+	}
+
+	var response struct {
+		Data testOAuthClient `json:"data"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response.Data
+}
+
+// postForm sends form to handler, the way clients call the OAuth endpoints
+func postForm(t *testing.T, handler http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+// authorize approves an authorization request as the user with token and
+// returns the parameters of the redirect back to the client
+func authorize(t *testing.T, handler http.Handler, token string, client testOAuthClient, challenge string) url.Values {
+	t.Helper()
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {client.ID},
+		"redirect_uri":  {testRedirectURI},
+		"state":         {"xyz"},
+		"decision":      {"approve"},
+	}
+	if challenge != "" {
+		query.Set("code_challenge", challenge)
+		query.Set("code_challenge_method", models.PKCEMethodS256)
+	}
+
+	rr := doRequest(t, handler, http.MethodPost, "/oauth/authorize?"+query.Encode(), token, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("authorize: status %d: %s", rr.Code, rr.Body)
+	}
+
+	var response struct {
+		Data struct {
+			RedirectTo string `json:"redirect_to"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redirect, err := url.Parse(response.Data.RedirectTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response.Data.RedirectTo, testRedirectURI+"?") || redirect.Query().Get("state") != "xyz" {
+		t.Fatalf("redirect_to = %s", response.Data.RedirectTo)
+	}
+
+	return redirect.Query()
+}
+
+// tokenRequest calls the token endpoint and decodes what it returns
+func tokenRequest(t *testing.T, handler http.Handler, client testOAuthClient, form url.Values) (int, tokenResponse, oauthError) {
+	t.Helper()
+
+	rr := postForm(t, handler, "/oauth/token", client.credentials(form))
+
+	var response tokenResponse
+	var oerr oauthError
+	if rr.Code == http.StatusOK {
+		err := json.Unmarshal(rr.Body.Bytes(), &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		err := json.Unmarshal(rr.Body.Bytes(), &oerr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return rr.Code, response, oerr
+}
+
+// introspect asks the introspection endpoint about token
+func introspect(t *testing.T, handler http.Handler, client testOAuthClient, token string) introspectionResponse {
+	t.Helper()
+
+	rr := postForm(t, handler, "/oauth/introspect", client.credentials(url.Values{"token": {token}}))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("introspect: status %d: %s", rr.Code, rr.Body)
+	}
+
+	var response introspectionResponse
+	err := json.Unmarshal(rr.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	app, _ := newTestApp(t)
+	handler := app.routes()
+
+	admin := createTestUser(t, app, "admin@example.com", models.RoleAdmin)
+	user := createTestUser(t, app, "user@example.com", models.RoleUser)
+	client := registerOAuthClient(t, handler, loginTestUser(t, handler, admin.Email), true)
+	other := registerOAuthClient(t, handler, loginTestUser(t, handler, admin.Email), true)
+	userToken := loginTestUser(t, handler, user.Email)
+
+	exchange := func(code, verifier string) (int, tokenResponse, oauthError) {
+		return tokenRequest(t, handler, client, url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {testRedirectURI},
+			"code_verifier": {verifier},
+		})
+	}
+
+	// PKCE: the code is only good with the verifier of its challenge
+	code := authorize(t, handler, userToken, client, codeChallenge(testCodeVerifier)).Get("code")
+	if status, _, oerr := exchange(code, strings.Repeat("a", 43)); status != http.StatusBadRequest || oerr.Code != "invalid_grant" {
+		t.Fatalf("wrong verifier: status %d, %+v", status, oerr)
+	}
+	code = authorize(t, handler, userToken, client, codeChallenge(testCodeVerifier)).Get("code")
+	if status, _, oerr := exchange(code, ""); status != http.StatusBadRequest || oerr.Code != "invalid_grant" {
+		t.Fatalf("no verifier: status %d, %+v", status, oerr)
+	}
+
+	code = authorize(t, handler, userToken, client, codeChallenge(testCodeVerifier)).Get("code")
+	status, tokens, oerr := exchange(code, testCodeVerifier)
+	if status != http.StatusOK || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("exchange: status %d, %+v %+v", status, tokens, oerr)
+	}
+
+	// a code is good for one exchange only
+	if status, _, oerr := exchange(code, testCodeVerifier); status != http.StatusBadRequest || oerr.Code != "invalid_grant" {
+		t.Fatalf("replayed code: status %d, %+v", status, oerr)
+	}
+
+	// refreshing rotates the refresh token
+	refresh := func(c testOAuthClient, refreshToken string) (int, tokenResponse, oauthError) {
+		return tokenRequest(t, handler, c, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}})
+	}
+	if status, _, _ := refresh(other, tokens.RefreshToken); status != http.StatusBadRequest {
+		t.Fatalf("refresh by another client: status %d", status)
+	}
+	status, rotated, oerr := refresh(client, tokens.RefreshToken)
+	if status != http.StatusOK || rotated.RefreshToken == "" || rotated.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("refresh: status %d, %+v %+v", status, rotated, oerr)
+	}
+	if status, _, _ := refresh(client, tokens.RefreshToken); status != http.StatusBadRequest {
+		t.Fatalf("reused refresh token: status %d", status)
+	}
+
+	// introspection describes live tokens, and nothing else
+	access := introspect(t, handler, client, rotated.AccessToken)
+	if !access.Active || access.ClientID != client.ID || access.Sub != user.UserID || access.TokenType != "Bearer" {
+		t.Fatalf("introspect access token: %+v", access)
+	}
+	refreshed := introspect(t, handler, client, rotated.RefreshToken)
+	if !refreshed.Active || refreshed.TokenType != "refresh_token" || refreshed.Sub != user.UserID {
+		t.Fatalf("introspect refresh token: %+v", refreshed)
+	}
+	for _, token := range []string{tokens.RefreshToken, "not-a-token", ""} {
+		if response := introspect(t, handler, client, token); response != (introspectionResponse{}) {
+			t.Fatalf("introspect %q: %+v", token, response)
+		}
+	}
+
+	// another client cannot revoke the client's tokens
+	rr := postForm(t, handler, "/oauth/revoke", other.credentials(url.Values{"token": {rotated.RefreshToken}}))
+	if rr.Code != http.StatusOK || !introspect(t, handler, client, rotated.RefreshToken).Active {
+		t.Fatalf("revoke by another client: status %d", rr.Code)
+	}
+
+	// revoking the refresh token ends every access token of the grant
+	rr = postForm(t, handler, "/oauth/revoke", client.credentials(url.Values{"token": {rotated.RefreshToken}}))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("revoke: status %d: %s", rr.Code, rr.Body)
+	}
+	for _, token := range []string{rotated.RefreshToken, rotated.AccessToken, tokens.AccessToken} {
+		if introspect(t, handler, client, token).Active {
+			t.Fatalf("%s is active after the revocation", token)
+		}
+	}
+	if rr := doRequest(t, handler, http.MethodGet, "/users/me/", rotated.AccessToken, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("access token after the revocation: status %d", rr.Code)
+	}
+	if rr := doRequest(t, handler, http.MethodGet, "/users/me/", userToken, nil); rr.Code != http.StatusOK {
+		t.Fatalf("the user's own session after the revocation: status %d", rr.Code)
+	}
+}
+
+func TestOAuthPublicClientsMustUsePKCE(t *testing.T) {
+	app, _ := newTestApp(t)
+	handler := app.routes()
+
+	admin := createTestUser(t, app, "admin@example.com", models.RoleAdmin)
+	client := registerOAuthClient(t, handler, loginTestUser(t, handler, admin.Email), false)
+	userToken := loginTestUser(t, handler, admin.Email)
+
+	if params := authorize(t, handler, userToken, client, ""); params.Get("error") != "invalid_request" || params.Get("code") != "" {
+		t.Fatalf("authorized a public client without PKCE: %v", params)
+	}
+
+	code := authorize(t, handler, userToken, client, codeChallenge(testCodeVerifier)).Get("code")
+	status, tokens, oerr := tokenRequest(t, handler, client, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {testCodeVerifier},
+	})
+	if status != http.StatusOK || tokens.AccessToken == "" {
+		t.Fatalf("exchange: status %d, %+v %+v", status, tokens, oerr)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/oidc"
+)
+
+// idTokenTTL is how long an ID token is valid for
+const idTokenTTL = time.Hour
+
+// userInfoClaims returns the standard claims about user that the given scopes
+// allow to be released
+func userInfoClaims(user *models.User, scopes models.Scopes) oidc.UserInfo {
+	info := oidc.UserInfo{Subject: user.UserID}
+
+	if scopes.Has(models.ScopeEmail) {
+		verified := user.EmailVerifiedAt.Valid
+		info.Email = user.Email
+		info.EmailVerified = &verified
+	}
+
+	if scopes.Has(models.ScopeProfile) {
+		info.GivenName = user.FirstName
+		info.FamilyName = user.LastName
+		info.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		info.UpdatedAt = user.UpdatedAt.Unix()
+	}
+
+	return info
+}
+
+// signIDToken issues an ID token for user to the client with the given
+// client_id, bound to the access token issued alongside it
+func (app *applicationConfig) signIDToken(clientID string, user *models.User, scopes models.Scopes, nonce, accessToken string) (string, error) {
+	now := time.Now()
+
+	claims := oidc.IDTokenClaims{
+		Issuer:    app.issuer,
+		Audience:  clientID,
+		ExpiresAt: now.Add(idTokenTTL).Unix(),
+		IssuedAt:  now.Unix(),
+		Nonce:     nonce,
+		AtHash:    oidc.AccessTokenHash(accessToken),
+		UserInfo:  userInfoClaims(user, scopes),
+	}
+
+	return app.idTokenSigner.Sign(claims)
+}
+
+// OpenIDConfiguration serves the OpenID Connect discovery document. Browsers
+// sent to the authorization endpoint are redirected to the consent page of
+// the front end, see redirectToConsent.
+func (app *applicationConfig) OpenIDConfiguration(w http.ResponseWriter, _ *http.Request) {
+	configuration := envelope{
+		"issuer":                                app.issuer,
+		"authorization_endpoint":                app.issuer + "/oauth/authorize",
+		"token_endpoint":                        app.issuer + "/oauth/token",
+		"userinfo_endpoint":                     app.issuer + "/userinfo",
+		"jwks_uri":                              app.issuer + "/.well-known/jwks.json",
+		"introspection_endpoint":                app.issuer + "/oauth/introspect",
+		"revocation_endpoint":                   app.issuer + "/oauth/revoke",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code", "client_credentials", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{oidc.Algorithm},
+		"code_challenge_methods_supported":      []string{models.PKCEMethodS256},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"scopes_supported": []string{
+			models.ScopeOpenID,
+			models.ScopeProfile,
+			models.ScopeEmail,
+			models.ScopeUsersRead,
+			models.ScopeUsersWrite,
+			models.ScopeAdmin,
+		},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "nonce", "at_hash",
+			"email", "email_verified", "name", "given_name", "family_name", "updated_at",
+		},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, configuration)
+}
+
+// JWKS serves the public key ID tokens are signed with
+func (app *applicationConfig) JWKS(w http.ResponseWriter, _ *http.Request) {
+	_ = app.writeJSON(w, http.StatusOK, app.idTokenSigner.JWKS())
+}
+
+// UserInfo is the OpenID Connect userinfo endpoint. It returns the claims
+// about the authenticated user that the access token's scopes allow.
+func (app *applicationConfig) UserInfo(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-store")
+
+	_ = app.writeJSON(w, http.StatusOK, userInfoClaims(user, user.GrantedScopes()), headers)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// changePassword changes the password of the user with token from
+// current to next and returns the response
+func changePassword(t *testing.T, app *applicationConfig, token, current, next string) (int, string) {
+	t.Helper()
+
+	rr := doRequest(t, app.routes(), http.MethodPost, "/users/me/password", token, envelope{"current_password": current, "new_password": next})
+
+	return rr.Code, rr.Body.String()
+}
+
+func TestPasswordHistory(t *testing.T) {
+	app, mem := newTestApp(t)
+	policy := models.DefaultPasswordPolicy()
+	policy.HistorySize = 3
+	models.SetPasswordPolicy(policy)
+
+	user := createTestUser(t, app, "alice@example.com", models.RoleUser)
+	token := loginTestUser(t, app.routes(), user.Email)
+
+	passwords := []string{testPassword, "Sec0ndPassword", "Th1rdPassword", "F0urthPassword"}
+	for i := 1; i < len(passwords); i++ {
+		status, body := changePassword(t, app, token, passwords[i-1], passwords[i])
+		if status != http.StatusOK {
+			t.Fatalf("change to %s: status %d: %s", passwords[i], status, body)
+		}
+	}
+
+	// the current password and the two before it cannot come back
+	for _, reused := range passwords[1:] {
+		status, body := changePassword(t, app, token, passwords[3], reused)
+		if status != http.StatusUnprocessableEntity || !strings.Contains(body, `"reused"`) {
+			t.Fatalf("reuse %s: status %d: %s", reused, status, body)
+		}
+	}
+
+	// the history keeps nothing older than that
+	history := mem.rows("password_history")
+	if len(history) != 2 {
+		t.Fatalf("history holds %d hashes, want 2", len(history))
+	}
+
+	status, body := changePassword(t, app, token, passwords[3], testPassword)
+	if status != http.StatusOK {
+		t.Fatalf("reuse a password older than the history: status %d: %s", status, body)
+	}
+}
+
+func TestExpiredPassword(t *testing.T) {
+	app, mem := newTestApp(t)
+	policy := models.DefaultPasswordPolicy()
+	policy.MaxAge = 24 * time.Hour
+	models.SetPasswordPolicy(policy)
+	handler := app.routes()
+
+	user := createTestUser(t, app, "alice@example.com", models.RoleUser)
+	if user.PasswordExpired(policy.MaxAge) {
+		t.Fatal("a new password has expired")
+	}
+
+	mem.mu.Lock()
+	for _, row := range mem.tables["users"] {
+		row["password_changed_at"] = time.Now().Add(-25 * time.Hour)
+	}
+	mem.mu.Unlock()
+
+	user, err := app.models.User.ShowByID(user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.PasswordExpired(policy.MaxAge) || user.PasswordExpired(0) {
+		t.Fatalf("password changed at %v: expired %v", user.PasswordChangedAt.Time, user.PasswordExpired(policy.MaxAge))
+	}
+
+	// the login only gets a token for changing the password
+	rr := doRequest(t, handler, http.MethodPost, "/auth/login", "", envelope{"email": user.Email, "password": testPassword})
+	var login struct {
+		Message string `json:"message"`
+		Data    struct {
+			Token models.Token `json:"token"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || login.Message != "password_change_required" || !login.Data.Token.PasswordChangeOnly {
+		t.Fatalf("login: status %d: %s", rr.Code, rr.Body)
+	}
+	changeOnly := login.Data.Token.Token
+
+	if rr := doRequest(t, handler, http.MethodGet, "/users/me/", changeOnly, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("me with a password change token: status %d: %s", rr.Code, rr.Body)
+	}
+
+	// changing the password swaps it for a regular token
+	rr = doRequest(t, handler, http.MethodPost, "/users/me/password", changeOnly, envelope{"current_password": testPassword, "new_password": "Fr3shPassword"})
+	var changed struct {
+		Data struct {
+			Token models.Token `json:"token"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(rr.Body.Bytes(), &changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || changed.Data.Token.Token == "" || changed.Data.Token.PasswordChangeOnly {
+		t.Fatalf("change password: status %d: %s", rr.Code, rr.Body)
+	}
+
+	if rr := doRequest(t, handler, http.MethodGet, "/users/me/", changed.Data.Token.Token, nil); rr.Code != http.StatusOK {
+		t.Fatalf("me with the new token: status %d: %s", rr.Code, rr.Body)
+	}
+	if rr := doRequest(t, handler, http.MethodGet, "/users/me/", changeOnly, nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("password change token after the change: status %d", rr.Code)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader carries the request ID in both directions
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID accepted from a client; it
+// is what the audit log has room for
+const maxRequestIDLength = 64
+
+const requestIDKey contextKey = "requestID"
+
+// requestID returns the ID assignRequestID gave r
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+
+	return id
+}
+
+// validRequestID tells whether a request ID sent by a client can be used
+// as is. Anything else is replaced rather than cleaned, so IDs in the logs
+// can be trusted to be plain.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "unknown"
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// assignRequestID gives every request an ID: the one sent in X-Request-ID
+// by the client or a proxy in front of us, or a new one. The ID is stored in
+// the request context and sent back in X-Request-ID, so a client reporting a
+// problem can tell us which request it was.
+func (app *applicationConfig) assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"io"
 	"net/http"
 
 	"github.com/go-chi/chi"
@@ -16,6 +15,9 @@ import (
 // that is part of the standard library.
 func (app *applicationConfig) routes() http.Handler {
 	mux := chi.NewRouter()
+	mux.Use(app.assignRequestID)
+	mux.Use(app.accessLog)
+	mux.Use(app.requestLogger)
 	mux.Use(middleware.Recoverer)
 	// mux.Use(app.noSurf)
 
@@ -28,6 +30,7 @@ func (app *applicationConfig) routes() http.Handler {
 			"GET",
 			"POST",
 			"PUT",
+			"PATCH",
 			"DELETE",
 			"OPTIONS",
 		},
@@ -36,46 +39,84 @@ func (app *applicationConfig) routes() http.Handler {
 			"Authorization",
 			"Content-Type",
 			"X-CSRF-Token",
+			"X-Request-ID",
+			"X-API-Key",
 		},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", "X-Request-ID"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
-	mux.Get("/", func(w http.ResponseWriter, _ *http.Request) {
-		io.WriteString(w, "Hello world")
-	})
+	mux.Get("/healthz", app.Healthz)
+	mux.Get("/readyz", app.Readyz)
 
 	mux.Route("/auth", func(mux chi.Router) {
 		// mux.Get("/login", app.Login)
 		mux.Post("/login", app.Login)
+		mux.Post("/login/step-up", app.StepUpLogin)
+		mux.Post("/register", app.Register)
+		mux.With(app.authToken, app.blockImpersonation).Post("/tokens", app.CreateToken)
+		mux.Get("/federated/{provider}/start", app.FederatedLoginStart)
+		mux.Get("/federated/{provider}/callback", app.FederatedLoginCallback)
+		mux.Get("/saml/{provider}/metadata", app.SAMLMetadata)
+		mux.Get("/saml/{provider}/start", app.SAMLLoginStart)
+		mux.Post("/saml/{provider}/acs", app.SAMLAssertionConsumer)
+	})
+
+	mux.Get("/.well-known/openid-configuration", app.OpenIDConfiguration)
+	mux.Get("/.well-known/jwks.json", app.JWKS)
+	mux.With(app.authToken, app.requireScopes(models.ScopeOpenID)).Get("/userinfo", app.UserInfo)
+	mux.With(app.authToken, app.requireScopes(models.ScopeOpenID)).Post("/userinfo", app.UserInfo)
+
+	mux.Route("/oauth", func(mux chi.Router) {
+		mux.With(app.redirectToConsent, app.authToken, app.requireScopes(models.ScopeUsersWrite)).Get("/authorize", app.OAuthAuthorizeInfo)
+		mux.With(app.authToken, app.blockImpersonation, app.requireScopes(models.ScopeUsersWrite)).Post("/authorize", app.OAuthAuthorize)
+		mux.Post("/token", app.OAuthToken)
+		mux.Post("/introspect", app.OAuthIntrospect)
+		mux.Post("/revoke", app.OAuthRevoke)
+	})
+
+	mux.Route("/scim/v2", func(mux chi.Router) {
+		mux.Use(app.scimAuth)
+
+		mux.Get("/ServiceProviderConfig", app.SCIMServiceProviderConfig)
+		mux.Get("/Users", app.SCIMListUsers)
+		mux.Post("/Users", app.SCIMCreateUser)
+		mux.Get("/Users/{id}", app.SCIMGetUser)
+		mux.Put("/Users/{id}", app.SCIMReplaceUser)
+		mux.Patch("/Users/{id}", app.SCIMPatchUser)
+		mux.Delete("/Users/{id}", app.SCIMDeleteUser)
+	})
+
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.authToken)
+		mux.Use(app.requireScopes(models.ScopeAdmin))
+		mux.Post("/oauth/clients", app.CreateOAuthClient)
+		mux.Post("/users/{id}/impersonate", app.Impersonate)
+		mux.Put("/users/{id}/role", app.SetUserRole)
+		mux.Get("/audit", app.AuditEvents)
+		mux.Get("/db/stats", app.DBStats)
 	})
 
-	mux.Get("/user", app.User)
-	mux.Get("/users/all", app.AllUsers)
-	mux.Get("/users/get/{id}", app.getUserByID)
-	mux.Get("/users/add", func(w http.ResponseWriter, r *http.Request) {
-		var u = models.User{
-			FirstName: "You",
-			LastName:  "There",
-			Email:     "edsoif@dfj.com",
-			Password:  "password",
-		}
-
-		app.infoLog.Println("Adding user...")
-
-		userID, err := app.models.User.Insert(u)
-		if err != nil {
-			app.errorLog.Println(err)
-			app.errorJSON(w, err, http.StatusForbidden)
-			return
-		}
-
-		app.infoLog.Println("Got back user_id of", userID)
-		newUser, _ := app.models.User.ShowByID(userID)
-		app.writeJSON(w, http.StatusOK, newUser)
+	mux.With(app.optionalAuthToken).Get("/users/all", app.AllUsers)
+	mux.With(app.optionalAuthToken).Get("/users/get/{id}", app.getUserByID)
+	mux.With(app.authToken, app.blockImpersonation, app.requireScopes(models.ScopeUsersWrite, models.ScopeAdmin)).Post("/users/delete/{user_id}", app.DeleteUserByID)
+
+	mux.Route("/users/me", func(mux chi.Router) {
+		mux.With(app.authTokenForPasswordChange, app.blockImpersonation, app.requireScopes(models.ScopeUsersWrite)).Post("/password", app.ChangePassword)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.authToken)
+			mux.With(app.requireScopes(models.ScopeUsersRead)).Get("/", app.Me)
+			mux.With(app.requireScopes(models.ScopeUsersRead)).Get("/logins", app.MyLogins)
+			mux.With(app.blockImpersonation, app.requireScopes(models.ScopeUsersWrite)).Patch("/", app.UpdateMe)
+			mux.With(app.blockImpersonation, app.requireScopes(models.ScopeUsersWrite)).Delete("/", app.DeleteMe)
+
+			mux.With(app.requireScopes(models.ScopeUsersRead)).Get("/api-keys", app.APIKeys)
+			mux.With(app.blockImpersonation, app.requireScopes(models.ScopeUsersWrite)).Post("/api-keys", app.CreateAPIKey)
+			mux.With(app.blockImpersonation, app.requireScopes(models.ScopeUsersWrite)).Delete("/api-keys/{prefix}", app.DeleteAPIKey)
+		})
 	})
-	mux.Post("/users/delete/{user_id}", app.DeleteUserByID)
 
 	return mux
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/federation"
+)
+
+// samlIdentityPrefix keeps the names of SAML providers apart from those of
+// OpenID Connect providers in login states and federated identities
+const samlIdentityPrefix = "saml:"
+
+// samlProvider returns the SAML provider named in the URL
+func (app *applicationConfig) samlProvider(r *http.Request) (*federation.SAMLProvider, error) {
+	provider, ok := app.samlProviders[chi.URLParam(r, "provider")]
+	if !ok {
+		return nil, errUnknownProvider
+	}
+
+	return provider, nil
+}
+
+// SAMLMetadata serves our service provider metadata for one IdP
+func (app *applicationConfig) SAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	provider, err := app.samlProvider(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	metadata, err := provider.Metadata()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(metadata)
+}
+
+// SAMLLoginStart begins an SP-initiated login. The AuthnRequest ID is kept
+// with a login state that travels to the IdP and back as the RelayState, and
+// returns the URL the client should send the user to.
+func (app *applicationConfig) SAMLLoginStart(w http.ResponseWriter, r *http.Request) {
+	provider, err := app.samlProvider(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	loginState, err := app.models.LoginState.IssueLoginState(samlIdentityPrefix + provider.Name)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	redirectTo, err := provider.AuthnRequestURL(federation.RequestID(loginState.Nonce), loginState.State)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	payload := jsonResponse{
+		Error:   false,
+		Message: "success",
+		Data:    envelope{"redirect_to": redirectTo},
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// SAMLAssertionConsumer is the ACS the IdP posts its response to. The signed
+// assertion is validated against the AuthnRequest we sent, its NameID is
+// mapped to a local user, and a token is issued for that user.
+func (app *applicationConfig) SAMLAssertionConsumer(w http.ResponseWriter, r *http.Request) {
+	provider, err := app.samlProvider(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	loginState, err := app.models.LoginState.ConsumeLoginState(r.PostForm.Get("RelayState"), samlIdentityPrefix+provider.Name)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	claims, err := provider.ParseResponse(r, federation.RequestID(loginState.Nonce))
+	if err != nil {
+		app.requestLog(r).Warn("invalid SAML assertion", "provider", provider.Name, "error", err)
+		app.federatedLoginFailed(r, samlIdentityPrefix+provider.Name, "", "invalid assertion")
+		app.errorJSON(w, errors.New("could not sign in with identity provider"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.federatedUser(r, samlIdentityPrefix+provider.Name, claims)
+	if err != nil {
+		app.federatedLoginFailed(r, samlIdentityPrefix+provider.Name, "", err.Error())
+		app.errorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	app.federatedLogin(w, r, user, samlIdentityPrefix+provider.Name)
+}
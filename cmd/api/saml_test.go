@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/federation"
+)
+
+// testKeyPair generates an RSA key and a self-signed certificate for it
+func testKeyPair(t *testing.T, name string) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, certificate
+}
+
+// stubServiceProviders hands our metadata to the stub IdP. The keys are left
+// out so that assertions come in the clear and can be tampered with.
+type stubServiceProviders struct {
+	metadata *saml.EntityDescriptor
+}
+
+func (s stubServiceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	if serviceProviderID != s.metadata.EntityID {
+		return nil, os.ErrNotExist
+	}
+
+	return s.metadata, nil
+}
+
+// newStubSAMLProvider registers a SAML provider named stub whose IdP signs
+// with a key generated for the test, and returns that IdP
+func newStubSAMLProvider(t *testing.T, app *applicationConfig) *saml.IdentityProvider {
+	t.Helper()
+
+	idpKey, idpCertificate := testKeyPair(t, "idp.test")
+	idp := &saml.IdentityProvider{
+		Key:         idpKey,
+		Certificate: idpCertificate,
+		MetadataURL: url.URL{Scheme: "https", Host: "idp.test", Path: "/metadata"},
+		SSOURL:      url.URL{Scheme: "https", Host: "idp.test", Path: "/sso"},
+	}
+
+	idpMetadata, err := xml.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idpMetadataFile := filepath.Join(t.TempDir(), "idp.xml")
+	err = os.WriteFile(idpMetadataFile, idpMetadata, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spKey, spCertificate := testKeyPair(t, "api.test")
+	provider, err := federation.NewSAMLProvider(context.Background(), federation.SAMLConfig{
+		Name:            "stub",
+		MetadataURL:     "http://api.test/auth/saml/stub/metadata",
+		ACSURL:          "http://api.test/auth/saml/stub/acs",
+		IDPMetadataFile: idpMetadataFile,
+		TrustEmail:      true,
+	}, spKey, spCertificate, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.samlProviders["stub"] = provider
+
+	spMetadata, err := provider.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sp saml.EntityDescriptor
+	err = xml.Unmarshal(spMetadata, &sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range sp.SPSSODescriptors {
+		sp.SPSSODescriptors[i].KeyDescriptors = nil
+	}
+	idp.ServiceProviderProvider = stubServiceProviders{metadata: &sp}
+
+	return idp
+}
+
+// samlResponse is how a test wants the stub IdP's answer changed
+type samlResponse struct {
+	// assertion changes the assertion before it is signed
+	assertion func(*saml.Assertion)
+	// signed changes the response after it is signed
+	signed func(*etree.Element)
+	// signer signs in place of the key in the IdP's metadata
+	signer *rsa.PrivateKey
+	// late is how long after it was issued the response is posted
+	late time.Duration
+}
+
+// samlLogin starts a login, has the IdP answer the AuthnRequest for session,
+// and returns the response of posting that answer to the ACS
+func samlLogin(t *testing.T, handler http.Handler, idp *saml.IdentityProvider, session *saml.Session, change samlResponse) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rr := doRequest(t, handler, http.MethodGet, "/auth/saml/stub/start", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("start: status %d: %s", rr.Code, rr.Body)
+	}
+
+	var start struct {
+		Data struct {
+			RedirectTo string `json:"redirect_to"`
+		} `json:"data"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := saml.NewIdpAuthnRequest(idp, httptest.NewRequest(http.MethodGet, start.Data.RedirectTo, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = req.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = saml.DefaultAssertionMaker{}.MakeAssertion(req, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.assertion != nil {
+		change.assertion(req.Assertion)
+	}
+
+	if change.signer != nil {
+		genuine := idp.Key
+		idp.Key = change.signer
+		defer func() { idp.Key = genuine }()
+	}
+	err = req.MakeResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.signed != nil {
+		change.signed(req.ResponseEl)
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+	response, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"SAMLResponse": {base64.StdEncoding.EncodeToString(response)},
+		"RelayState":   {req.RelayState},
+	}
+	acs := httptest.NewRequest(http.MethodPost, "/auth/saml/stub/acs", strings.NewReader(form.Encode()))
+	acs.RemoteAddr = "192.0.2.1:1234"
+	acs.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if change.late != 0 {
+		now := saml.TimeNow
+		saml.TimeNow = func() time.Time { return now().Add(change.late) }
+		defer func() { saml.TimeNow = now }()
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, acs)
+
+	return rr
+}
+
+func TestSAMLAssertionConsumer(t *testing.T) {
+	otherKey, _ := testKeyPair(t, "idp.test")
+
+	session := func(nameID string, attributes ...saml.Attribute) *saml.Session {
+		return &saml.Session{
+			CreateTime:       time.Now(),
+			NameID:           nameID,
+			NameIDFormat:     string(saml.PersistentNameIDFormat),
+			UserGivenName:    "Sam",
+			UserSurname:      "Lee",
+			CustomAttributes: attributes,
+		}
+	}
+	email := func(address string) saml.Attribute {
+		return saml.Attribute{Name: "email", Values: []saml.AttributeValue{{Type: "xs:string", Value: address}}}
+	}
+
+	tests := []struct {
+		name    string
+		session *saml.Session
+		change  samlResponse
+		status  int
+		// email is the address the signed in user must end up with
+		email string
+	}{
+		{
+			name:    "NameID and attributes are mapped",
+			session: session("stub-user-1", email("sam@example.com")),
+			status:  http.StatusOK,
+			email:   "sam@example.com",
+		},
+		{
+			name:    "NameID is the email address",
+			session: session("nameid@example.com"),
+			status:  http.StatusOK,
+			email:   "nameid@example.com",
+		},
+		{
+			name:    "signature does not match",
+			session: session("stub-user-1", email("sam@example.com")),
+			change: samlResponse{signed: func(response *etree.Element) {
+				response.FindElement("//NameID").SetText("someone-else")
+			}},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "signed with another key",
+			session: session("stub-user-1", email("sam@example.com")),
+			change:  samlResponse{signer: otherKey},
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "meant for another service provider",
+			session: session("stub-user-1", email("sam@example.com")),
+			change: samlResponse{assertion: func(assertion *saml.Assertion) {
+				assertion.Conditions.AudienceRestrictions[0].Audience.Value = "https://other.example/metadata"
+			}},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "expired",
+			session: session("stub-user-1", email("sam@example.com")),
+			change:  samlResponse{late: time.Hour},
+			status:  http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, mem := newTestApp(t)
+			idp := newStubSAMLProvider(t, app)
+			handler := app.routes()
+
+			rr := samlLogin(t, handler, idp, tt.session, tt.change)
+			if rr.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rr.Code, tt.status, rr.Body)
+			}
+
+			identities := mem.rows("federated_identities")
+			if tt.status != http.StatusOK {
+				if len(identities) != 0 || len(mem.rows("users")) != 0 {
+					t.Fatalf("refused sign in left %d identities and %d users", len(identities), len(mem.rows("users")))
+				}
+				return
+			}
+
+			if len(identities) != 1 || identities[0]["provider"] != samlIdentityPrefix+"stub" || identities[0]["subject"] != tt.session.NameID {
+				t.Fatalf("identities = %v", identities)
+			}
+
+			user, err := app.models.User.ShowByID(toString(identities[0]["user_id"]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Email != tt.email || user.FirstName != "Sam" || user.LastName != "Lee" || !user.EmailVerifiedAt.Valid || user.HasUsablePassword() {
+				t.Fatalf("provisioned user %+v", user)
+			}
+
+			if !bytes.Contains(rr.Body.Bytes(), []byte(`"token"`)) {
+				t.Fatalf("no token issued: %s", rr.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// SCIM schema and message URNs (RFC 7643, RFC 7644)
+const (
+	scimUserSchema        = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListSchema        = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimPatchSchema       = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimErrorSchema       = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimConfigSchema      = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimDefaultPageSize   = 100
+	scimMaxPageSize       = 1000
+	scimContentType       = "application/scim+json"
+	scimInvalidFilter     = "invalidFilter"
+	scimInvalidValue      = "invalidValue"
+	scimInvalidPath       = "invalidPath"
+	scimUniquenessProblem = "uniqueness"
+)
+
+// scimError is a SCIM error response (RFC 7644 section 3.12)
+type scimError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+type scimName struct {
+	GivenName  string `json:"givenName"`
+	FamilyName string `json:"familyName"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+// scimUser is a user as SCIM clients see it. Our users are identified by
+// their email address, which doubles as the SCIM userName. A closed account
+// is an inactive user. Password is only ever read, never sent back.
+type scimUser struct {
+	Schemas  []string    `json:"schemas"`
+	ID       string      `json:"id,omitempty"`
+	UserName string      `json:"userName"`
+	Name     *scimName   `json:"name,omitempty"`
+	Emails   []scimEmail `json:"emails,omitempty"`
+	Active   *bool       `json:"active,omitempty"`
+	Password string      `json:"password,omitempty"`
+	Meta     *scimMeta   `json:"meta,omitempty"`
+}
+
+// email returns the address a SCIM user maps to: the primary email, or the
+// userName when no emails were sent
+func (u *scimUser) email() string {
+	for _, e := range u.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if u.UserName == "" && len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+
+	return u.UserName
+}
+
+type scimListResponse struct {
+	Schemas      []string   `json:"schemas"`
+	TotalResults int        `json:"totalResults"`
+	StartIndex   int        `json:"startIndex"`
+	ItemsPerPage int        `json:"itemsPerPage"`
+	Resources    []scimUser `json:"Resources"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string `json:"schemas"`
+	Operations []struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		Value json.RawMessage `json:"value"`
+	} `json:"Operations"`
+}
+
+// newSCIMUser builds the SCIM representation of a user
+func (app *applicationConfig) newSCIMUser(user *models.User) scimUser {
+	active := !user.DeletedAt.Valid
+
+	return scimUser{
+		Schemas:  []string{scimUserSchema},
+		ID:       user.UserID,
+		UserName: user.Email,
+		Name: &scimName{
+			GivenName:  user.FirstName,
+			FamilyName: user.LastName,
+		},
+		Emails: []scimEmail{
+			{Value: user.Email, Type: "work", Primary: true},
+		},
+		Active: &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     app.issuer + "/scim/v2/Users/" + user.UserID,
+		},
+	}
+}
+
+// writeSCIM writes a SCIM response body
+func (app *applicationConfig) writeSCIM(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) {
+	h := http.Header{}
+	if len(headers) > 0 {
+		h = headers[0]
+	}
+	h.Set("Content-Type", scimContentType)
+
+	_ = app.writeJSON(w, status, data, h)
+}
+
+// scimErrorJSON writes a SCIM error. scimType may be empty.
+func (app *applicationConfig) scimErrorJSON(w http.ResponseWriter, status int, scimType string, err error) {
+	app.writeSCIM(w, status, scimError{
+		Schemas:  []string{scimErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   err.Error(),
+	})
+}
+
+// scimAuth only lets through requests carrying an API key with the scim
+// scope. Identity providers get a key of their own for provisioning; user
+// tokens are never accepted here, even an admin's.
+func (app *applicationConfig) scimAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := models.APIKeyFromRequest(r)
+		if !ok {
+			app.scimErrorJSON(w, http.StatusUnauthorized, "", errors.New("a SCIM API key is required"))
+			return
+		}
+
+		user, err := app.models.APIKey.AuthenticateAPIKey(key)
+		if err != nil {
+			app.scimErrorJSON(w, http.StatusUnauthorized, "", errors.New("invalid authentication credentials"))
+			return
+		}
+
+		if !user.IsAdmin() || !user.GrantedScopes().Has(models.ScopeSCIM) {
+			app.scimErrorJSON(w, http.StatusForbidden, "", fmt.Errorf("credentials are missing a required scope: %s", models.ScopeSCIM))
+			return
+		}
+
+		next.ServeHTTP(w, withAuthenticatedUser(r, user))
+	})
+}
+
+// SCIMServiceProviderConfig tells SCIM clients which optional features we support
+func (app *applicationConfig) SCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	supported := func(b bool) envelope { return envelope{"supported": b} }
+
+	app.writeSCIM(w, http.StatusOK, envelope{
+		"schemas":        []string{scimConfigSchema},
+		"patch":          supported(true),
+		"bulk":           envelope{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         envelope{"supported": true, "maxResults": scimMaxPageSize},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []envelope{
+			{
+				"type":        "oauthbearertoken",
+				"name":        "API key",
+				"description": "An API key with the scim scope, sent as a bearer token",
+			},
+		},
+	})
+}
+
+// SCIMListUsers lists users, optionally filtered, a page at a time
+func (app *applicationConfig) SCIMListUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filters, err := parseSCIMFilter(query.Get("filter"))
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidFilter, err)
+		return
+	}
+
+	startIndex, err := strconv.Atoi(query.Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(query.Get("count"))
+	if err != nil || count < 0 {
+		count = scimDefaultPageSize
+	}
+	if count > scimMaxPageSize {
+		count = scimMaxPageSize
+	}
+
+	users, total, err := app.models.User.Search(filters, startIndex-1, count)
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+		return
+	}
+
+	resources := make([]scimUser, 0, len(users))
+	for _, user := range users {
+		resources = append(resources, app.newSCIMUser(user))
+	}
+
+	app.writeSCIM(w, http.StatusOK, scimListResponse{
+		Schemas:      []string{scimListSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// scimUserFromURL loads the user named by the id URL parameter, writing a
+// SCIM error and returning nil when there is none
+func (app *applicationConfig) scimUserFromURL(w http.ResponseWriter, r *http.Request) *models.User {
+	user, err := app.models.User.ShowByID(chi.URLParam(r, "id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.scimErrorJSON(w, http.StatusNotFound, "", errors.New("user not found"))
+		return nil
+	}
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+		return nil
+	}
+
+	return user
+}
+
+// SCIMGetUser returns one user
+func (app *applicationConfig) SCIMGetUser(w http.ResponseWriter, r *http.Request) {
+	user := app.scimUserFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	app.writeSCIM(w, http.StatusOK, app.newSCIMUser(user))
+}
+
+// SCIMCreateUser provisions a user. Without a password in the request the
+// account can only be signed in to through single sign-on.
+func (app *applicationConfig) SCIMCreateUser(w http.ResponseWriter, r *http.Request) {
+	var in scimUser
+	err := app.readJSON(w, r, &in)
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidValue, err)
+		return
+	}
+
+	email := in.email()
+	if email == "" {
+		app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidValue, errors.New("userName is required"))
+		return
+	}
+
+	_, err = app.models.User.ShowByEmail(email)
+	if err == nil {
+		app.scimErrorJSON(w, http.StatusConflict, scimUniquenessProblem, errors.New("a user with this userName already exists"))
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+		return
+	}
+
+	newUser := models.User{
+		Email:    email,
+		Password: in.Password,
+	}
+	if in.Name != nil {
+		newUser.FirstName = in.Name.GivenName
+		newUser.LastName = in.Name.FamilyName
+	}
+	var userID string
+	if newUser.Password == "" {
+		userID, err = app.models.User.InsertWithoutPassword(newUser)
+	} else {
+		userID, err = app.models.User.Insert(newUser)
+	}
+	var policyErr *models.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidValue, err)
+		return
+	}
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+		return
+	}
+
+	user, err := app.models.User.ShowByID(userID)
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+		return
+	}
+
+	diff := userDiff(nil, user)
+	if in.Active != nil && !*in.Active {
+		err = user.SoftDelete()
+		if err != nil {
+			app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+			return
+		}
+		diff["deleted"] = models.AuditChange{From: false, To: true}
+	}
+
+	app.audit(r, models.AuditUserCreated, user.UserID, diff)
+
+	resource := app.newSCIMUser(user)
+	headers := http.Header{}
+	headers.Set("Location", resource.Meta.Location)
+
+	app.writeSCIM(w, http.StatusCreated, resource, headers)
+}
+
+// SCIMReplaceUser replaces a user's attributes with the ones sent
+func (app *applicationConfig) SCIMReplaceUser(w http.ResponseWriter, r *http.Request) {
+	user := app.scimUserFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	var in scimUser
+	err := app.readJSON(w, r, &in)
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidValue, err)
+		return
+	}
+
+	email := in.email()
+	if email == "" {
+		app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidValue, errors.New("userName is required"))
+		return
+	}
+
+	changed := *user
+	changed.Email = email
+	changed.FirstName = ""
+	changed.LastName = ""
+	if in.Name != nil {
+		changed.FirstName = in.Name.GivenName
+		changed.LastName = in.Name.FamilyName
+	}
+
+	active := true
+	if in.Active != nil {
+		active = *in.Active
+	}
+
+	app.saveSCIMUser(w, r, user, &changed, active)
+}
+
+// SCIMPatchUser applies a list of add, replace and remove operations. Both
+// forms are understood: a path with a value, and a value object without one.
+func (app *applicationConfig) SCIMPatchUser(w http.ResponseWriter, r *http.Request) {
+	user := app.scimUserFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	var patch scimPatchRequest
+	err := app.readJSON(w, r, &patch)
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidValue, err)
+		return
+	}
+
+	if len(patch.Schemas) != 1 || patch.Schemas[0] != scimPatchSchema {
+		app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidValue, errors.New("request must use the PatchOp schema"))
+		return
+	}
+
+	changed := *user
+	active := !user.DeletedAt.Valid
+
+	for _, op := range patch.Operations {
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+			if op.Path == "" {
+				err = applySCIMValues(&changed, &active, "", op.Value)
+			} else {
+				err = applySCIMValue(&changed, &active, op.Path, op.Value)
+			}
+		case "remove":
+			err = removeSCIMValue(&changed, op.Path)
+		default:
+			err = fmt.Errorf("unsupported patch operation %q", op.Op)
+		}
+		if err != nil {
+			app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidPath, err)
+			return
+		}
+	}
+
+	app.saveSCIMUser(w, r, user, &changed, active)
+}
+
+// saveSCIMUser stores the changes made to user and opens or closes the
+// account to match active, then responds with the result
+func (app *applicationConfig) saveSCIMUser(w http.ResponseWriter, r *http.Request, user, changed *models.User, active bool) {
+	if changed.Email == "" {
+		app.scimErrorJSON(w, http.StatusBadRequest, scimInvalidValue, errors.New("userName is required"))
+		return
+	}
+
+	if changed.Email != user.Email {
+		_, err := app.models.User.ShowByEmail(changed.Email)
+		if err == nil {
+			app.scimErrorJSON(w, http.StatusConflict, scimUniquenessProblem, errors.New("a user with this userName already exists"))
+			return
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+			return
+		}
+		changed.EmailVerifiedAt = models.NullTime{}
+	}
+
+	err := changed.Update()
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+		return
+	}
+
+	diff := userDiff(user, changed)
+	if active == changed.DeletedAt.Valid {
+		diff["deleted"] = models.AuditChange{From: active, To: !active}
+	}
+
+	switch {
+	case active && changed.DeletedAt.Valid:
+		err = changed.Restore()
+	case !active && !changed.DeletedAt.Valid:
+		err = changed.SoftDelete()
+	}
+	if err != nil {
+		app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+		return
+	}
+
+	if len(diff) > 0 {
+		app.audit(r, models.AuditUserUpdated, changed.UserID, diff)
+	}
+
+	app.writeSCIM(w, http.StatusOK, app.newSCIMUser(changed))
+}
+
+// SCIMDeleteUser deprovisions a user. The account is closed, not removed.
+func (app *applicationConfig) SCIMDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user := app.scimUserFromURL(w, r)
+	if user == nil {
+		return
+	}
+
+	if !user.DeletedAt.Valid {
+		err := user.SoftDelete()
+		if err != nil {
+			app.scimErrorJSON(w, http.StatusInternalServerError, "", err)
+			return
+		}
+
+		app.audit(r, models.AuditUserDeleted, user.UserID, nil)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applySCIMValues applies a value object, as sent by a patch operation
+// without a path. Nested objects such as name are flattened into paths.
+func applySCIMValues(user *models.User, active *bool, prefix string, raw json.RawMessage) error {
+	var values map[string]json.RawMessage
+	err := json.Unmarshal(raw, &values)
+	if err != nil {
+		return errors.New("patch value must be an object when no path is given")
+	}
+
+	for key, value := range values {
+		path := prefix + key
+		if strings.EqualFold(key, "name") && prefix == "" {
+			err = applySCIMValues(user, active, "name.", value)
+		} else {
+			err = applySCIMValue(user, active, path, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applySCIMValue sets the attribute at path. Attributes we do not store,
+// such as externalId or schemas, are ignored.
+func applySCIMValue(user *models.User, active *bool, path string, raw json.RawMessage) error {
+	switch normalizeSCIMPath(path) {
+	case "active":
+		b, err := scimBool(raw)
+		if err != nil {
+			return err
+		}
+		*active = b
+	case "username", "emails.value":
+		return json.Unmarshal(raw, &user.Email)
+	case "emails":
+		var emails []scimEmail
+		err := json.Unmarshal(raw, &emails)
+		if err != nil {
+			return err
+		}
+		if email := (&scimUser{Emails: emails}).email(); email != "" {
+			user.Email = email
+		}
+	case "name.givenname":
+		return json.Unmarshal(raw, &user.FirstName)
+	case "name.familyname":
+		return json.Unmarshal(raw, &user.LastName)
+	case "id", "password":
+		return fmt.Errorf("%s cannot be changed", path)
+	}
+
+	return nil
+}
+
+// removeSCIMValue clears the attribute at path; only the name parts can be
+// cleared
+func removeSCIMValue(user *models.User, path string) error {
+	switch normalizeSCIMPath(path) {
+	case "name.givenname":
+		user.FirstName = ""
+	case "name.familyname":
+		user.LastName = ""
+	case "name":
+		user.FirstName = ""
+		user.LastName = ""
+	default:
+		return fmt.Errorf("%s cannot be removed", path)
+	}
+
+	return nil
+}
+
+// scimEmailPath matches value paths into the emails list, such as
+// emails[type eq "work"].value
+var scimEmailPath = regexp.MustCompile(`^emails\[[^\]]*\]\.value$`)
+
+// normalizeSCIMPath lower cases a path, strips the core schema URN some
+// clients prefix attributes with, and folds the emails value path variants
+func normalizeSCIMPath(path string) string {
+	path = strings.ToLower(strings.TrimSpace(path))
+	path = strings.TrimPrefix(path, strings.ToLower(scimUserSchema)+":")
+
+	if scimEmailPath.MatchString(path) {
+		return "emails.value"
+	}
+
+	return path
+}
+
+// scimBool reads a boolean, which some clients send as a string
+func scimBool(raw json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return false, errors.New("active must be a boolean")
+	}
+
+	return strconv.ParseBool(strings.ToLower(s))
+}
+
+// scimFilterClause matches one attribute comparison of a filter, such as
+// userName eq "bjensen@example.com"
+var scimFilterClause = regexp.MustCompile(`(?i)^\s*([a-z][a-z0-9.:\[\]" ]*?)\s+(eq|co|sw)\s+("(?:[^"\\]|\\.)*")\s*$`)
+
+// scimFilterAnd separates the clauses of a filter, where it is not inside a
+// quoted value or a value path; see splitSCIMFilter
+var scimFilterAnd = regexp.MustCompile(`(?i)\s+and\s+`)
+
+// scimFilterFields maps the SCIM attributes that can be filtered on to user
+// fields
+var scimFilterFields = map[string]string{
+	"id":              models.UserFieldUserID,
+	"username":        models.UserFieldEmail,
+	"emails.value":    models.UserFieldEmail,
+	"emails":          models.UserFieldEmail,
+	"name.givenname":  models.UserFieldFirstName,
+	"name.familyname": models.UserFieldLastName,
+}
+
+// parseSCIMFilter understands the subset of the SCIM filter language
+// provisioning clients use: eq, co and sw comparisons joined with "and"
+func parseSCIMFilter(filter string) ([]models.UserFilter, error) {
+	if strings.TrimSpace(filter) == "" {
+		return nil, nil
+	}
+
+	var filters []models.UserFilter
+	for _, clause := range splitSCIMFilter(filter) {
+		m := scimFilterClause.FindStringSubmatch(clause)
+		if m == nil {
+			return nil, fmt.Errorf("unsupported filter %q", clause)
+		}
+
+		field, ok := scimFilterFields[normalizeSCIMPath(m[1])]
+		if !ok {
+			return nil, fmt.Errorf("cannot filter by %s", m[1])
+		}
+
+		value, err := strconv.Unquote(m[3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed filter value %s", m[3])
+		}
+
+		filters = append(filters, models.UserFilter{
+			Field:    field,
+			Operator: strings.ToLower(m[2]),
+			Value:    value,
+		})
+	}
+
+	return filters, nil
+}
+
+// splitSCIMFilter splits a filter into its clauses at every "and" that is
+// neither inside a quoted value, as in displayName eq "Tom and Jerry", nor
+// inside the brackets of a value path
+func splitSCIMFilter(filter string) []string {
+	// topLevel[i] tells whether byte i is outside quotes and brackets
+	topLevel := make([]bool, len(filter))
+	quoted, escaped, depth := false, false, 0
+	for i := 0; i < len(filter); i++ {
+		topLevel[i] = !quoted && depth == 0
+
+		switch c := filter[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '[':
+			depth++
+		case !quoted && c == ']' && depth > 0:
+			depth--
+		}
+	}
+
+	var clauses []string
+	start := 0
+	for _, match := range scimFilterAnd.FindAllStringIndex(filter, -1) {
+		if !topLevel[match[0]] {
+			continue
+		}
+		clauses = append(clauses, filter[start:match[0]])
+		start = match[1]
+	}
+
+	return append(clauses, filter[start:])
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+func TestParseSCIMFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		want    []models.UserFilter
+		invalid bool
+	}{
+		{
+			filter: `userName eq "bjensen@example.com"`,
+			want:   []models.UserFilter{{Field: models.UserFieldEmail, Operator: "eq", Value: "bjensen@example.com"}},
+		},
+		{
+			filter: `name.givenName sw "Ba" AND name.familyName eq "Jensen"`,
+			want: []models.UserFilter{
+				{Field: models.UserFieldFirstName, Operator: "sw", Value: "Ba"},
+				{Field: models.UserFieldLastName, Operator: "eq", Value: "Jensen"},
+			},
+		},
+		{
+			filter: `name.familyName eq "Tom and Jerry"`,
+			want:   []models.UserFilter{{Field: models.UserFieldLastName, Operator: "eq", Value: "Tom and Jerry"}},
+		},
+		{
+			filter: `name.familyName eq "say \"a and b\"" and userName co "and"`,
+			want: []models.UserFilter{
+				{Field: models.UserFieldLastName, Operator: "eq", Value: `say "a and b"`},
+				{Field: models.UserFieldEmail, Operator: "co", Value: "and"},
+			},
+		},
+		{
+			filter: `emails[type eq "work" and primary eq "true"].value eq "bjensen@example.com"`,
+			want:   []models.UserFilter{{Field: models.UserFieldEmail, Operator: "eq", Value: "bjensen@example.com"}},
+		},
+		{
+			filter:  `userName eq "a" or userName eq "b"`,
+			invalid: true,
+		},
+		{
+			filter:  `userName eq "unterminated and userName eq "b"`,
+			invalid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			got, err := parseSCIMFilter(tt.filter)
+			if tt.invalid {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// visibility decides how much of a user the caller is allowed to see
+type visibility int
+
+const (
+	visibilityPublic visibility = iota
+	visibilitySelf
+	visibilityAdmin
+)
+
+// userView is the only shape in which a user is ever sent to a client. It is
+// built field by field from models.User, so the password hash and tokens
+// cannot end up in a response by accident. Fields the caller may not see are
+// left empty and omitted.
+type userView struct {
+	ID                int        `json:"id,omitempty"`
+	UserID            string     `json:"user_id"`
+	FirstName         string     `json:"first_name"`
+	LastName          string     `json:"last_name"`
+	Email             string     `json:"email,omitempty"`
+	Role              string     `json:"role,omitempty"`
+	EmailVerifiedAt   *time.Time `json:"email_verified_at,omitempty"`
+	PasswordChangedAt *time.Time `json:"password_changed_at,omitempty"`
+	CreatedAt         *time.Time `json:"created_at,omitempty"`
+	UpdatedAt         *time.Time `json:"updated_at,omitempty"`
+	DeletedAt         *time.Time `json:"deleted_at,omitempty"`
+	ImpersonatedBy    string     `json:"impersonated_by,omitempty"`
+}
+
+// newUserView builds the view of user appropriate for the given visibility.
+// Public callers get the name only, the user themselves also gets their
+// account details, and admins additionally get the internal fields.
+func newUserView(user *models.User, v visibility) userView {
+	view := userView{
+		UserID:    user.UserID,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+	}
+
+	if v >= visibilitySelf {
+		view.Email = user.Email
+		view.EmailVerifiedAt = nullTimePtr(user.EmailVerifiedAt)
+		view.CreatedAt = &user.CreatedAt
+		view.UpdatedAt = &user.UpdatedAt
+	}
+
+	if v >= visibilityAdmin {
+		view.ID = user.ID
+		view.Role = user.Role
+		view.PasswordChangedAt = nullTimePtr(user.PasswordChangedAt)
+		view.DeletedAt = nullTimePtr(user.DeletedAt)
+	}
+
+	return view
+}
+
+// newUserViews builds the views of several users for the same caller
+func (app *applicationConfig) newUserViews(r *http.Request, users []*models.User) []userView {
+	views := make([]userView, 0, len(users))
+	for _, user := range users {
+		views = append(views, newUserView(user, app.visibilityFor(r, user)))
+	}
+
+	return views
+}
+
+// visibilityFor works out what the caller of r may see of target. Admins see
+// everything, users see all of their own account, and everyone else only
+// gets the public fields. The caller's credentials must carry the matching
+// scope as well.
+func (app *applicationConfig) visibilityFor(r *http.Request, target *models.User) visibility {
+	caller := app.authenticatedUser(r)
+
+	switch {
+	case caller == nil:
+		return visibilityPublic
+	case caller.IsAdmin() && caller.GrantedScopes().Has(models.ScopeAdmin):
+		return visibilityAdmin
+	case caller.UserID == target.UserID && caller.GrantedScopes().Has(models.ScopeUsersRead):
+		return visibilitySelf
+	default:
+		return visibilityPublic
+	}
+}
+
+func nullTimePtr(t models.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	return &t.Time
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+// TestUserViewsHideCredentials makes sure no handler that sends users ever
+// includes a password hash or a token hash, whoever is asking
+func TestUserViewsHideCredentials(t *testing.T) {
+	app, _ := newTestApp(t)
+	handler := app.routes()
+
+	admin := createTestUser(t, app, "admin@example.com", models.RoleAdmin)
+	user := createTestUser(t, app, "user@example.com", models.RoleUser)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   interface{}
+	}{
+		{name: "login", method: http.MethodPost, path: "/auth/login", body: envelope{"email": user.Email, "password": testPassword}},
+		{name: "me", method: http.MethodGet, path: "/users/me/", token: loginTestUser(t, handler, user.Email)},
+		{name: "update me", method: http.MethodPatch, path: "/users/me/", token: loginTestUser(t, handler, user.Email), body: envelope{"first_name": "Renamed"}},
+		{name: "all users, anonymous", method: http.MethodGet, path: "/users/all"},
+		{name: "all users, as user", method: http.MethodGet, path: "/users/all", token: loginTestUser(t, handler, user.Email)},
+		{name: "all users, as admin", method: http.MethodGet, path: "/users/all", token: loginTestUser(t, handler, admin.Email)},
+		{name: "user by id, anonymous", method: http.MethodGet, path: "/users/get/" + user.UserID},
+		{name: "user by id, as self", method: http.MethodGet, path: "/users/get/" + user.UserID, token: loginTestUser(t, handler, user.Email)},
+		{name: "user by id, as admin", method: http.MethodGet, path: "/users/get/" + user.UserID, token: loginTestUser(t, handler, admin.Email)},
+		{name: "set role, as admin", method: http.MethodPut, path: "/admin/users/" + user.UserID + "/role", token: loginTestUser(t, handler, admin.Email), body: envelope{"role": models.RoleAdmin}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := doRequest(t, handler, tt.method, tt.path, tt.token, tt.body)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rr.Code, rr.Body)
+			}
+
+			var body interface{}
+			err := json.Unmarshal(rr.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, key := range jsonKeys(body) {
+				if key == "password" || key == "token_hash" {
+					t.Errorf("response has a %q key: %s", key, rr.Body)
+				}
+			}
+
+			if strings.Contains(rr.Body.String(), "$2a$") {
+				t.Errorf("response contains a bcrypt hash: %s", rr.Body)
+			}
+		})
+	}
+}
+
+// storedSecrets returns the password hashes, token hashes and secret hashes
+// the database holds, by table and column. The audit log's own hashes are
+// public.
+func storedSecrets(t *testing.T, mem *memDB) map[string][]string {
+	t.Helper()
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	secrets := make(map[string][]string)
+	for table, rows := range mem.tables {
+		if strings.HasPrefix(table, "audit_") {
+			continue
+		}
+		for _, row := range rows {
+			for column, value := range row {
+				if column != "password" && !strings.HasSuffix(column, "_hash") {
+					continue
+				}
+				if value != nil && toString(value) != "" {
+					secrets[table+"."+column] = append(secrets[table+"."+column], toString(value))
+				}
+			}
+		}
+	}
+
+	return secrets
+}
+
+// TestSCIMAuditOAuthHideCredentials makes sure the SCIM, audit and OAuth
+// endpoints never send back a password, a password hash or a token hash
+func TestSCIMAuditOAuthHideCredentials(t *testing.T) {
+	app, mem := newTestApp(t)
+	handler := app.routes()
+
+	createTestUser(t, app, "admin@example.com", models.RoleAdmin)
+	adminToken := loginTestUser(t, handler, "admin@example.com")
+
+	responses := map[string]*httptest.ResponseRecorder{}
+	record := func(name string, rr *httptest.ResponseRecorder, status int) *httptest.ResponseRecorder {
+		t.Helper()
+		if rr.Code != status {
+			t.Fatalf("%s: status %d: %s", name, rr.Code, rr.Body)
+		}
+		responses[name] = rr
+		return rr
+	}
+	decode := func(rr *httptest.ResponseRecorder, v interface{}) {
+		t.Helper()
+		err := json.Unmarshal(rr.Body.Bytes(), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// SCIM
+	var apiKey struct {
+		Data struct {
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	decode(record("api key", doRequest(t, handler, http.MethodPost, "/users/me/api-keys", adminToken, envelope{
+		"name":   "provisioning",
+		"scopes": []string{models.ScopeSCIM},
+	}), http.StatusCreated), &apiKey)
+
+	scimRequest := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		t.Helper()
+		var payload strings.Builder
+		if body != nil {
+			err := json.NewEncoder(&payload).Encode(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := httptest.NewRequest(method, path, strings.NewReader(payload.String()))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Content-Type", "application/scim+json")
+		req.Header.Set("Authorization", "Bearer "+apiKey.Data.Key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	scimPassword := "Sc1mProvisioned"
+	var scimUser struct {
+		ID string `json:"id"`
+	}
+	decode(record("scim create", scimRequest(http.MethodPost, "/scim/v2/Users", envelope{
+		"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:User"},
+		"userName": "provisioned@example.com",
+		"password": scimPassword,
+	}), http.StatusCreated), &scimUser)
+	record("scim get", scimRequest(http.MethodGet, "/scim/v2/Users/"+scimUser.ID, nil), http.StatusOK)
+	record("scim list", scimRequest(http.MethodGet, "/scim/v2/Users", nil), http.StatusOK)
+	record("scim replace", scimRequest(http.MethodPut, "/scim/v2/Users/"+scimUser.ID, envelope{
+		"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:User"},
+		"userName": "provisioned@example.com",
+		"name":     envelope{"givenName": "Pro", "familyName": "Visioned"},
+	}), http.StatusOK)
+
+	// OAuth
+	client := registerOAuthClient(t, handler, adminToken, true)
+	code := authorize(t, handler, adminToken, client, codeChallenge(testCodeVerifier)).Get("code")
+	issued := record("oauth token", postForm(t, handler, "/oauth/token", client.credentials(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {testCodeVerifier},
+	})), http.StatusOK)
+	var tokens tokenResponse
+	decode(issued, &tokens)
+	record("oauth refresh", postForm(t, handler, "/oauth/token", client.credentials(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {tokens.RefreshToken},
+	})), http.StatusOK)
+	record("oauth introspect", postForm(t, handler, "/oauth/introspect", client.credentials(url.Values{
+		"token": {tokens.AccessToken},
+	})), http.StatusOK)
+
+	// audit, last, so it lists all of the above
+	record("audit", doRequest(t, handler, http.MethodGet, "/admin/audit", adminToken, nil), http.StatusOK)
+
+	stored := storedSecrets(t, mem)
+	secrets := []string{testPassword, scimPassword}
+	for _, column := range []string{
+		"users.password",
+		"tokens.token_hash",
+		"api_keys.secret_hash",
+		"oauth_clients.secret_hash",
+		"oauth_refresh_tokens.token_hash",
+	} {
+		if len(stored[column]) == 0 {
+			t.Fatalf("nothing is stored in %s", column)
+		}
+		secrets = append(secrets, stored[column]...)
+	}
+
+	for name, rr := range responses {
+		body := rr.Body.String()
+		for _, secret := range secrets {
+			if strings.Contains(body, secret) {
+				t.Errorf("%s: response contains %q: %s", name, secret, body)
+			}
+		}
+
+		var document interface{}
+		err := json.Unmarshal(rr.Body.Bytes(), &document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range jsonKeys(document) {
+			if key == "password" || key == "token_hash" || key == "secret_hash" {
+				t.Errorf("%s: response has a %q key: %s", name, key, body)
+			}
+		}
+	}
+}
+
+// jsonKeys returns every object key in a decoded JSON value, however deep
+func jsonKeys(v interface{}) []string {
+	var keys []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			keys = append(keys, key)
+			keys = append(keys, jsonKeys(value)...)
+		}
+	case []interface{}:
+		for _, value := range v {
+			keys = append(keys, jsonKeys(value)...)
+		}
+	}
+	return keys
+}
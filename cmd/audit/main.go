@@ -0,0 +1,224 @@
+// Command audit checks that the audit log has not been tampered with, and
+// exports it for auditors.
+//
+//	audit verify
+//	audit export [-since 2023-01-01T00:00:00Z] [-out audit.jsonl]
+//
+// verify walks the hash chain and exits with status 1 if any event was
+// modified, removed or reordered. Events written before the log was chained
+// (migration 000014) carry no hash; verify reports how many there are and
+// checks the chain from the first event after them.
+//
+// export writes one event per line, followed by a last line holding a
+// signature: {"signature": "<JWT>"}. The JWT is signed with the OIDC signing
+// key (OIDC_SIGNING_KEY_FILE), so it can be checked against the API's
+// /.well-known/jwks.json, and its sha256 claim is the SHA-256 of every line
+// before it. Each event carries its hash and the hash of the event before it,
+// which can be recomputed from the exported fields.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/config"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/driver"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/oidc"
+)
+
+const usage = `usage:
+	audit verify
+	audit export [-since time] [-out file] [-key file]`
+
+// exportLine is how an event is written to an export. The diff is written
+// exactly as stored, so the event's hash can be recomputed from the line.
+type exportLine struct {
+	*models.AuditEvent
+	Diff json.RawMessage `json:"diff"`
+}
+
+// exportClaims are signed at the end of an export
+type exportClaims struct {
+	Issuer   string `json:"iss"`
+	IssuedAt int64  `json:"iat"`
+	Events   int64  `json:"events"`
+	FirstID  int64  `json:"first_id"`
+	LastID   int64  `json:"last_id"`
+	HeadHash string `json:"head_hash"`
+	SHA256   string `json:"sha256"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// settings are shared with the API, through CONFIG_FILE and the environment
+	cfg, err := config.Load("audit", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch os.Args[1] {
+	case "verify":
+		err = verify(cfg)
+	case "export":
+		err = export(cfg, os.Args[2:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// connect opens the database the API uses, configured the same way
+func connect(cfg *config.Config) (models.Models, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	db, err := driver.ConnectDB(ctx, cfg.DB.Connection(), cfg.Logger(os.Stderr))
+	if err != nil {
+		return models.Models{}, err
+	}
+
+	models.SetDBTimeout(cfg.DB.Timeout)
+
+	return models.New(db.SQL), nil
+}
+
+func verify(cfg *config.Config) error {
+	m, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	verification, err := m.AuditEvent.VerifyChain()
+	if err != nil {
+		return err
+	}
+
+	if !report(os.Stdout, verification) {
+		os.Exit(1)
+	}
+
+	return nil
+}
+
+// report prints what VerifyChain found, and tells whether the chain is intact
+func report(w io.Writer, verification *models.AuditVerification) bool {
+	if verification.Unchained > 0 {
+		fmt.Fprintf(w, "%d events up to event %d were written before the log was chained and cannot be checked\n", verification.Unchained, verification.LastUnchainedID)
+	}
+
+	for _, problem := range verification.Problems {
+		fmt.Fprintf(w, "event %d: %s\n", problem.EventID, problem.Reason)
+	}
+
+	if len(verification.Problems) > 0 {
+		fmt.Fprintf(w, "checked %d events, found %d problems\n", verification.Checked, len(verification.Problems))
+		return false
+	}
+
+	fmt.Fprintf(w, "checked %d events, the chain is intact\n", verification.Checked)
+
+	return true
+}
+
+func export(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	sinceFlag := flags.String("since", "", "only export events created at or after this RFC 3339 time")
+	outFlag := flags.String("out", "", "file to write to, instead of standard output")
+	keyFlag := flags.String("key", cfg.OIDC.SigningKeyFile, "PEM encoded RSA key to sign the export with")
+	issuerFlag := flags.String("issuer", cfg.OIDC.Issuer, "issuer named in the signature")
+	_ = flags.Parse(args)
+
+	var since time.Time
+	if *sinceFlag != "" {
+		parsed, err := time.Parse(time.RFC3339, *sinceFlag)
+		if err != nil {
+			return errors.New("-since must be an RFC 3339 time")
+		}
+		since = parsed
+	}
+
+	if *keyFlag == "" {
+		return errors.New("a signing key is required: set OIDC_SIGNING_KEY_FILE or pass -key")
+	}
+	signer, err := oidc.LoadSigner(*keyFlag)
+	if err != nil {
+		return fmt.Errorf("cannot load signing key: %w", err)
+	}
+
+	m, err := connect(cfg)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *outFlag != "" {
+		out, err = os.Create(*outFlag)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	w := bufio.NewWriter(out)
+	digest := sha256.New()
+	encoder := json.NewEncoder(io.MultiWriter(w, digest))
+
+	claims := exportClaims{Issuer: *issuerFlag}
+	err = m.AuditEvent.WalkChain(since, func(event *models.ChainedAuditEvent) error {
+		if claims.Events == 0 {
+			claims.FirstID = event.ID
+		}
+		claims.Events++
+		claims.LastID = event.ID
+		claims.HeadHash = event.Hash
+
+		return encoder.Encode(exportLine{AuditEvent: &event.AuditEvent, Diff: event.RawDiff})
+	})
+	if err != nil {
+		return err
+	}
+
+	claims.IssuedAt = time.Now().Unix()
+	claims.SHA256 = hex.EncodeToString(digest.Sum(nil))
+
+	signature, err := signer.Sign(claims)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(w).Encode(map[string]string{"signature": signature})
+	if err != nil {
+		return err
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if *outFlag != "" {
+		log.Printf("exported %d events to %s", claims.Events, *outFlag)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+)
+
+func TestReport(t *testing.T) {
+	tests := []struct {
+		name         string
+		verification models.AuditVerification
+		intact       bool
+		lines        []string
+	}{
+		{
+			name:         "intact",
+			verification: models.AuditVerification{Checked: 5},
+			intact:       true,
+			lines:        []string{"checked 5 events, the chain is intact"},
+		},
+		{
+			name:         "events from before the chain",
+			verification: models.AuditVerification{Checked: 5, Unchained: 3, LastUnchainedID: 3},
+			intact:       true,
+			lines: []string{
+				"3 events up to event 3 were written before the log was chained and cannot be checked",
+				"checked 5 events, the chain is intact",
+			},
+		},
+		{
+			name: "modified and deleted",
+			verification: models.AuditVerification{
+				Checked: 4,
+				Problems: []models.AuditProblem{
+					{EventID: 2, Reason: "contents do not match the hash: the event was modified"},
+					{EventID: 4, Reason: "does not follow event 2: events were removed or reordered"},
+				},
+			},
+			lines: []string{
+				"event 2: contents do not match the hash: the event was modified",
+				"event 4: does not follow event 2: events were removed or reordered",
+				"checked 4 events, found 2 problems",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			intact := report(&out, &tt.verification)
+
+			if intact != tt.intact {
+				t.Errorf("report = %v, want %v", intact, tt.intact)
+			}
+			if got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"); strings.Join(got, "\n") != strings.Join(tt.lines, "\n") {
+				t.Fatalf("printed:\n%s\nwant:\n%s", out.String(), strings.Join(tt.lines, "\n"))
+			}
+		})
+	}
+}
+
+// TestExportLinesCanBeChecked checks that an auditor can recompute every
+// hash of an exported chain from the lines alone
+func TestExportLinesCanBeChecked(t *testing.T) {
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+
+	prevHash := ""
+	created := time.Date(2023, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	for i := 1; i <= 3; i++ {
+		event := models.AuditEvent{
+			ID:        int64(i),
+			Type:      models.AuditRoleChanged,
+			ActorID:   "admin-1",
+			TargetID:  "user-1",
+			IP:        "192.0.2.1",
+			UserAgent: "test",
+			CreatedAt: created.Add(time.Duration(i) * time.Second),
+			PrevHash:  prevHash,
+		}
+		// stored as MySQL returns it, which is not how Go would encode it
+		rawDiff := []byte(`{"role": {"from": "user", "to": "admin"}}`)
+
+		var err error
+		event.Hash, err = event.ComputeHash(rawDiff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prevHash = event.Hash
+
+		err = encoder.Encode(exportLine{AuditEvent: &event, Diff: rawDiff})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prevHash = ""
+	lines := 0
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		lines++
+
+		var line exportLine
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if line.PrevHash != prevHash {
+			t.Fatalf("line %d does not follow the one before it", lines)
+		}
+		hash, err := line.ComputeHash(line.Diff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != line.Hash {
+			t.Fatalf("line %d: recomputed %s, exported %s", lines, hash, line.Hash)
+		}
+		prevHash = line.Hash
+	}
+	if lines != 3 {
+		t.Fatalf("read %d lines, want 3", lines)
+	}
+}
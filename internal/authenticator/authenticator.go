@@ -0,0 +1,88 @@
+package authenticator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrInvalidCredentials is returned when the directory rejects the email
+// address or password
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Identity is what an external directory tells us about a user whose
+// credentials it accepted
+type Identity struct {
+	Email     string
+	FirstName string
+	LastName  string
+}
+
+// Authenticator checks a user's credentials somewhere other than the bcrypt
+// hash in users.password
+type Authenticator interface {
+	Authenticate(ctx context.Context, email, password string) (*Identity, error)
+}
+
+// Domains picks the authenticator for an email address by its domain. An
+// address whose domain has no authenticator is checked against the local
+// password hash.
+type Domains map[string]Authenticator
+
+// For returns the authenticator responsible for email, or nil when the
+// address belongs to a local account
+func (d Domains) For(email string) Authenticator {
+	domain := Domain(email)
+	if domain == "" {
+		return nil
+	}
+
+	return d[domain]
+}
+
+// Domain returns the lower cased domain of an email address, or "" when it
+// has none
+func Domain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+
+	return strings.ToLower(email[at+1:])
+}
+
+// LoadDomains reads a JSON array of LDAP directory configurations from a file
+// and returns an authenticator for every domain they list
+func LoadDomains(path string) (Domains, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []LDAPConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, err
+	}
+
+	domains := make(Domains)
+	for _, c := range configs {
+		if c.URL == "" || c.BaseDN == "" || len(c.Domains) == 0 {
+			return nil, fmt.Errorf("%s: url, base_dn and domains are required for every directory", path)
+		}
+
+		directory := NewLDAP(c)
+		for _, domain := range c.Domains {
+			domain = strings.ToLower(domain)
+			if _, exists := domains[domain]; exists {
+				return nil, fmt.Errorf("%s: domain %s is configured more than once", path, domain)
+			}
+			domains[domain] = directory
+		}
+	}
+
+	return domains, nil
+}
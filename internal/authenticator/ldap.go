@@ -0,0 +1,146 @@
+package authenticator
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// defaultLDAPTimeout bounds every directory round trip when the caller's
+// context has no deadline of its own
+const defaultLDAPTimeout = 10 * time.Second
+
+// LDAPConfig describes an LDAP or Active Directory server and which email
+// domains it is the source of truth for
+type LDAPConfig struct {
+	Name     string   `json:"name"`
+	Domains  []string `json:"domains"`
+	URL      string   `json:"url"`
+	StartTLS bool     `json:"start_tls"`
+
+	// BindDN and BindPassword are the service account used to search for
+	// users. Leave them empty if the directory allows anonymous search.
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+
+	// BaseDN is where users are searched, and UserFilter the search filter
+	// with a single %s for the escaped email address
+	BaseDN     string `json:"base_dn"`
+	UserFilter string `json:"user_filter"`
+
+	MailAttribute      string `json:"mail_attribute"`
+	FirstNameAttribute string `json:"first_name_attribute"`
+	LastNameAttribute  string `json:"last_name_attribute"`
+}
+
+// LDAP authenticates users with a search and bind against a directory: the
+// service account looks up the entry for the email address, and the user's
+// password is then checked by binding as that entry
+type LDAP struct {
+	config LDAPConfig
+}
+
+// NewLDAP returns an authenticator for the given directory, filling in the
+// attribute names Active Directory and most OpenLDAP schemas use
+func NewLDAP(config LDAPConfig) *LDAP {
+	if config.UserFilter == "" {
+		config.UserFilter = "(&(objectClass=person)(mail=%s))"
+	}
+	if config.MailAttribute == "" {
+		config.MailAttribute = "mail"
+	}
+	if config.FirstNameAttribute == "" {
+		config.FirstNameAttribute = "givenName"
+	}
+	if config.LastNameAttribute == "" {
+		config.LastNameAttribute = "sn"
+	}
+
+	return &LDAP{config: config}
+}
+
+// Authenticate checks email and password against the directory
+func (l *LDAP) Authenticate(ctx context.Context, email, password string) (*Identity, error) {
+	// an empty password would be an unauthenticated bind, which most
+	// directories accept for any DN
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	timeout := defaultLDAPTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	conn, err := ldap.DialURL(l.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(timeout)
+
+	if l.config.StartTLS {
+		u, err := url.Parse(l.config.URL)
+		if err != nil {
+			return nil, err
+		}
+		err = conn.StartTLS(&tls.Config{ServerName: u.Hostname()})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if l.config.BindDN != "" {
+		err = conn.Bind(l.config.BindDN, l.config.BindPassword)
+		if err != nil {
+			return nil, fmt.Errorf("service account bind: %w", err)
+		}
+	}
+
+	search := ldap.NewSearchRequest(
+		l.config.BaseDN,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		2,
+		int(timeout/time.Second),
+		false,
+		fmt.Sprintf(l.config.UserFilter, ldap.EscapeFilter(email)),
+		[]string{l.config.MailAttribute, l.config.FirstNameAttribute, l.config.LastNameAttribute},
+		nil,
+	)
+
+	result, err := conn.Search(search)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	if result == nil || len(result.Entries) != 1 {
+		// no entry, or an ambiguous filter matching several
+		return nil, ErrInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	err = conn.Bind(entry.DN, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		Email:     entry.GetAttributeValue(l.config.MailAttribute),
+		FirstName: entry.GetAttributeValue(l.config.FirstNameAttribute),
+		LastName:  entry.GetAttributeValue(l.config.LastNameAttribute),
+	}
+	if identity.Email == "" {
+		return nil, errors.New("directory entry " + entry.DN + " has no " + l.config.MailAttribute)
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,310 @@
+package authenticator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAP result codes the stub answers with
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+)
+
+// stubEntry is a user in the stub directory
+type stubEntry struct {
+	dn, password string
+	attributes   map[string]string
+}
+
+// stubLDAP is an in-process directory speaking just enough LDAP for search
+// and bind: simple binds, subtree searches by an exact filter, and unbind
+type stubLDAP struct {
+	listener net.Listener
+	// passwords holds who may bind, by DN; entries are searched by filter
+	passwords map[string]string
+	entries   []stubEntry
+
+	mu       sync.Mutex
+	searches []string
+}
+
+func newStubLDAP(t *testing.T, serviceDN, servicePassword string, entries ...stubEntry) *stubLDAP {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stubLDAP{
+		listener:  listener,
+		passwords: map[string]string{serviceDN: servicePassword},
+		entries:   entries,
+	}
+	for _, entry := range entries {
+		s.passwords[entry.dn] = entry.password
+	}
+
+	go s.serve()
+	t.Cleanup(func() { _ = listener.Close() })
+
+	return s
+}
+
+func (s *stubLDAP) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *stubLDAP) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *stubLDAP) handle(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+
+			code := ldapInvalidCredentials
+			if expected, ok := s.passwords[dn]; ok && password != "" && password == expected {
+				code = ldapSuccess
+			}
+			s.reply(conn, messageID, ldapResult(ldap.ApplicationBindResponse, code))
+
+		case ldap.ApplicationSearchRequest:
+			filter, err := ldap.DecompileFilter(op.Children[6])
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.searches = append(s.searches, filter)
+			s.mu.Unlock()
+
+			for _, entry := range s.entries {
+				if filter != "(&(objectClass=person)(mail="+ldap.EscapeFilter(entry.attributes["mail"])+"))" {
+					continue
+				}
+
+				result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+				result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.dn, "DN"))
+				attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+				for name, value := range entry.attributes {
+					attribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+					attribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+					attribute.AppendChild(values)
+					attributes.AppendChild(attribute)
+				}
+				result.AppendChild(attributes)
+				s.reply(conn, messageID, result)
+			}
+			s.reply(conn, messageID, ldapResult(ldap.ApplicationSearchResultDone, ldapSuccess))
+
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+func (s *stubLDAP) reply(conn net.Conn, messageID interface{}, op *ber.Packet) {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	envelope.AppendChild(op)
+	_, _ = conn.Write(envelope.Bytes())
+}
+
+// ldapResult is a response carrying only a result code
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return result
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	const serviceDN = "cn=svc,dc=corp,dc=example"
+
+	directory := newStubLDAP(t, serviceDN, "svc-secret", stubEntry{
+		dn:       "uid=alice,ou=people,dc=corp,dc=example",
+		password: "alice-secret",
+		attributes: map[string]string{
+			"mail":      "alice@corp.example",
+			"givenName": "Alice",
+			"sn":        "Corp",
+		},
+	})
+
+	config := LDAPConfig{
+		URL:          directory.url(),
+		BindDN:       serviceDN,
+		BindPassword: "svc-secret",
+		BaseDN:       "dc=corp,dc=example",
+	}
+
+	tests := []struct {
+		name            string
+		email, password string
+		servicePassword string
+		want            *Identity
+		err             error
+	}{
+		{
+			name:     "search and bind",
+			email:    "alice@corp.example",
+			password: "alice-secret",
+			want:     &Identity{Email: "alice@corp.example", FirstName: "Alice", LastName: "Corp"},
+		},
+		{
+			name:     "wrong password",
+			email:    "alice@corp.example",
+			password: "guess",
+			err:      ErrInvalidCredentials,
+		},
+		{
+			name:     "empty password",
+			email:    "alice@corp.example",
+			password: "",
+			err:      ErrInvalidCredentials,
+		},
+		{
+			name:     "no entry",
+			email:    "bob@corp.example",
+			password: "alice-secret",
+			err:      ErrInvalidCredentials,
+		},
+		{
+			name:     "filter injection",
+			email:    "*",
+			password: "alice-secret",
+			err:      ErrInvalidCredentials,
+		},
+		{
+			name:            "service account refused",
+			email:           "alice@corp.example",
+			password:        "alice-secret",
+			servicePassword: "stale",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := config
+			if tt.servicePassword != "" {
+				c.BindPassword = tt.servicePassword
+			}
+
+			identity, err := NewLDAP(c).Authenticate(context.Background(), tt.email, tt.password)
+
+			switch {
+			case tt.want != nil:
+				if err != nil {
+					t.Fatal(err)
+				}
+				if *identity != *tt.want {
+					t.Fatalf("identity = %+v, want %+v", identity, tt.want)
+				}
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+			default:
+				// a broken service account is an outage, not a wrong password
+				if err == nil || errors.Is(err, ErrInvalidCredentials) {
+					t.Fatalf("err = %v, want a directory error", err)
+				}
+			}
+		})
+	}
+
+	directory.mu.Lock()
+	defer directory.mu.Unlock()
+	for _, filter := range directory.searches {
+		if strings.Contains(filter, "(mail=*)") {
+			t.Fatalf("email was not escaped in the filter %s", filter)
+		}
+	}
+}
+
+func TestDomainsFor(t *testing.T) {
+	corp := NewLDAP(LDAPConfig{URL: "ldap://corp.example", BaseDN: "dc=corp"})
+	domains := Domains{"corp.example": corp}
+
+	tests := []struct {
+		email string
+		want  Authenticator
+	}{
+		{email: "alice@corp.example", want: corp},
+		{email: "Alice@CORP.Example", want: corp},
+		{email: "odd@name@corp.example", want: corp},
+		{email: "alice@example.com"},
+		{email: "alice@sub.corp.example"},
+		{email: "corp.example"},
+		{email: ""},
+	}
+
+	for _, tt := range tests {
+		if got := domains.For(tt.email); got != tt.want {
+			t.Errorf("For(%q) = %v, want %v", tt.email, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDomains(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "directories.json")
+		err := os.WriteFile(path, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	domains, err := LoadDomains(write(t, `[
+		{"name": "corp", "url": "ldap://corp", "base_dn": "dc=corp", "domains": ["Corp.example", "corp.example.org"]},
+		{"name": "lab", "url": "ldap://lab", "base_dn": "dc=lab", "domains": ["lab.example"]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 3 || domains.For("a@corp.example") != domains.For("a@corp.example.org") || domains.For("a@corp.example") == domains.For("a@lab.example") {
+		t.Fatalf("domains = %v", domains)
+	}
+
+	for name, content := range map[string]string{
+		"missing base_dn":  `[{"url": "ldap://corp", "domains": ["corp.example"]}]`,
+		"domain twice":     `[{"url": "ldap://a", "base_dn": "dc=a", "domains": ["corp.example"]}, {"url": "ldap://b", "base_dn": "dc=b", "domains": ["CORP.example"]}]`,
+		"not a JSON array": `{"url": "ldap://corp"}`,
+	} {
+		if _, err := LoadDomains(write(t, content)); err == nil {
+			t.Errorf("%s: loaded", name)
+		}
+	}
+}
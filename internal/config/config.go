@@ -0,0 +1,343 @@
+// Package config holds the settings of the API and of the tools that share
+// its database. Settings come from defaults, a YAML or TOML file, environment
+// variables and command line flags, each overriding the ones before it, and
+// are checked as a whole before anything starts.
+//
+// Every setting is a field of Config. Its struct tags name it in each source:
+// yaml and toml for the file, env for the environment variable and flag for
+// the command line flag. Fields tagged secret are never printed, cannot be
+// set with a flag, and can be read from a file named by the environment
+// variable with _FILE appended, e.g. MYSQL_PASSWORD_FILE.
+package config
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/driver"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secrets when the configuration is printed
+const redacted = "REDACTED"
+
+// Config is the whole configuration
+type Config struct {
+	Environment  string `yaml:"environment" toml:"environment" env:"ENV" flag:"env" usage:"name of the environment, e.g. development"`
+	InProduction bool   `yaml:"in_production" toml:"in_production" env:"INPRODUCTION" flag:"in-production" usage:"turn on the checks meant for production"`
+
+	Log      Log      `yaml:"log" toml:"log"`
+	Server   Server   `yaml:"server" toml:"server"`
+	DB       DB       `yaml:"db" toml:"db"`
+	Password Password `yaml:"password_policy" toml:"password_policy"`
+	OIDC     OIDC     `yaml:"oidc" toml:"oidc"`
+	SSO      SSO      `yaml:"sso" toml:"sso"`
+	Login    Login    `yaml:"login" toml:"login"`
+
+	// ConfigFile and PrintConfig steer loading; they are not settings
+	ConfigFile  string `yaml:"-" toml:"-" env:"CONFIG_FILE" flag:"config" usage:"YAML (.yaml, .yml) or TOML (.toml) file to read settings from"`
+	PrintConfig bool   `yaml:"-" toml:"-" flag:"print-config" usage:"print the configuration, with secrets redacted, and exit"`
+}
+
+// Log configures logging
+type Log struct {
+	Level  string `yaml:"level" toml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"lowest level logged: debug, info, warn or error"`
+	Format string `yaml:"format" toml:"format" env:"LOG_FORMAT" flag:"log-format" usage:"json or text; defaults to json in production and text otherwise"`
+}
+
+// Server configures the HTTP server
+type Server struct {
+	Port              int           `yaml:"port" toml:"port" env:"API_PORT" flag:"port" usage:"port the API listens on"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" toml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT" flag:"read-header-timeout" usage:"how long reading request headers may take"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"SERVER_READ_TIMEOUT" flag:"read-timeout" usage:"how long reading a whole request may take"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"SERVER_WRITE_TIMEOUT" flag:"write-timeout" usage:"how long handling a request and writing the response may take"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" toml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT" flag:"idle-timeout" usage:"how long an idle keep-alive connection is kept"`
+	ShutdownGrace     time.Duration `yaml:"shutdown_grace" toml:"shutdown_grace" env:"SHUTDOWN_GRACE_PERIOD" flag:"shutdown-grace" usage:"how long running requests may take to finish on shutdown"`
+	DrainDelay        time.Duration `yaml:"drain_delay" toml:"drain_delay" env:"SHUTDOWN_DRAIN_DELAY" flag:"drain-delay" usage:"how long /readyz reports not ready on shutdown before the server stops accepting connections"`
+	ReadinessTimeout  time.Duration `yaml:"readiness_timeout" toml:"readiness_timeout" env:"READINESS_TIMEOUT" flag:"readiness-timeout" usage:"how long the /readyz checks may take"`
+	MetricsAddr       string        `yaml:"metrics_addr" toml:"metrics_addr" env:"METRICS_ADDR" flag:"metrics-addr" usage:"host:port /metrics is served on, apart from the API; empty turns it off"`
+}
+
+// DB configures the database connection
+type DB struct {
+	Driver          string        `yaml:"driver" toml:"driver" env:"DB_DRIVER" flag:"db-driver" usage:"database/sql driver name"`
+	Host            string        `yaml:"host" toml:"host" env:"MYSQL_HOST" flag:"db-host" usage:"database host"`
+	Port            int           `yaml:"port" toml:"port" env:"DB_PORT" flag:"db-port" usage:"database port"`
+	Name            string        `yaml:"name" toml:"name" env:"MYSQL_DATABASE" flag:"db-name" usage:"database name"`
+	User            string        `yaml:"user" toml:"user" env:"MYSQL_USER" flag:"db-user" usage:"database user"`
+	Password        string        `yaml:"password" toml:"password" env:"MYSQL_PASSWORD" secret:"true"`
+	Timeout         time.Duration `yaml:"timeout" toml:"timeout" env:"DB_TIMEOUT" flag:"db-timeout" usage:"how long a query may take"`
+	DialTimeout     time.Duration `yaml:"dial_timeout" toml:"dial_timeout" env:"DB_DIAL_TIMEOUT" flag:"db-dial-timeout" usage:"how long opening a connection may take; 0 means no limit"`
+	ReadTimeout     time.Duration `yaml:"read_timeout" toml:"read_timeout" env:"DB_READ_TIMEOUT" flag:"db-read-timeout" usage:"how long a network read may take; 0 means no limit"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" toml:"write_timeout" env:"DB_WRITE_TIMEOUT" flag:"db-write-timeout" usage:"how long a network write may take; 0 means no limit"`
+	MaxOpenConns    int           `yaml:"max_open_conns" toml:"max_open_conns" env:"MAX_OPEN_DB_CONN" flag:"db-max-open-conns" usage:"most connections open at once"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" toml:"max_idle_conns" env:"MAX_IDLE_DB_CONN" flag:"db-max-idle-conns" usage:"most idle connections kept"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" toml:"conn_max_lifetime" env:"MAX_DB_LIFE_TIME" flag:"db-conn-max-lifetime" usage:"how long a connection is reused; 0 means forever"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" toml:"conn_max_idle_time" env:"MAX_DB_IDLE_TIME" flag:"db-conn-max-idle-time" usage:"how long a connection is kept idle; 0 means forever"`
+	ConnectRetry    int           `yaml:"connect_retry" toml:"connect_retry" env:"DB_CONNECT_RETRY" flag:"db-connect-retry" usage:"how many times to retry connecting at startup"`
+	RetryDelay      time.Duration `yaml:"retry_delay" toml:"retry_delay" env:"DB_RETRY_DELAY" flag:"db-retry-delay" usage:"wait before the first retry, doubled for each one after"`
+	RetryMaxDelay   time.Duration `yaml:"retry_max_delay" toml:"retry_max_delay" env:"DB_RETRY_MAX_DELAY" flag:"db-retry-max-delay" usage:"longest wait between retries"`
+}
+
+// Password configures the password policy
+type Password struct {
+	MinLength     int           `yaml:"min_length" toml:"min_length" env:"PASSWORD_MIN_LENGTH" flag:"password-min-length" usage:"shortest password allowed"`
+	MaxLength     int           `yaml:"max_length" toml:"max_length" env:"PASSWORD_MAX_LENGTH" flag:"password-max-length" usage:"longest password allowed, in bytes"`
+	RequireUpper  bool          `yaml:"require_upper" toml:"require_upper" env:"PASSWORD_REQUIRE_UPPER" flag:"password-require-upper" usage:"passwords need an upper case letter"`
+	RequireLower  bool          `yaml:"require_lower" toml:"require_lower" env:"PASSWORD_REQUIRE_LOWER" flag:"password-require-lower" usage:"passwords need a lower case letter"`
+	RequireDigit  bool          `yaml:"require_digit" toml:"require_digit" env:"PASSWORD_REQUIRE_DIGIT" flag:"password-require-digit" usage:"passwords need a digit"`
+	RequireSymbol bool          `yaml:"require_symbol" toml:"require_symbol" env:"PASSWORD_REQUIRE_SYMBOL" flag:"password-require-symbol" usage:"passwords need a symbol"`
+	HistorySize   int           `yaml:"history_size" toml:"history_size" env:"PASSWORD_HISTORY_SIZE" flag:"password-history-size" usage:"how many previous passwords cannot be reused"`
+	MaxAge        time.Duration `yaml:"max_age" toml:"max_age" env:"PASSWORD_MAX_AGE" flag:"password-max-age" usage:"how long a password lasts; 0 means forever"`
+	BreachedFile  string        `yaml:"breached_file" toml:"breached_file" env:"BREACHED_PASSWORDS_FILE" flag:"breached-passwords-file" usage:"file of SHA-1 hashes of breached passwords"`
+}
+
+// OIDC configures the OpenID Connect provider we are
+type OIDC struct {
+	Issuer         string `yaml:"issuer" toml:"issuer" env:"OIDC_ISSUER" flag:"oidc-issuer" usage:"issuer URL; defaults to http://localhost:<port>"`
+	SigningKeyFile string `yaml:"signing_key_file" toml:"signing_key_file" env:"OIDC_SIGNING_KEY_FILE" flag:"oidc-signing-key-file" usage:"PEM encoded RSA key ID tokens are signed with"`
+	ConsentURL     string `yaml:"consent_url" toml:"consent_url" env:"OIDC_CONSENT_URL" flag:"oidc-consent-url" usage:"front end page where users approve OAuth clients; browsers sent to /oauth/authorize are redirected there"`
+}
+
+// SSO configures the external identity providers and directories users can
+// sign in with
+type SSO struct {
+	FederationProvidersFile string `yaml:"federation_providers_file" toml:"federation_providers_file" env:"FEDERATION_PROVIDERS_FILE" flag:"federation-providers-file" usage:"JSON file of external OpenID Connect providers"`
+	FederationRedirectURL   string `yaml:"federation_redirect_url" toml:"federation_redirect_url" env:"FEDERATION_REDIRECT_URL" flag:"federation-redirect-url" usage:"front end page browsers are sent to when a sign in at an external provider ends, with the outcome in the URL fragment"`
+	LDAPDirectoriesFile     string `yaml:"ldap_directories_file" toml:"ldap_directories_file" env:"LDAP_DIRECTORIES_FILE" flag:"ldap-directories-file" usage:"JSON file of LDAP directories"`
+	SAMLProvidersFile       string `yaml:"saml_providers_file" toml:"saml_providers_file" env:"SAML_PROVIDERS_FILE" flag:"saml-providers-file" usage:"JSON file of SAML identity providers"`
+	SAMLKeyFile             string `yaml:"saml_sp_key_file" toml:"saml_sp_key_file" env:"SAML_SP_KEY_FILE" flag:"saml-sp-key-file" usage:"PEM encoded key of our SAML service provider"`
+	SAMLCertFile            string `yaml:"saml_sp_cert_file" toml:"saml_sp_cert_file" env:"SAML_SP_CERT_FILE" flag:"saml-sp-cert-file" usage:"PEM encoded certificate of our SAML service provider"`
+}
+
+// Login configures suspicious login detection
+type Login struct {
+	StepUp        bool   `yaml:"step_up" toml:"step_up" env:"LOGIN_STEP_UP" flag:"login-step-up" usage:"hold suspicious logins back until a code is entered"`
+	LocationsFile string `yaml:"locations_file" toml:"locations_file" env:"LOGIN_LOCATIONS_FILE" flag:"login-locations-file" usage:"CSV file mapping IP ranges to places"`
+	WebhookURL    string `yaml:"webhook_url" toml:"webhook_url" env:"LOGIN_WEBHOOK_URL" flag:"login-webhook-url" usage:"URL login notices are posted to"`
+	WebhookSecret string `yaml:"webhook_secret" toml:"webhook_secret" env:"LOGIN_WEBHOOK_SECRET" secret:"true"`
+}
+
+// Default returns the configuration used for anything not set elsewhere
+func Default() *Config {
+	policy := models.DefaultPasswordPolicy()
+
+	return &Config{
+		Environment: "development",
+		Log: Log{
+			Level: "info",
+		},
+		Server: Server{
+			Port:              8080,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownGrace:     30 * time.Second,
+			ReadinessTimeout:  2 * time.Second,
+			MetricsAddr:       "127.0.0.1:9090",
+		},
+		DB: DB{
+			Driver:          "mysql",
+			Host:            "localhost",
+			Port:            3306,
+			Timeout:         5 * time.Second,
+			DialTimeout:     10 * time.Second,
+			ReadTimeout:     30 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			MaxOpenConns:    5,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 5 * time.Minute,
+			ConnMaxIdleTime: time.Minute,
+			ConnectRetry:    10,
+			RetryDelay:      time.Second,
+			RetryMaxDelay:   30 * time.Second,
+		},
+		Password: Password{
+			MinLength:     policy.MinLength,
+			MaxLength:     policy.MaxLength,
+			RequireUpper:  policy.RequireUpper,
+			RequireLower:  policy.RequireLower,
+			RequireDigit:  policy.RequireDigit,
+			RequireSymbol: policy.RequireSymbol,
+			HistorySize:   policy.HistorySize,
+			MaxAge:        policy.MaxAge,
+		},
+	}
+}
+
+// Errors is every problem found with a configuration
+type Errors []string
+
+func (e Errors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks the configuration as a whole, and reports every problem
+// rather than only the first
+func (c *Config) Validate() error {
+	var errs Errors
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, err := logging.ParseLevel(c.Log.Level)
+	check(err == nil, "log level (LOG_LEVEL) must be debug, info, warn or error, not %q", c.Log.Level)
+	check(c.Log.Format == logging.FormatJSON || c.Log.Format == logging.FormatText, "log format (LOG_FORMAT) must be json or text, not %q", c.Log.Format)
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server port (API_PORT) must be between 1 and 65535, not %d", c.Server.Port)
+	check(c.Server.ReadHeaderTimeout > 0, "read header timeout (SERVER_READ_HEADER_TIMEOUT) must be positive")
+	check(c.Server.ReadTimeout >= c.Server.ReadHeaderTimeout, "read timeout (SERVER_READ_TIMEOUT) cannot be shorter than SERVER_READ_HEADER_TIMEOUT")
+	check(c.Server.WriteTimeout > 0, "write timeout (SERVER_WRITE_TIMEOUT) must be positive")
+	check(c.Server.IdleTimeout > 0, "idle timeout (SERVER_IDLE_TIMEOUT) must be positive")
+	check(c.Server.ShutdownGrace >= 0, "shutdown grace period (SHUTDOWN_GRACE_PERIOD) cannot be negative")
+	check(c.Server.DrainDelay >= 0, "shutdown drain delay (SHUTDOWN_DRAIN_DELAY) cannot be negative")
+	check(c.Server.ReadinessTimeout > 0, "readiness timeout (READINESS_TIMEOUT) must be positive")
+	if c.Server.MetricsAddr != "" {
+		_, port, err := net.SplitHostPort(c.Server.MetricsAddr)
+		check(err == nil, "metrics address (METRICS_ADDR) must be host:port, e.g. 127.0.0.1:9090, not %q", c.Server.MetricsAddr)
+		check(port != strconv.Itoa(c.Server.Port), "metrics address (METRICS_ADDR) must not use the API port %d", c.Server.Port)
+	}
+
+	check(c.DB.Driver != "", "database driver (DB_DRIVER) is required")
+	check(c.DB.Host != "", "database host (MYSQL_HOST) is required")
+	check(c.DB.Port > 0 && c.DB.Port < 65536, "database port (DB_PORT) must be between 1 and 65535, not %d", c.DB.Port)
+	check(c.DB.Name != "", "database name (MYSQL_DATABASE) is required")
+	check(c.DB.User != "", "database user (MYSQL_USER) is required")
+	check(c.DB.Timeout > 0, "database timeout (DB_TIMEOUT) must be positive")
+	check(c.DB.DialTimeout >= 0, "database dial timeout (DB_DIAL_TIMEOUT) cannot be negative")
+	check(c.DB.ReadTimeout >= 0, "database read timeout (DB_READ_TIMEOUT) cannot be negative")
+	check(c.DB.WriteTimeout >= 0, "database write timeout (DB_WRITE_TIMEOUT) cannot be negative")
+	check(c.DB.MaxOpenConns > 0, "open connections (MAX_OPEN_DB_CONN) must be at least 1")
+	check(c.DB.MaxIdleConns >= 0 && c.DB.MaxIdleConns <= c.DB.MaxOpenConns, "idle connections (MAX_IDLE_DB_CONN) must be between 0 and MAX_OPEN_DB_CONN")
+	check(c.DB.ConnMaxLifetime >= 0, "connection lifetime (MAX_DB_LIFE_TIME) cannot be negative")
+	check(c.DB.ConnMaxIdleTime >= 0, "connection idle time (MAX_DB_IDLE_TIME) cannot be negative")
+	check(c.DB.ConnectRetry >= 0, "database connect retries (DB_CONNECT_RETRY) cannot be negative")
+	check(c.DB.RetryDelay > 0, "database retry delay (DB_RETRY_DELAY) must be positive")
+	check(c.DB.RetryMaxDelay >= c.DB.RetryDelay, "database retry max delay (DB_RETRY_MAX_DELAY) cannot be shorter than DB_RETRY_DELAY")
+
+	check(c.Password.MinLength > 0, "minimum password length (PASSWORD_MIN_LENGTH) must be at least 1")
+	check(c.Password.MaxLength >= c.Password.MinLength && c.Password.MaxLength <= 72,
+		"maximum password length (PASSWORD_MAX_LENGTH) must be between PASSWORD_MIN_LENGTH and 72")
+	check(c.Password.HistorySize >= 0, "password history size (PASSWORD_HISTORY_SIZE) cannot be negative")
+	check(c.Password.MaxAge >= 0, "password max age (PASSWORD_MAX_AGE) cannot be negative")
+
+	if c.OIDC.Issuer != "" {
+		u, err := url.Parse(c.OIDC.Issuer)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && u.RawQuery == "" && u.Fragment == "",
+			"OIDC issuer (OIDC_ISSUER) must be an http(s) URL without query or fragment")
+	}
+	check(!c.InProduction || c.OIDC.SigningKeyFile != "", "OIDC signing key (OIDC_SIGNING_KEY_FILE) must be set in production")
+	if c.OIDC.ConsentURL != "" {
+		u, err := url.Parse(c.OIDC.ConsentURL)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && u.Fragment == "",
+			"OIDC consent page (OIDC_CONSENT_URL) must be an http(s) URL without fragment")
+	}
+	check(!c.InProduction || c.OIDC.ConsentURL != "", "OIDC consent page (OIDC_CONSENT_URL) must be set in production")
+
+	if c.SSO.FederationRedirectURL != "" {
+		u, err := url.Parse(c.SSO.FederationRedirectURL)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && u.Fragment == "",
+			"federation redirect page (FEDERATION_REDIRECT_URL) must be an http(s) URL without fragment")
+	}
+	check(!c.InProduction || c.SSO.FederationProvidersFile == "" || c.SSO.FederationRedirectURL != "",
+		"federation redirect page (FEDERATION_REDIRECT_URL) must be set in production when FEDERATION_PROVIDERS_FILE is")
+
+	check(c.SSO.SAMLProvidersFile == "" || (c.SSO.SAMLKeyFile != "" && c.SSO.SAMLCertFile != ""),
+		"SAML providers need SAML_SP_KEY_FILE and SAML_SP_CERT_FILE")
+
+	if c.Login.WebhookURL != "" {
+		u, err := url.Parse(c.Login.WebhookURL)
+		check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "", "login webhook (LOGIN_WEBHOOK_URL) must be an http(s) URL")
+	}
+	check(!c.Login.StepUp || c.Login.WebhookURL != "", "login step-up (LOGIN_STEP_UP) needs LOGIN_WEBHOOK_URL to deliver codes")
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// Logger returns the logger the configuration describes, writing to w
+func (c *Config) Logger(w io.Writer) *logging.Logger {
+	level, _ := logging.ParseLevel(c.Log.Level)
+
+	return logging.New(w, c.Log.Format, level)
+}
+
+// PasswordPolicy returns the password policy the configuration describes,
+// without the breached password list, which has to be loaded separately
+func (c *Config) PasswordPolicy() models.PasswordPolicy {
+	return models.PasswordPolicy{
+		MinLength:     c.Password.MinLength,
+		MaxLength:     c.Password.MaxLength,
+		RequireUpper:  c.Password.RequireUpper,
+		RequireLower:  c.Password.RequireLower,
+		RequireDigit:  c.Password.RequireDigit,
+		RequireSymbol: c.Password.RequireSymbol,
+		HistorySize:   c.Password.HistorySize,
+		MaxAge:        c.Password.MaxAge,
+	}
+}
+
+// Connection returns what the database driver needs to connect
+func (d DB) Connection() driver.Config {
+	return driver.Config{
+		Driver:          d.Driver,
+		Host:            d.Host,
+		Port:            d.Port,
+		Name:            d.Name,
+		User:            d.User,
+		Password:        d.Password,
+		DialTimeout:     d.DialTimeout,
+		ReadTimeout:     d.ReadTimeout,
+		WriteTimeout:    d.WriteTimeout,
+		MaxOpenConns:    d.MaxOpenConns,
+		MaxIdleConns:    d.MaxIdleConns,
+		ConnMaxLifetime: d.ConnMaxLifetime,
+		ConnMaxIdleTime: d.ConnMaxIdleTime,
+		ConnectRetry:    d.ConnectRetry,
+		RetryDelay:      d.RetryDelay,
+		RetryMaxDelay:   d.RetryMaxDelay,
+	}
+}
+
+// Redacted returns a copy of the configuration with every secret that is
+// set replaced, so it can be shown
+func (c *Config) Redacted() *Config {
+	clean := *c
+
+	walk(reflect.ValueOf(&clean).Elem(), func(field reflect.StructField, value reflect.Value) error {
+		if field.Tag.Get("secret") == "true" && value.String() != "" {
+			value.SetString(redacted)
+		}
+		return nil
+	})
+
+	return &clean
+}
+
+// Print writes the configuration as YAML, with secrets redacted. The output
+// can be used as a config file, once the secrets are put back.
+func (c *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+
+	err := encoder.Encode(c.Redacted())
+	if err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
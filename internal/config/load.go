@@ -0,0 +1,289 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+	"gopkg.in/yaml.v3"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Load builds the configuration for a program called name from, in order of
+// precedence, the command line flags in args, the environment, the config
+// file and the defaults, and validates it. When args asks for help, the
+// usage is printed and flag.ErrHelp returned.
+func Load(name string, args []string) (*Config, error) {
+	cfg := Default()
+
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	set, err := parseFlags(flags, cfg, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file to read can itself come from the environment or a flag
+	path := os.Getenv("CONFIG_FILE")
+	if raw, ok := set["config"]; ok {
+		path = raw
+	}
+
+	if path != "" {
+		err = loadFile(cfg, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var errs Errors
+
+	errs = append(errs, loadEnv(cfg)...)
+
+	walkErr := walk(reflect.ValueOf(cfg).Elem(), func(field reflect.StructField, value reflect.Value) error {
+		name := field.Tag.Get("flag")
+		raw, ok := set[name]
+		if name == "" || !ok {
+			return nil
+		}
+		if err := setValue(value, raw); err != nil {
+			errs = append(errs, fmt.Sprintf("-%s: %v", name, err))
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	if cfg.Log.Format == "" {
+		cfg.Log.Format = logging.FormatText
+		if cfg.InProduction {
+			cfg.Log.Format = logging.FormatJSON
+		}
+	}
+
+	if cfg.OIDC.Issuer == "" {
+		cfg.OIDC.Issuer = fmt.Sprintf("http://localhost:%d", cfg.Server.Port)
+	}
+	cfg.OIDC.Issuer = strings.TrimSuffix(cfg.OIDC.Issuer, "/")
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// parseFlags defines a flag for every setting that has one and parses args.
+// It returns the raw values of the flags that were given, which are only
+// applied once the file and the environment have been read.
+func parseFlags(flags *flag.FlagSet, cfg *Config, args []string) (map[string]string, error) {
+	err := walk(reflect.ValueOf(cfg).Elem(), func(field reflect.StructField, value reflect.Value) error {
+		name := field.Tag.Get("flag")
+		if name == "" {
+			return nil
+		}
+
+		usage := field.Tag.Get("usage")
+		if env := field.Tag.Get("env"); env != "" {
+			usage += " (" + env + ")"
+		}
+
+		flags.Var(&rawFlag{isBool: value.Kind() == reflect.Bool, def: formatValue(value)}, name, usage)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	set := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.(*rawFlag).raw
+	})
+
+	return set, nil
+}
+
+// rawFlag keeps the value a flag was given as is
+type rawFlag struct {
+	raw    string
+	def    string
+	isBool bool
+}
+
+func (f *rawFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.def
+}
+
+func (f *rawFlag) Set(s string) error {
+	f.raw = s
+	return nil
+}
+
+func (f *rawFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// loadFile reads settings from a YAML or TOML file, chosen by its extension.
+// Settings the file does not mention keep their defaults.
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(cfg)
+		// an empty file sets nothing
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.Decode(string(data), cfg)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown setting %q", meta.Undecoded()[0].String())
+		}
+	default:
+		return fmt.Errorf("config file %s must end in .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// loadEnv applies the environment variables that are set. Secrets may
+// instead be read from the file named by the variable with _FILE appended.
+func loadEnv(cfg *Config) Errors {
+	var errs Errors
+
+	_ = walk(reflect.ValueOf(cfg).Elem(), func(field reflect.StructField, value reflect.Value) error {
+		name := field.Tag.Get("env")
+		if name == "" {
+			return nil
+		}
+
+		raw, ok := os.LookupEnv(name)
+		if field.Tag.Get("secret") == "true" {
+			if path := os.Getenv(name + "_FILE"); path != "" {
+				if ok && raw != "" {
+					errs = append(errs, fmt.Sprintf("%s: set either %s or %s_FILE, not both", name, name, name))
+					return nil
+				}
+				data, err := os.ReadFile(path)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("%s_FILE: %v", name, err))
+					return nil
+				}
+				raw, ok = strings.TrimRight(string(data), "\r\n"), true
+			}
+		}
+
+		// an empty variable counts as not set, as the Makefile defines them all
+		if !ok || raw == "" {
+			return nil
+		}
+
+		if err := setValue(value, raw); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+		return nil
+	})
+
+	return errs
+}
+
+// walk calls fn for every setting in v, a struct, descending into nested
+// structs
+func walk(v reflect.Value, fn func(field reflect.StructField, value reflect.Value) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		var err error
+		if field.Type.Kind() == reflect.Struct {
+			err = walk(value, fn)
+		} else {
+			err = fn(field, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setValue parses raw into a setting
+func setValue(value reflect.Value, raw string) error {
+	if value.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, e.g. 30s, 5m or 2160h", raw)
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		value.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q, use true or false", raw)
+		}
+		value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+
+	return nil
+}
+
+// formatValue returns a setting the way setValue reads it
+func formatValue(value reflect.Value) string {
+	if value.Type() == durationType {
+		return time.Duration(value.Int()).String()
+	}
+
+	return fmt.Sprint(value.Interface())
+}
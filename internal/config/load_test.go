@@ -0,0 +1,241 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFile writes content to a file called name in a temporary directory
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// clearEnv unsets, for the test, every variable a setting could be read from
+func clearEnv(t *testing.T) {
+	t.Helper()
+
+	cfg := Default()
+	_ = walk(reflect.ValueOf(cfg).Elem(), func(field reflect.StructField, value reflect.Value) error {
+		if name := field.Tag.Get("env"); name != "" {
+			t.Setenv(name, "")
+			if field.Tag.Get("secret") == "true" {
+				t.Setenv(name+"_FILE", "")
+			}
+		}
+		return nil
+	})
+
+	t.Setenv("MYSQL_DATABASE", "api")
+	t.Setenv("MYSQL_USER", "api")
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	for _, ext := range []string{".yaml", ".toml"} {
+		t.Run(ext, func(t *testing.T) {
+			clearEnv(t)
+
+			content := map[string]string{
+				".yaml": "server:\n  port: 8081\ndb:\n  host: file-host\n  port: 3307\n  timeout: 7s\n",
+				".toml": "[server]\nport = 8081\n\n[db]\nhost = \"file-host\"\nport = 3307\ntimeout = \"7s\"\n",
+			}[ext]
+			path := writeFile(t, "api"+ext, content)
+
+			t.Setenv("API_PORT", "8082")
+			t.Setenv("DB_PORT", "3308")
+
+			cfg, err := Load("api", []string{"-config", path, "-db-port", "3309"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				name      string
+				got, want interface{}
+			}{
+				{name: "default", got: cfg.Log.Level, want: "info"},
+				{name: "file over default", got: cfg.DB.Host, want: "file-host"},
+				{name: "file duration", got: cfg.DB.Timeout, want: 7 * time.Second},
+				{name: "environment over file", got: cfg.Server.Port, want: 8082},
+				{name: "flag over environment", got: cfg.DB.Port, want: 3309},
+				{name: "derived issuer", got: cfg.OIDC.Issuer, want: "http://localhost:8082"},
+			}
+			for _, tt := range tests {
+				if tt.got != tt.want {
+					t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadFileFromEnvironment(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("CONFIG_FILE", writeFile(t, "api.yml", "log:\n  level: debug\n"))
+
+	cfg, err := Load("api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Log.Level != "debug" {
+		t.Fatalf("log level = %q, want the file's", cfg.Log.Level)
+	}
+
+	for name, content := range map[string]string{
+		"api.yaml": "server:\n  prot: 8081\n",
+		"api.toml": "[server]\nprot = 8081\n",
+		"api.json": "{}",
+	} {
+		t.Setenv("CONFIG_FILE", writeFile(t, name, content))
+		if _, err := Load("api", nil); err == nil {
+			t.Errorf("%s: loaded a file with an unknown setting or extension", name)
+		}
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("MYSQL_PASSWORD_FILE", writeFile(t, "password", "s3cret\n"))
+
+	cfg, err := Load("api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DB.Password != "s3cret" {
+		t.Fatalf("password = %q, want the file's without the newline", cfg.DB.Password)
+	}
+
+	// a secret cannot come from both places
+	t.Setenv("MYSQL_PASSWORD", "other")
+	_, err = Load("api", nil)
+	if err == nil || !strings.Contains(err.Error(), "not both") {
+		t.Fatalf("err = %v, want one about setting both", err)
+	}
+
+	t.Setenv("MYSQL_PASSWORD", "")
+	t.Setenv("MYSQL_PASSWORD_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := Load("api", nil); err == nil || !strings.Contains(err.Error(), "MYSQL_PASSWORD_FILE") {
+		t.Fatalf("err = %v, want one about the missing file", err)
+	}
+
+	// nor from a flag, where it would show up in the process list
+	t.Setenv("MYSQL_PASSWORD_FILE", "")
+	if _, err := Load("api", []string{"-db-password", "s3cret"}); err == nil {
+		t.Fatal("accepted a secret as a flag")
+	}
+}
+
+func TestLoadReportsEveryProblem(t *testing.T) {
+	clearEnv(t)
+	t.Setenv("API_PORT", "eighty")
+	t.Setenv("DB_TIMEOUT", "soon")
+
+	_, err := Load("api", []string{"-in-production=maybe"})
+	if err == nil {
+		t.Fatal("loaded invalid settings")
+	}
+
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("err = %v, want the three bad values", err)
+	}
+	for _, name := range []string{"API_PORT", "DB_TIMEOUT", "-in-production"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("%s is not reported: %v", name, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.Log.Format = "text"
+	cfg.Log.Level = "loud"
+	cfg.Server.Port = 0
+	cfg.Server.MetricsAddr = "127.0.0.1:0"
+	cfg.DB.MaxIdleConns = cfg.DB.MaxOpenConns + 1
+	cfg.SSO.FederationProvidersFile = "providers.json"
+	cfg.InProduction = true
+
+	err := cfg.Validate()
+
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("err = %v, want Errors", err)
+	}
+	for _, want := range []string{
+		"LOG_LEVEL",
+		"API_PORT",
+		"METRICS_ADDR",
+		"MYSQL_DATABASE",
+		"MYSQL_USER",
+		"MAX_IDLE_DB_CONN",
+		"OIDC_SIGNING_KEY_FILE",
+		"OIDC_CONSENT_URL",
+		"FEDERATION_REDIRECT_URL",
+	} {
+		found := false
+		for _, problem := range errs {
+			found = found || strings.Contains(problem, want)
+		}
+		if !found {
+			t.Errorf("%s is not reported in %v", want, errs)
+		}
+	}
+
+	valid := Default()
+	valid.Log.Format = "json"
+	valid.DB.Name, valid.DB.User = "api", "api"
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("the defaults with a database are invalid: %v", err)
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	clearEnv(t)
+
+	cfg := Default()
+	cfg.Log.Format = "json"
+	cfg.DB.Name, cfg.DB.User = "api", "api"
+	cfg.DB.Password = "hunter2"
+	cfg.Login.WebhookSecret = "whsec"
+
+	var out bytes.Buffer
+	err := cfg.Print(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, secret := range []string{"hunter2", "whsec"} {
+		if strings.Contains(out.String(), secret) {
+			t.Fatalf("printed %q:\n%s", secret, out.String())
+		}
+	}
+	if strings.Count(out.String(), redacted) != 2 {
+		t.Fatalf("secrets are not marked as redacted:\n%s", out.String())
+	}
+	if cfg.DB.Password != "hunter2" {
+		t.Fatal("printing changed the configuration")
+	}
+
+	// what is printed reads back as a config file
+	loaded, err := Load("api", []string{"-config", writeFile(t, "printed.yaml", out.String())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.DB.Name != "api" || loaded.Server.Port != cfg.Server.Port || loaded.DB.RetryMaxDelay != cfg.DB.RetryMaxDelay {
+		t.Fatalf("read back %+v", loaded)
+	}
+}
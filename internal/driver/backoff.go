@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// jitter is seeded per process, so instances pick different waits
+var jitter = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// sleep waits for d, or until ctx is done; tests replace it to not wait
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Backoff retries an operation with exponentially growing, jittered waits in
+// between, so instances started together do not retry in lockstep
+type Backoff struct {
+	// Retries is how many times a failed attempt is retried
+	Retries int
+	// Delay is the wait before the first retry; each retry doubles it
+	Delay time.Duration
+	// MaxDelay caps the wait
+	MaxDelay time.Duration
+}
+
+// Wait returns how long to wait after the given failed attempt, counting
+// from 1. The wait is picked at random between half and all of the delay
+// for that attempt.
+func (b Backoff) Wait(attempt int) time.Duration {
+	delay := b.Delay
+	for i := 1; i < attempt && delay < b.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > b.MaxDelay {
+		delay = b.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	jitter.Lock()
+	defer jitter.Unlock()
+
+	return delay/2 + time.Duration(jitter.Int63n(int64(delay/2)+1))
+}
+
+// Retry calls fn until it succeeds, it has failed Retries+1 times, or ctx
+// is done. fn is given the number of the attempt, counting from 1. Retry
+// returns how many attempts were made and the last error.
+func (b Backoff) Retry(ctx context.Context, fn func(attempt int) error) (int, error) {
+	attempt := 0
+	for {
+		attempt++
+
+		err := fn(attempt)
+		if err == nil || attempt > b.Retries {
+			return attempt, err
+		}
+
+		if err := sleep(ctx, b.Wait(attempt)); err != nil {
+			return attempt, err
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package driver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+)
+
+// fakeSleep replaces sleep for the test, recording the waits instead of
+// waiting. during, when set, runs at each wait with the context of the Retry.
+func fakeSleep(t *testing.T, during func(ctx context.Context)) *[]time.Duration {
+	t.Helper()
+
+	var waits []time.Duration
+	real := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		if during != nil {
+			during(ctx)
+		}
+		return ctx.Err()
+	}
+	t.Cleanup(func() { sleep = real })
+
+	return &waits
+}
+
+func TestBackoffWait(t *testing.T) {
+	b := Backoff{Delay: time.Second, MaxDelay: 10 * time.Second}
+
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 1, min: 500 * time.Millisecond, max: time.Second},
+		{attempt: 2, min: time.Second, max: 2 * time.Second},
+		{attempt: 3, min: 2 * time.Second, max: 4 * time.Second},
+		{attempt: 4, min: 4 * time.Second, max: 8 * time.Second},
+		// capped from here on, without the doubling overflowing
+		{attempt: 5, min: 5 * time.Second, max: 10 * time.Second},
+		{attempt: 200, min: 5 * time.Second, max: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 200; i++ {
+			wait := b.Wait(tt.attempt)
+			if wait < tt.min || wait > tt.max {
+				t.Fatalf("Wait(%d) = %v, want between %v and %v", tt.attempt, wait, tt.min, tt.max)
+			}
+			seen[wait] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("Wait(%d) is always %v; it is not jittered", tt.attempt, b.Wait(tt.attempt))
+		}
+	}
+
+	if wait := (Backoff{}).Wait(3); wait != 0 {
+		t.Fatalf("Wait without a delay = %v, want 0", wait)
+	}
+}
+
+func TestBackoffRetry(t *testing.T) {
+	errDown := errors.New("down")
+
+	tests := []struct {
+		name     string
+		retries  int
+		failures int
+		attempts int
+		err      error
+	}{
+		{name: "first attempt", retries: 3, failures: 0, attempts: 1},
+		{name: "after failures", retries: 3, failures: 2, attempts: 3},
+		{name: "last retry", retries: 3, failures: 3, attempts: 4},
+		{name: "gives up", retries: 3, failures: 10, attempts: 4, err: errDown},
+		{name: "no retries", retries: 0, failures: 10, attempts: 1, err: errDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waits := fakeSleep(t, nil)
+			b := Backoff{Retries: tt.retries, Delay: time.Second, MaxDelay: 3 * time.Second}
+
+			var calls []int
+			attempts, err := b.Retry(context.Background(), func(attempt int) error {
+				calls = append(calls, attempt)
+				if attempt <= tt.failures {
+					return errDown
+				}
+				return nil
+			})
+
+			if attempts != tt.attempts || !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("Retry = %d, %v; want %d, %v", attempts, err, tt.attempts, tt.err)
+			}
+			for i, attempt := range calls {
+				if attempt != i+1 {
+					t.Fatalf("attempts were numbered %v", calls)
+				}
+			}
+			if len(*waits) != tt.attempts-1 {
+				t.Fatalf("waited %d times between %d attempts", len(*waits), tt.attempts)
+			}
+			for i, wait := range *waits {
+				if wait > b.MaxDelay || wait < b.Delay/2 {
+					t.Fatalf("wait %d was %v", i+1, wait)
+				}
+			}
+		})
+	}
+}
+
+func TestBackoffRetryCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fakeSleep(t, func(context.Context) { cancel() })
+
+	calls := 0
+	attempts, err := Backoff{Retries: 5, Delay: time.Hour, MaxDelay: time.Hour}.Retry(ctx, func(int) error {
+		calls++
+		return errors.New("down")
+	})
+	if attempts != 1 || calls != 1 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Retry = %d, %v after %d calls; want 1, context.Canceled", attempts, err, calls)
+	}
+}
+
+func TestSleepEndsWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := sleep(ctx, time.Hour); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("sleep = %v, want context.DeadlineExceeded", err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Fatalf("sleep waited %v after its context ended", waited)
+	}
+
+	if err := sleep(context.Background(), time.Millisecond); err != nil {
+		t.Fatalf("sleep = %v, want nil", err)
+	}
+}
+
+// flakyDriver is a database/sql driver that refuses the first failures
+// connections
+type flakyDriver struct {
+	mu       sync.Mutex
+	failures int
+}
+
+func (d *flakyDriver) Open(string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.failures > 0 {
+		d.failures--
+		return nil, errors.New("connection refused")
+	}
+
+	return flakyConn{}, nil
+}
+
+type flakyConn struct{}
+
+func (flakyConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (flakyConn) Close() error                        { return nil }
+func (flakyConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+var flaky = &flakyDriver{}
+
+func init() {
+	sql.Register("flaky", flaky)
+}
+
+func TestConnectAttempts(t *testing.T) {
+	fakeSleep(t, nil)
+
+	cfg := Config{
+		Driver:        "flaky",
+		Host:          "localhost",
+		Port:          3306,
+		ConnectRetry:  3,
+		RetryDelay:    time.Second,
+		RetryMaxDelay: time.Minute,
+	}
+
+	flaky.failures = 2
+	db, err := ConnectDB(context.Background(), cfg, logging.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.SQL.Close()
+	if db.ConnectAttempts != 3 {
+		t.Fatalf("ConnectAttempts = %d, want 3", db.ConnectAttempts)
+	}
+
+	flaky.failures = 10
+	_, err = ConnectDB(context.Background(), cfg, logging.Discard())
+	if err == nil || !strings.Contains(err.Error(), "after 4 attempts") {
+		t.Fatalf("err = %v, want one after 4 attempts", err)
+	}
+}
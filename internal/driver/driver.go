@@ -1,146 +1,134 @@
 package driver
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
-	"log"
-	"os"
+	"net"
+	"strconv"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
 	"github.com/jmoiron/sqlx"
 )
 
 type DB struct {
 	SQL *sqlx.DB
 	dns string
+
+	// ConnectAttempts is how many pings it took to reach the database
+	ConnectAttempts int
 }
 
 var dbConn = &DB{}
 
-const maxOpenDbConn = 5 // might be changed in production
-const maxIdleDbConn = 5 // might be changed in production
-const maxDbLifeTime = 5 * time.Minute
+// Config is how to reach the database, how many connections to keep and
+// how to retry connecting at startup
+type Config struct {
+	Driver   string
+	Host     string
+	Port     int
+	Name     string
+	User     string
+	Password string
+
+	// DialTimeout, ReadTimeout and WriteTimeout bound establishing a
+	// connection and each network read and write on it; 0 means no limit
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxOpenConns of 0 means no limit. Connections are closed once idle for
+	// ConnMaxIdleTime or reused for ConnMaxLifetime; 0 keeps them forever.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// ConnectRetry is how many times a failed first ping is retried. The
+	// wait starts around RetryDelay and doubles after each attempt, up to
+	// RetryMaxDelay; see Backoff.
+	ConnectRetry  int
+	RetryDelay    time.Duration
+	RetryMaxDelay time.Duration
+}
 
-func ConnectDB(count int) (*DB, error) {
-	setDns()
+// ConnectDB opens the database and waits for it to answer, retrying as cfg
+// says. Each failed attempt is logged to logger, as are the driver's own
+// errors. It gives up as soon as ctx is done, so a startup stuck on a
+// database that is down can be stopped.
+func ConnectDB(ctx context.Context, cfg Config, logger *logging.Logger) (*DB, error) {
+	_ = mysql.SetLogger(logger.With("component", "mysql").StdLogger(logging.LevelError))
 
-	d, err := open(dbConn.dns)
+	err := setDns(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	d.SetMaxOpenConns(maxOpenDbConn)
-	d.SetMaxIdleConns(maxIdleDbConn)
-	d.SetConnMaxLifetime(maxDbLifeTime)
-
-	err = testDB(d, count)
+	d, err := open(cfg.Driver, dbConn.dns)
 	if err != nil {
 		return nil, err
 	}
 
+	d.SetMaxOpenConns(cfg.MaxOpenConns)
+	d.SetMaxIdleConns(cfg.MaxIdleConns)
+	d.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	d.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	backoff := Backoff{Retries: cfg.ConnectRetry, Delay: cfg.RetryDelay, MaxDelay: cfg.RetryMaxDelay}
+	attempts, err := backoff.Retry(ctx, func(attempt int) error {
+		err := d.PingContext(ctx)
+		if err != nil {
+			logger.Warn("cannot reach database", "attempt", attempt, "attempts", cfg.ConnectRetry+1, "error", err)
+		}
+		return err
+	})
+	if err != nil {
+		_ = d.Close()
+		return nil, fmt.Errorf("cannot connect to database after %d attempts: %w", attempts, err)
+	}
+
 	dbConn.SQL = d
+	dbConn.ConnectAttempts = attempts
 	return dbConn, nil
 }
 
+// Stats returns the live statistics of the connection pool
+func (d *DB) Stats() sql.DBStats {
+	return d.SQL.Stats()
+}
+
 // DNS
-func setDns() {
+func setDns(cfg Config) error {
 	jst, err := time.LoadLocation("Asia/Tokyo")
 	if err != nil {
-		log.Fatal("Load location failed:", err)
+		return fmt.Errorf("load location failed: %w", err)
 	}
-	address := os.Getenv("MYSQL_HOST") + ":" + os.Getenv("DB_PORT")
 	c := mysql.Config{
-		DBName:    os.Getenv("MYSQL_DATABASE"),
-		User:      os.Getenv("MYSQL_USER"),
-		Passwd:    os.Getenv("MYSQL_PASSWORD"),
-		Addr:      address,
+		DBName:    cfg.Name,
+		User:      cfg.User,
+		Passwd:    cfg.Password,
+		Addr:      net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
 		Net:       "tcp",
 		ParseTime: true,
 		Collation: "utf8mb4_unicode_ci",
 		Loc:       jst,
+
+		Timeout:      cfg.DialTimeout,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
 	}
 
 	dbConn.dns = c.FormatDSN()
+	return nil
 }
 
 // NewDatabase creates a new database for the application
-func open(dsn string) (*sqlx.DB, error) {
-	db, err := sqlx.Open(os.Getenv("DB_DRIVER"), dsn)
+func open(driverName, dsn string) (*sqlx.DB, error) {
+	db, err := sqlx.Open(driverName, dsn)
 	if err != nil {
 		return nil, err
 	}
 	return db, nil
 }
-
-func testDB(d *sqlx.DB, count int) error {
-	err := d.Ping()
-	if err != nil {
-		if count <= 0 {
-			fmt.Println("Error!", err)
-			return err
-		}
-		time.Sleep(time.Second * 2)
-		count--
-		fmt.Printf("Retry Connection... count:%v\n", count)
-		return testDB(d, count)
-	}
-	return nil
-
-	// use Ping.Context but not works
-	// ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	// defer cancel()
-
-	// if err := d.PingContext(ctx); err != nil {
-	// 	log.Fatal(err)
-	// 	return err
-	// }
-
-	// return nil
-}
-
-// RoundTrip を DB接続リトライで実装するほうがbetter
-
-// type retryableRoundTripper struct {
-// 	base     http.RoundTripper
-// 	attempts int
-// 	waitTime time.Duration
-// }
-
-// func (rt *retryableRoundTripper) shouldRetry(resp *http.Response, err error) bool {
-// 	if err != nil {
-// 		var netErr net.Error
-// 		if errors.As(err, &netErr) && netErr.Temporary() {
-// 			return true
-// 		}
-// 	}
-
-// 	if resp != nil {
-// 		if resp.StatusCode == 429 ||
-// 			(500 <= resp.StatusCode && resp.StatusCode <= 504) {
-// 			return true
-// 		}
-// 	}
-
-// 	return false
-// }
-
-// func (rt *retryableRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-// 	var (
-// 		resp *http.Response
-// 		err  error
-// 	)
-// 	for count := 0; count < rt.attempts; count++ {
-// 		resp, err = rt.base.RoundTrip(req)
-
-// 		if !rt.shouldRetry(resp, err) {
-// 			return resp, err
-// 		}
-
-// 		select {
-// 		case <-req.Context().Done():
-// 			return nil, req.Context().Err()
-// 		case <-time.After(rt.waitTime):
-// 		}
-// 	}
-// 	return resp, nil
-// }
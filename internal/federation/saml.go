@@ -0,0 +1,235 @@
+package federation
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+)
+
+// SAMLConfig describes one upstream SAML 2.0 identity provider. The IdP's
+// metadata is read from IDPMetadataFile, or fetched from IDPMetadataURL.
+type SAMLConfig struct {
+	Name            string `json:"name"`
+	EntityID        string `json:"entity_id"`
+	MetadataURL     string `json:"metadata_url"`
+	ACSURL          string `json:"acs_url"`
+	IDPMetadataFile string `json:"idp_metadata_file"`
+	IDPMetadataURL  string `json:"idp_metadata_url"`
+
+	// Attribute names for the user's details; the NameID is used for the
+	// email address when EmailAttribute is not in the assertion
+	EmailAttribute     string `json:"email_attribute"`
+	FirstNameAttribute string `json:"first_name_attribute"`
+	LastNameAttribute  string `json:"last_name_attribute"`
+
+	// TrustEmail marks the IdP as authoritative for email addresses, so that
+	// an existing account with the same address may be linked to it
+	TrustEmail bool `json:"trust_email"`
+}
+
+// LoadSAMLConfigs reads a JSON array of SAML provider configurations from a file
+func LoadSAMLConfigs(path string) ([]SAMLConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []SAMLConfig
+	err = json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range configs {
+		if c.Name == "" || c.MetadataURL == "" || c.ACSURL == "" || (c.IDPMetadataFile == "" && c.IDPMetadataURL == "") {
+			return nil, fmt.Errorf("%s: name, metadata_url, acs_url and idp_metadata_file or idp_metadata_url are required for every provider", path)
+		}
+	}
+
+	return configs, nil
+}
+
+// LoadSAMLKeyPair reads our PEM encoded RSA key and certificate as a service
+// provider
+func LoadSAMLKeyPair(keyFile, certFile string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("SAML service provider key must be an RSA key")
+	}
+
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, certificate, nil
+}
+
+// SAMLProvider is an upstream SAML identity provider we are a service
+// provider for. Logins are SP-initiated only: every response must answer an
+// AuthnRequest we sent.
+type SAMLProvider struct {
+	SAMLConfig
+	sp *saml.ServiceProvider
+}
+
+// NewSAMLProvider sets up the service provider side of a SAML provider. key
+// and certificate are ours; they decrypt encrypted assertions and are
+// published in our metadata. A nil client means http.DefaultClient.
+func NewSAMLProvider(ctx context.Context, config SAMLConfig, key *rsa.PrivateKey, certificate *x509.Certificate, client *http.Client) (*SAMLProvider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if config.EmailAttribute == "" {
+		config.EmailAttribute = "email"
+	}
+	if config.FirstNameAttribute == "" {
+		config.FirstNameAttribute = "givenName"
+	}
+	if config.LastNameAttribute == "" {
+		config.LastNameAttribute = "sn"
+	}
+
+	metadataURL, err := url.Parse(config.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(config.ACSURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var idpMetadata *saml.EntityDescriptor
+	if config.IDPMetadataFile != "" {
+		data, err := os.ReadFile(config.IDPMetadataFile)
+		if err != nil {
+			return nil, err
+		}
+		idpMetadata, err = samlsp.ParseMetadata(data)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		idpURL, err := url.Parse(config.IDPMetadataURL)
+		if err != nil {
+			return nil, err
+		}
+		idpMetadata, err = samlsp.FetchMetadata(ctx, client, *idpURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &SAMLProvider{
+		SAMLConfig: config,
+		sp: &saml.ServiceProvider{
+			EntityID:          config.EntityID,
+			Key:               key,
+			Certificate:       certificate,
+			HTTPClient:        client,
+			MetadataURL:       *metadataURL,
+			AcsURL:            *acsURL,
+			IDPMetadata:       idpMetadata,
+			AuthnNameIDFormat: saml.PersistentNameIDFormat,
+		},
+	}, nil
+}
+
+// Metadata returns our service provider metadata, for registering with the IdP
+func (p *SAMLProvider) Metadata() ([]byte, error) {
+	data, err := xml.MarshalIndent(p.sp.Metadata(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), data...), nil
+}
+
+// RequestID turns a random value into an AuthnRequest ID. IDs are XML names,
+// so they must not start with a digit or a dash.
+func RequestID(random string) string {
+	return "id-" + random
+}
+
+// AuthnRequestURL returns the URL that sends the user to the IdP with an
+// AuthnRequest carrying the given ID, over the HTTP-Redirect binding
+func (p *SAMLProvider) AuthnRequestURL(requestID, relayState string) (string, error) {
+	req, err := p.sp.MakeAuthenticationRequest(p.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", err
+	}
+	req.ID = requestID
+
+	redirectTo, err := req.Redirect(url.QueryEscape(relayState), p.sp)
+	if err != nil {
+		return "", err
+	}
+
+	return redirectTo.String(), nil
+}
+
+// ParseResponse validates the SAMLResponse posted to the assertion consumer
+// service: the signature, issuer, audience, validity window and that it
+// answers requestID. It returns the NameID and attributes as claims.
+func (p *SAMLProvider) ParseResponse(r *http.Request, requestID string) (*Claims, error) {
+	assertion, err := p.sp.ParseResponse(r, []string{requestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			return nil, fmt.Errorf("invalid SAML response: %w", invalid.PrivateErr)
+		}
+		return nil, err
+	}
+
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, errors.New("SAML assertion has no NameID")
+	}
+
+	claims := &Claims{
+		Issuer:        assertion.Issuer.Value,
+		Subject:       assertion.Subject.NameID.Value,
+		Email:         p.attribute(assertion, p.EmailAttribute),
+		EmailVerified: p.TrustEmail,
+		GivenName:     p.attribute(assertion, p.FirstNameAttribute),
+		FamilyName:    p.attribute(assertion, p.LastNameAttribute),
+	}
+	if claims.Email == "" && strings.Contains(claims.Subject, "@") {
+		claims.Email = claims.Subject
+	}
+
+	return claims, nil
+}
+
+// attribute returns the first value of the attribute with the given name or
+// friendly name
+func (p *SAMLProvider) attribute(assertion *saml.Assertion, name string) string {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != name && attribute.FriendlyName != name {
+				continue
+			}
+			if len(attribute.Values) > 0 {
+				return attribute.Values[0].Value
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,310 @@
+// Package logging writes structured logs: a message and key value pairs, as
+// one JSON object per line in production and as key=value text in
+// development. Its API follows log/slog, which needs a newer Go than ours.
+//
+//	logger := logging.New(os.Stdout, logging.FormatJSON, logging.LevelInfo)
+//	logger.With("user_id", id).Info("password changed", "method", "reset")
+//
+// Values of keys that look like they hold a secret, such as "password" or
+// "token", are never written.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Level is how important a log entry is. Entries below a logger's level are
+// dropped.
+type Level int
+
+// Levels, spaced like slog's so levels in between can be added later
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// ParseLevel reads a level name, in any case
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+
+	return 0, fmt.Errorf("unknown log level %q, use debug, info, warn or error", s)
+}
+
+// Output formats
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Redacted replaces the values of sensitive keys
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are keys whose values are never written. Keys containing
+// one of sensitiveParts are not written either.
+var (
+	sensitiveKeys  = []string{"token", "access_token", "refresh_token", "id_token", "code", "api_key", "client_secret"}
+	sensitiveParts = []string{"password", "passwd", "secret", "authorization", "cookie"}
+)
+
+// sensitive tells whether the value of key must not be logged
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, k := range sensitiveKeys {
+		if key == k {
+			return true
+		}
+	}
+	for _, part := range sensitiveParts {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// output is where a logger and every logger derived from it write
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  Level
+}
+
+// attr is one key value pair
+type attr struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes log entries. Its methods take a message followed by
+// alternating keys and values. It is safe for concurrent use.
+type Logger struct {
+	out   *output
+	attrs []attr
+}
+
+// New returns a logger writing entries of level and above to w in format,
+// FormatJSON or FormatText
+func New(w io.Writer, format string, level Level) *Logger {
+	return &Logger{out: &output{w: w, format: format, level: level}}
+}
+
+// Discard returns a logger that writes nothing
+func Discard() *Logger {
+	return New(io.Discard, FormatText, LevelError+1)
+}
+
+// With returns a logger that adds the given key value pairs to every entry
+func (l *Logger) With(args ...interface{}) *Logger {
+	attrs := make([]attr, 0, len(l.attrs)+len(args)/2)
+	attrs = append(attrs, l.attrs...)
+
+	return &Logger{out: l.out, attrs: appendArgs(attrs, args)}
+}
+
+// Enabled tells whether entries of level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+// Debug logs at LevelDebug
+func (l *Logger) Debug(msg string, args ...interface{}) {
+	l.Log(LevelDebug, msg, args...)
+}
+
+// Info logs at LevelInfo
+func (l *Logger) Info(msg string, args ...interface{}) {
+	l.Log(LevelInfo, msg, args...)
+}
+
+// Warn logs at LevelWarn
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.Log(LevelWarn, msg, args...)
+}
+
+// Error logs at LevelError
+func (l *Logger) Error(msg string, args ...interface{}) {
+	l.Log(LevelError, msg, args...)
+}
+
+// Log writes an entry at level
+func (l *Logger) Log(level Level, msg string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	attrs := make([]attr, 0, 3+len(l.attrs)+len(args)/2)
+	attrs = append(attrs,
+		attr{"time", time.Now()},
+		attr{"level", level.String()},
+		attr{"msg", msg},
+	)
+	attrs = append(attrs, l.attrs...)
+	attrs = appendArgs(attrs, args)
+
+	var line []byte
+	if l.out.format == FormatJSON {
+		line = formatJSON(attrs)
+	} else {
+		line = formatText(attrs)
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	_, _ = l.out.w.Write(line)
+}
+
+// StdLogger returns a standard library logger that writes each line it is
+// given as an entry at level, for packages that only take a *log.Logger
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(&lineWriter{logger: l, level: level}, "", 0)
+}
+
+// lineWriter turns the lines written by a standard library logger into
+// entries
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.logger.Log(w.level, strings.TrimRightFunc(string(p), unicode.IsSpace))
+	return len(p), nil
+}
+
+// appendArgs adds alternating keys and values to attrs. A value without a
+// key is kept under !BADKEY, like slog does.
+func appendArgs(attrs []attr, args []interface{}) []attr {
+	for len(args) > 0 {
+		key, ok := args[0].(string)
+		if !ok || len(args) == 1 {
+			attrs = append(attrs, attr{"!BADKEY", args[0]})
+			args = args[1:]
+			continue
+		}
+
+		value := args[1]
+		if sensitive(key) {
+			value = Redacted
+		}
+		attrs = append(attrs, attr{key, value})
+		args = args[2:]
+	}
+
+	return attrs
+}
+
+// plain turns a value into something that formats well
+func plain(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return value
+}
+
+func formatJSON(attrs []attr) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, a := range attrs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(a.key)
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(plain(a.value))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprintf("%+v", a.value))
+		}
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+
+	return buf.Bytes()
+}
+
+func formatText(attrs []attr) []byte {
+	var buf bytes.Buffer
+	for i, a := range attrs {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(a.key)
+		buf.WriteByte('=')
+
+		value := fmt.Sprintf("%+v", plain(a.value))
+		if value == "" || strings.IndexFunc(value, needsQuote) >= 0 {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+func needsQuote(r rune) bool {
+	return unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying logger
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or fallback if there is none
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return logger
+	}
+
+	return fallback
+}
@@ -0,0 +1,104 @@
+package loginrisk
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ipRange is one network with the location it is assigned to
+type ipRange struct {
+	network  *net.IPNet
+	location Location
+}
+
+// RangeLocator locates addresses from a list of networks, picking the most
+// specific network an address is in
+type RangeLocator struct {
+	ranges []ipRange
+}
+
+// LoadRangeLocator reads networks and their locations from a CSV file, one
+// "cidr,latitude,longitude" per line. Blank lines and lines starting with #
+// are skipped.
+func LoadRangeLocator(path string) (*RangeLocator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	locator := &RangeLocator{}
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		r, err := parseRange(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		locator.ranges = append(locator.ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// most specific first, so the first match is the best one
+	sort.SliceStable(locator.ranges, func(i, j int) bool {
+		a, _ := locator.ranges[i].network.Mask.Size()
+		b, _ := locator.ranges[j].network.Mask.Size()
+		return a > b
+	})
+
+	return locator, nil
+}
+
+func parseRange(text string) (ipRange, error) {
+	fields := strings.Split(text, ",")
+	if len(fields) != 3 {
+		return ipRange{}, fmt.Errorf("expected cidr,latitude,longitude")
+	}
+
+	_, network, err := net.ParseCIDR(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return ipRange{}, err
+	}
+
+	latitude, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		return ipRange{}, fmt.Errorf("invalid latitude %q", fields[1])
+	}
+
+	longitude, err := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		return ipRange{}, fmt.Errorf("invalid longitude %q", fields[2])
+	}
+
+	return ipRange{network: network, location: Location{Latitude: latitude, Longitude: longitude}}, nil
+}
+
+// Len returns how many networks the locator knows
+func (l *RangeLocator) Len() int {
+	return len(l.ranges)
+}
+
+// Locate implements Locator
+func (l *RangeLocator) Locate(ip net.IP) (Location, bool) {
+	for _, r := range l.ranges {
+		if r.network.Contains(ip) {
+			return r.location, true
+		}
+	}
+
+	return Location{}, false
+}
@@ -0,0 +1,163 @@
+// Package loginrisk decides whether a login looks suspicious compared to the
+// user's earlier logins, and tells the user about it.
+package loginrisk
+
+import (
+	"math"
+	"net"
+	"time"
+)
+
+// Flags a login can be given
+const (
+	FlagNewDevice        = "new_device"
+	FlagNewNetwork       = "new_network"
+	FlagImpossibleTravel = "impossible_travel"
+)
+
+// Defaults for an Assessor
+const (
+	DefaultMaxSpeed    = 1000 // km/h, a little faster than an airliner
+	DefaultMinDistance = 300  // km, within which IP locations are too coarse to tell
+)
+
+// earthRadius is the mean radius of the earth in km
+const earthRadius = 6371
+
+// Location is where an IP address is
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Locator finds where an IP address is
+type Locator interface {
+	Locate(ip net.IP) (Location, bool)
+}
+
+// Login is what an Assessor knows about one login
+type Login struct {
+	IP        string
+	UserAgent string
+	Time      time.Time
+	Location  *Location
+}
+
+// Assessor flags logins from a device or network the user has never logged
+// in from, and logins too far away from the previous one to have travelled
+// in between
+type Assessor struct {
+	// Locator finds IP locations. Without one, travel is not checked.
+	Locator Locator
+	// MaxSpeed is the fastest a user is believed to travel, in km/h
+	MaxSpeed float64
+	// MinDistance is how far apart two logins must be, in km, before
+	// their speed is checked at all
+	MinDistance float64
+}
+
+// NewAssessor returns an Assessor with the default limits
+func NewAssessor(locator Locator) *Assessor {
+	return &Assessor{
+		Locator:     locator,
+		MaxSpeed:    DefaultMaxSpeed,
+		MinDistance: DefaultMinDistance,
+	}
+}
+
+// Locate returns where ip is, or nil when that is not known
+func (a *Assessor) Locate(ip string) *Location {
+	parsed := net.ParseIP(ip)
+	if a.Locator == nil || parsed == nil {
+		return nil
+	}
+
+	location, ok := a.Locator.Locate(parsed)
+	if !ok {
+		return nil
+	}
+
+	return &location
+}
+
+// Assess returns the flags for login, given the user's earlier successful
+// logins, newest first. A user's first login is never flagged, since there
+// is nothing to compare it with.
+func (a *Assessor) Assess(login Login, history []Login) []string {
+	if len(history) == 0 {
+		return nil
+	}
+
+	var flags []string
+
+	knownDevice, knownNetwork := false, false
+	network := Network(login.IP)
+	for _, previous := range history {
+		knownDevice = knownDevice || previous.UserAgent == login.UserAgent
+		knownNetwork = knownNetwork || Network(previous.IP) == network
+	}
+	if !knownDevice {
+		flags = append(flags, FlagNewDevice)
+	}
+	if !knownNetwork {
+		flags = append(flags, FlagNewNetwork)
+	}
+
+	if login.Location != nil {
+		for _, previous := range history {
+			if previous.Location == nil {
+				continue
+			}
+			if a.impossibleTravel(previous, login) {
+				flags = append(flags, FlagImpossibleTravel)
+			}
+			break
+		}
+	}
+
+	return flags
+}
+
+// impossibleTravel tells whether getting from one login to the next would
+// have meant travelling faster than MaxSpeed
+func (a *Assessor) impossibleTravel(from, to Login) bool {
+	distance := Distance(*from.Location, *to.Location)
+	if distance < a.MinDistance {
+		return false
+	}
+
+	hours := to.Time.Sub(from.Time).Hours()
+	if hours <= 0 {
+		return true
+	}
+
+	return distance/hours > a.MaxSpeed
+}
+
+// Network returns the network an address belongs to, as far as telling
+// networks apart goes: its /24 for IPv4 and its /48 for IPv6. Anything that
+// is not an IP address is returned as is.
+func Network(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// Distance returns the great circle distance between two locations, in km
+func Distance(a, b Location) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,119 @@
+package loginrisk
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
+)
+
+// Kinds of notice
+const (
+	NoticeSuspiciousLogin = "login.suspicious"
+	NoticeStepUpCode      = "login.step_up_code"
+)
+
+// ErrCannotDeliverCodes is returned by notifiers that have no way of getting
+// a step-up code to the user
+var ErrCannotDeliverCodes = errors.New("notifier cannot deliver step-up codes")
+
+// Notice tells a user about a login to their account
+type Notice struct {
+	Kind      string    `json:"event"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Flags     []string  `json:"flags"`
+	Time      time.Time `json:"time"`
+	// Code is the one-time code a step-up notice carries
+	Code string `json:"code,omitempty"`
+}
+
+// Notifier gets notices to users. How they are delivered (email, SMS, a
+// push message) is up to the implementation.
+type Notifier interface {
+	// Notify delivers a notice. Step-up notices carry a code the user
+	// needs to finish logging in; notifiers that cannot deliver those
+	// securely return ErrCannotDeliverCodes.
+	Notify(ctx context.Context, notice Notice) error
+	// DeliversCodes tells whether the notifier can deliver step-up codes
+	DeliversCodes() bool
+}
+
+// LogNotifier only writes notices to a log. It is the default, and cannot
+// deliver step-up codes, since they must not be written to logs.
+type LogNotifier struct {
+	Log *logging.Logger
+}
+
+// Notify implements Notifier
+func (n *LogNotifier) Notify(_ context.Context, notice Notice) error {
+	if notice.Kind == NoticeStepUpCode {
+		return ErrCannotDeliverCodes
+	}
+
+	n.Log.Info("login notice", "event", notice.Kind, "user_id", notice.UserID, "ip", notice.IP, "flags", strings.Join(notice.Flags, ","))
+
+	return nil
+}
+
+// DeliversCodes implements Notifier
+func (n *LogNotifier) DeliversCodes() bool {
+	return false
+}
+
+// WebhookNotifier posts notices as JSON to a URL, for a service that turns
+// them into emails or text messages. With a secret, every request carries an
+// X-Signature header: "sha256=" and the hex HMAC-SHA256 of the body.
+type WebhookNotifier struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+// Notify implements Notifier
+func (n *WebhookNotifier) Notify(ctx context.Context, notice Notice) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if n.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notification webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// DeliversCodes implements Notifier
+func (n *WebhookNotifier) DeliversCodes() bool {
+	return true
+}
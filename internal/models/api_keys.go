@@ -0,0 +1,291 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix marks a string as one of our API keys
+const apiKeyPrefix = "ak_"
+
+// APIKey is a long lived credential for machine to machine clients. The full
+// key is "<prefix>.<secret>"; the prefix is stored in clear so the key can be
+// found and shown in listings, while only a SHA-256 hash of the secret is
+// kept. The plain text Key is only set right after the key was generated.
+type APIKey struct {
+	ID         int       `db:"id" json:"id"`
+	UserID     string    `db:"user_id" json:"user_id"`
+	Name       string    `db:"name" json:"name"`
+	Prefix     string    `db:"prefix" json:"prefix"`
+	SecretHash []byte    `db:"secret_hash" json:"-"`
+	Scopes     Scopes    `db:"scopes" json:"scopes"`
+	LastUsedAt NullTime  `db:"last_used_at" json:"last_used_at"`
+	ExpireAt   NullTime  `db:"expire_at" json:"expire_at"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt  time.Time `db:"updated_at" json:"updated_at"`
+	Key        string    `db:"-" json:"-"`
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateAPIKey creates a new key for a user. It is not saved until Insert
+// is called. A zero expireAt means the key does not expire.
+func (k *APIKey) GenerateAPIKey(userID, name string, scopes Scopes, expireAt time.Time) (*APIKey, error) {
+	prefixBytes := make([]byte, 5)
+	_, err := rand.Read(prefixBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	secretBytes := make([]byte, 20)
+	_, err = rand.Read(secretBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := apiKeyPrefix + strings.ToLower(base32NoPadding.EncodeToString(prefixBytes))
+	secret := base32NoPadding.EncodeToString(secretBytes)
+	hash := sha256.Sum256([]byte(secret))
+
+	key := &APIKey{
+		UserID:     userID,
+		Name:       name,
+		Prefix:     prefix,
+		SecretHash: hash[:],
+		Scopes:     scopes,
+		Key:        prefix + "." + secret,
+	}
+	if !expireAt.IsZero() {
+		key.ExpireAt.Time = expireAt
+		key.ExpireAt.Valid = true
+	}
+
+	return key, nil
+}
+
+// Insert saves a newly generated key
+func (k *APIKey) Insert(key *APIKey) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		INSERT INTO
+			api_keys (
+				user_id,
+				name,
+				prefix,
+				secret_hash,
+				scopes,
+				expire_at,
+				created_at,
+				updated_at
+			)
+			VALUES (
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?
+			)
+	`
+
+	key.CreatedAt = time.Now()
+	key.UpdatedAt = key.CreatedAt
+
+	result, err := db.ExecContext(ctx, stmt,
+		key.UserID,
+		key.Name,
+		key.Prefix,
+		key.SecretHash,
+		key.Scopes,
+		key.ExpireAt,
+		key.CreatedAt,
+		key.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	key.ID = int(id)
+
+	return nil
+}
+
+// IndexForUser returns every key owned by a user
+func (k *APIKey) IndexForUser(userID string) ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT
+			*
+		FROM
+			api_keys
+		WHERE
+			user_id = ?
+		ORDER BY
+			created_at
+	`
+
+	var keys []*APIKey
+	err := db.SelectContext(ctx, &keys, query, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// ShowByPrefix returns one key by its prefix
+func (k *APIKey) ShowByPrefix(prefix string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT
+			*
+		FROM
+			api_keys
+		WHERE
+			prefix = ?
+	`
+
+	var key APIKey
+	row := db.QueryRowxContext(ctx, query, prefix)
+
+	err := row.StructScan(&key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// DeleteForUser revokes one of a user's keys, by prefix
+func (k *APIKey) DeleteForUser(userID, prefix string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		DELETE FROM
+			api_keys
+		WHERE
+			user_id = ?
+			AND prefix = ?
+	`
+
+	result, err := db.ExecContext(ctx, stmt, userID, prefix)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("no matching api key found")
+	}
+
+	return nil
+}
+
+// touch records that the key has just been used
+func (k *APIKey) touch() error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		UPDATE
+			api_keys
+		SET
+			last_used_at = ?
+		WHERE
+			id = ?
+	`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), k.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// APIKeyFromRequest returns the API key sent with the request, either in the
+// X-API-Key header or as "Authorization: ApiKey <key>". A bearer credential
+// that looks like one of our keys counts too, for clients such as SCIM
+// provisioning that can only send bearer tokens. The second value is false
+// when the request does not carry an API key at all.
+func APIKeyFromRequest(r *http.Request) (string, bool) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, true
+	}
+
+	headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerParts) == 2 && headerParts[0] == "ApiKey" {
+		return headerParts[1], true
+	}
+	if len(headerParts) == 2 && headerParts[0] == "Bearer" && strings.HasPrefix(headerParts[1], apiKeyPrefix) {
+		return headerParts[1], true
+	}
+
+	return "", false
+}
+
+// AuthenticateAPIKey takes a plain text API key, checks it against the stored
+// hash and expiry, records that it was used, and returns the user owning it.
+// The key is kept on the returned user.
+func (k *APIKey) AuthenticateAPIKey(plainText string) (*User, error) {
+	prefix, secret, ok := strings.Cut(plainText, ".")
+	if !ok || !strings.HasPrefix(prefix, apiKeyPrefix) || secret == "" {
+		return nil, errors.New("malformed api key")
+	}
+
+	key, err := k.ShowByPrefix(prefix)
+	if err != nil {
+		return nil, errors.New("no matching api key found")
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], key.SecretHash) != 1 {
+		return nil, errors.New("no matching api key found")
+	}
+
+	if key.ExpireAt.Valid && key.ExpireAt.Time.Before(time.Now()) {
+		return nil, errors.New("expired api key")
+	}
+
+	var u User
+	user, err := u.ShowByID(key.UserID)
+	if err != nil {
+		return nil, errors.New("no matching user found")
+	}
+
+	if user.DeletedAt.Valid {
+		return nil, errors.New("user account is closed")
+	}
+
+	err = key.touch()
+	if err != nil {
+		return nil, err
+	}
+
+	user.APIKey = key
+
+	return user, nil
+}
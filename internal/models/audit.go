@@ -0,0 +1,475 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Types of audit events
+const (
+	AuditLoginSucceeded       = "login.succeeded"
+	AuditLoginFailed          = "login.failed"
+	AuditTokenIssued          = "token.issued"
+	AuditTokenRevoked         = "token.revoked"
+	AuditUserCreated          = "user.created"
+	AuditUserUpdated          = "user.updated"
+	AuditUserDeleted          = "user.deleted"
+	AuditRoleChanged          = "user.role_changed"
+	AuditImpersonationStarted = "impersonation.started"
+	AuditImpersonatedRequest  = "impersonation.request"
+)
+
+// auditTimeFormat is how created_at is written into an event's hash. The
+// column keeps milliseconds, so that is all the hash may depend on.
+const auditTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// auditChainBatch is how many events are read at a time when walking the chain
+const auditChainBatch = 500
+
+// AuditEvent records a security relevant event: who did it (the actor, and
+// the admin behind them when impersonating), to whom (the target), from
+// where, and what changed. Events are only ever inserted, and each one
+// carries a hash over its contents and the hash of the event before it, so
+// editing or removing an event breaks the chain from there on.
+type AuditEvent struct {
+	ID             int64     `db:"id" json:"id"`
+	Type           string    `db:"event_type" json:"type"`
+	ActorID        string    `db:"actor_id" json:"actor_id,omitempty"`
+	ImpersonatorID string    `db:"impersonator_id" json:"impersonator_id,omitempty"`
+	TargetID       string    `db:"target_id" json:"target_id,omitempty"`
+	IP             string    `db:"ip" json:"ip"`
+	UserAgent      string    `db:"user_agent" json:"user_agent"`
+	RequestID      string    `db:"request_id" json:"request_id,omitempty"`
+	Diff           AuditDiff `db:"diff" json:"diff"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at"`
+	PrevHash       string    `db:"prev_hash" json:"prev_hash"`
+	Hash           string    `db:"hash" json:"hash"`
+}
+
+// ComputeHash returns the hash the event should carry, given its diff
+// exactly as stored. It covers every column but the ID, which only the
+// database knows, and links the event to the one before it through PrevHash.
+func (a *AuditEvent) ComputeHash(rawDiff []byte) (string, error) {
+	fields, err := json.Marshal([]interface{}{
+		a.PrevHash,
+		a.Type,
+		a.ActorID,
+		a.ImpersonatorID,
+		a.TargetID,
+		a.IP,
+		a.UserAgent,
+		a.RequestID,
+		json.RawMessage(rawDiff),
+		a.CreatedAt.UTC().Format(auditTimeFormat),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(fields)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ChainedAuditEvent is an event read back to check or export the chain,
+// with its diff exactly as stored
+type ChainedAuditEvent struct {
+	AuditEvent
+	RawDiff []byte `db:"raw_diff" json:"-"`
+}
+
+// AuditChainHead is the last event appended to the chain. It lets a check
+// notice events removed from the end, which leave no break behind.
+type AuditChainHead struct {
+	EventID int64  `db:"event_id"`
+	Hash    string `db:"hash"`
+}
+
+// AuditProblem is something wrong VerifyChain found with an event
+type AuditProblem struct {
+	EventID int64
+	Reason  string
+}
+
+// AuditVerification is the outcome of VerifyChain
+type AuditVerification struct {
+	// Checked is how many events were checked against the chain
+	Checked int64
+	// Unchained is how many events were written before events were chained,
+	// which carry no hash to check, and LastUnchainedID the last of them
+	Unchained       int64
+	LastUnchainedID int64
+	Problems        []AuditProblem
+}
+
+// AuditChange is the old and new value of one field
+type AuditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// AuditDiff holds what an event changed, by field. Events that change
+// nothing, like a failed login, use it for their details instead, with only
+// To set.
+type AuditDiff map[string]AuditChange
+
+// Value implements driver.Valuer
+func (d AuditDiff) Value() (driver.Value, error) {
+	b, err := d.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// encode returns the diff as it is stored
+func (d AuditDiff) encode() ([]byte, error) {
+	if d == nil {
+		return []byte("{}"), nil
+	}
+
+	return json.Marshal(d)
+}
+
+// Scan implements sql.Scanner
+func (d *AuditDiff) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, d)
+	case string:
+		return json.Unmarshal([]byte(v), d)
+	default:
+		return fmt.Errorf("cannot scan %T into AuditDiff", src)
+	}
+}
+
+// AuditFilter narrows down a listing of audit events. Empty fields match
+// everything.
+type AuditFilter struct {
+	Type     string
+	ActorID  string
+	TargetID string
+	Since    time.Time
+	Until    time.Time
+}
+
+// Insert appends an event to the chain. The chain head stays locked until
+// the transaction ends, so concurrent inserts are chained one after another.
+func (a *AuditEvent) Insert(event AuditEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	rawDiff, err := event.Diff.encode()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT
+			event_id,
+			hash
+		FROM
+			audit_chain_head
+		WHERE
+			id = 1
+		FOR UPDATE
+	`
+
+	var head AuditChainHead
+	err = tx.GetContext(ctx, &head, query)
+	if err != nil {
+		return fmt.Errorf("cannot read audit chain head: %w", err)
+	}
+
+	event.CreatedAt = time.Now().Truncate(time.Millisecond)
+	event.PrevHash = head.Hash
+	event.Hash, err = event.ComputeHash(rawDiff)
+	if err != nil {
+		return err
+	}
+
+	stmt := `
+		INSERT INTO
+			audit_events (
+				event_type,
+				actor_id,
+				impersonator_id,
+				target_id,
+				ip,
+				user_agent,
+				request_id,
+				diff,
+				created_at,
+				prev_hash,
+				hash
+			)
+			VALUES (
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?
+			)
+	`
+
+	result, err := tx.ExecContext(ctx, stmt,
+		event.Type,
+		event.ActorID,
+		event.ImpersonatorID,
+		event.TargetID,
+		event.IP,
+		event.UserAgent,
+		event.RequestID,
+		string(rawDiff),
+		event.CreatedAt,
+		event.PrevHash,
+		event.Hash,
+	)
+	if err != nil {
+		return err
+	}
+
+	eventID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	stmt = `
+		UPDATE
+			audit_chain_head
+		SET
+			event_id = ?,
+			hash = ?
+		WHERE
+			id = 1
+	`
+
+	_, err = tx.ExecContext(ctx, stmt, eventID, event.Hash)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ChainHead returns the last event appended to the chain
+func (a *AuditEvent) ChainHead() (*AuditChainHead, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT
+			event_id,
+			hash
+		FROM
+			audit_chain_head
+		WHERE
+			id = 1
+	`
+
+	var head AuditChainHead
+	err := db.GetContext(ctx, &head, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &head, nil
+}
+
+// WalkChain calls fn with every event created at or after since, oldest
+// first, stopping at the first error fn returns. A zero since walks the
+// whole chain.
+func (a *AuditEvent) WalkChain(since time.Time, fn func(event *ChainedAuditEvent) error) error {
+	var cursor int64
+
+	for {
+		events, err := chainBatch(since, cursor)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			err = fn(event)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(events) < auditChainBatch {
+			return nil
+		}
+		cursor = events[len(events)-1].ID
+	}
+}
+
+// chainBatch reads the batch of events that follows the one with ID cursor
+func chainBatch(since time.Time, cursor int64) ([]*ChainedAuditEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT
+			*,
+			diff AS raw_diff
+		FROM
+			audit_events
+		WHERE
+			id > ?
+			AND created_at >= ?
+		ORDER BY
+			id ASC
+		LIMIT ?
+	`
+
+	events := []*ChainedAuditEvent{}
+	err := db.SelectContext(ctx, &events, query, cursor, since, auditChainBatch)
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// VerifyChain walks the whole chain and reports every event that was
+// modified, every break where events were removed or reordered, and events
+// missing from the end. Events written before the chain was introduced carry
+// no hash; the run of them at the start of the log is counted as unchained
+// and the chain is checked from the first event after it. An event without a
+// hash anywhere else was modified.
+func (a *AuditEvent) VerifyChain() (*AuditVerification, error) {
+	check := &auditChainCheck{}
+
+	err := a.WalkChain(time.Time{}, check.event)
+	if err != nil {
+		return &check.verification, err
+	}
+
+	head, err := a.ChainHead()
+	if err != nil {
+		return &check.verification, err
+	}
+	check.end(*head)
+
+	return &check.verification, nil
+}
+
+// auditChainCheck checks the chain one event at a time, oldest first, for
+// VerifyChain
+type auditChainCheck struct {
+	verification AuditVerification
+	chained      bool
+	last         AuditChainHead
+}
+
+// event checks the next event of the chain
+func (c *auditChainCheck) event(event *ChainedAuditEvent) error {
+	if !c.chained && event.PrevHash == "" && event.Hash == "" {
+		c.verification.Unchained++
+		c.verification.LastUnchainedID = event.ID
+		return nil
+	}
+	c.chained = true
+	c.verification.Checked++
+
+	if event.PrevHash != c.last.Hash {
+		c.problem(event.ID, fmt.Sprintf("does not follow event %d: events were removed or reordered", c.last.EventID))
+	}
+
+	hash, err := event.ComputeHash(event.RawDiff)
+	if err != nil {
+		return err
+	}
+	if event.Hash == "" || hash != event.Hash {
+		c.problem(event.ID, "contents do not match the hash: the event was modified")
+	}
+
+	c.last = AuditChainHead{EventID: event.ID, Hash: event.Hash}
+
+	return nil
+}
+
+// end checks that the last event checked is the head of the chain
+func (c *auditChainCheck) end(head AuditChainHead) {
+	if head != c.last {
+		c.problem(head.EventID, fmt.Sprintf("the chain ends at event %d: later events were removed", c.last.EventID))
+	}
+}
+
+func (c *auditChainCheck) problem(eventID int64, reason string) {
+	c.verification.Problems = append(c.verification.Problems, AuditProblem{EventID: eventID, Reason: reason})
+}
+
+// Index returns up to limit events matching filter, newest first. A cursor
+// greater than zero continues a listing after the event with that ID.
+func (a *AuditEvent) Index(filter AuditFilter, cursor int64, limit int) ([]*AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	where := "1 = 1"
+	var args []interface{}
+	if filter.Type != "" {
+		where += " AND event_type = ?"
+		args = append(args, filter.Type)
+	}
+	if filter.ActorID != "" {
+		where += " AND (actor_id = ? OR impersonator_id = ?)"
+		args = append(args, filter.ActorID, filter.ActorID)
+	}
+	if filter.TargetID != "" {
+		where += " AND target_id = ?"
+		args = append(args, filter.TargetID)
+	}
+	if !filter.Since.IsZero() {
+		where += " AND created_at >= ?"
+		args = append(args, filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where += " AND created_at < ?"
+		args = append(args, filter.Until)
+	}
+	if cursor > 0 {
+		where += " AND id < ?"
+		args = append(args, cursor)
+	}
+
+	query := `
+		SELECT
+			*
+		FROM
+			audit_events
+		WHERE
+			` + where + `
+		ORDER BY
+			id DESC
+		LIMIT ?
+	`
+
+	events := []*AuditEvent{}
+	err := db.SelectContext(ctx, &events, query, append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
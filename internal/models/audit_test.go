@@ -0,0 +1,243 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// buildChain returns n events chained the way Insert chains them, after
+// unchained events written before the chain, and the head of the chain
+func buildChain(t *testing.T, unchained, n int) ([]*ChainedAuditEvent, AuditChainHead) {
+	t.Helper()
+
+	var events []*ChainedAuditEvent
+	var head AuditChainHead
+	created := time.Date(2023, 1, 2, 3, 4, 5, 6e6, time.UTC)
+
+	for i := 1; i <= unchained+n; i++ {
+		event := &ChainedAuditEvent{AuditEvent: AuditEvent{
+			ID:        int64(i),
+			Type:      AuditLoginSucceeded,
+			ActorID:   "user-1",
+			IP:        "192.0.2.1",
+			UserAgent: "test",
+			Diff:      AuditDiff{"attempt": {To: i}},
+			CreatedAt: created.Add(time.Duration(i) * time.Minute),
+		}}
+
+		var err error
+		event.RawDiff, err = event.Diff.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if i > unchained {
+			event.PrevHash = head.Hash
+			event.Hash, err = event.ComputeHash(event.RawDiff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			head = AuditChainHead{EventID: event.ID, Hash: event.Hash}
+		}
+
+		events = append(events, event)
+	}
+
+	return events, head
+}
+
+// checkChain runs the checks VerifyChain runs over events and head
+func checkChain(t *testing.T, events []*ChainedAuditEvent, head AuditChainHead) AuditVerification {
+	t.Helper()
+
+	check := &auditChainCheck{}
+	for _, event := range events {
+		err := check.event(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check.end(head)
+
+	return check.verification
+}
+
+func TestVerifyChain(t *testing.T) {
+	type problem struct {
+		eventID int64
+		reason  string
+	}
+
+	tests := []struct {
+		name      string
+		unchained int
+		tamper    func(events []*ChainedAuditEvent, head *AuditChainHead) []*ChainedAuditEvent
+		checked   int64
+		problems  []problem
+	}{
+		{name: "intact", checked: 5},
+		{
+			name: "modified",
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				events[2].ActorID = "user-2"
+				return events
+			},
+			checked:  5,
+			problems: []problem{{3, "modified"}},
+		},
+		{
+			name: "modified diff",
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				events[1].RawDiff = []byte(`{"attempt":{"from":null,"to":20}}`)
+				return events
+			},
+			checked:  5,
+			problems: []problem{{2, "modified"}},
+		},
+		{
+			name: "rehashed after modifying",
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				events[2].IP = "198.51.100.1"
+				events[2].Hash, _ = events[2].ComputeHash(events[2].RawDiff)
+				return events
+			},
+			checked:  5,
+			problems: []problem{{4, "removed or reordered"}},
+		},
+		{
+			name: "hash removed",
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				events[2].PrevHash, events[2].Hash = "", ""
+				return events
+			},
+			checked:  5,
+			problems: []problem{{3, "removed or reordered"}, {3, "modified"}, {4, "removed or reordered"}},
+		},
+		{
+			name: "deleted",
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				return append(events[:2], events[3:]...)
+			},
+			checked:  4,
+			problems: []problem{{4, "removed or reordered"}},
+		},
+		{
+			name: "deleted from the end",
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				return events[:3]
+			},
+			checked:  3,
+			problems: []problem{{5, "chain ends at event 3"}},
+		},
+		{
+			name: "deleted with the head moved back",
+			tamper: func(events []*ChainedAuditEvent, head *AuditChainHead) []*ChainedAuditEvent {
+				*head = AuditChainHead{EventID: events[3].ID, Hash: events[3].Hash}
+				return events[:4]
+			},
+			checked: 4,
+		},
+		{
+			name: "reordered",
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				events[1], events[2] = events[2], events[1]
+				return events
+			},
+			checked:  5,
+			problems: []problem{{3, "removed or reordered"}, {2, "removed or reordered"}, {4, "removed or reordered"}},
+		},
+		{name: "events from before the chain", unchained: 3, checked: 5},
+		{
+			name:      "modified before the chain",
+			unchained: 3,
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				events[1].ActorID = "user-2"
+				return events
+			},
+			checked: 5,
+		},
+		{
+			name:      "unchained event after the chain started",
+			unchained: 3,
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				events[5].PrevHash, events[5].Hash = "", ""
+				return events
+			},
+			checked:  5,
+			problems: []problem{{6, "removed or reordered"}, {6, "modified"}, {7, "removed or reordered"}},
+		},
+		{
+			name:      "deleted the first chained event",
+			unchained: 3,
+			tamper: func(events []*ChainedAuditEvent, _ *AuditChainHead) []*ChainedAuditEvent {
+				return append(events[:3], events[4:]...)
+			},
+			checked:  4,
+			problems: []problem{{5, "removed or reordered"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, head := buildChain(t, tt.unchained, 5)
+			if tt.tamper != nil {
+				events = tt.tamper(events, &head)
+			}
+
+			verification := checkChain(t, events, head)
+
+			if verification.Checked != tt.checked {
+				t.Errorf("Checked = %d, want %d", verification.Checked, tt.checked)
+			}
+			if verification.Unchained != int64(tt.unchained) || verification.LastUnchainedID != int64(tt.unchained) {
+				t.Errorf("Unchained = %d up to %d, want %d", verification.Unchained, verification.LastUnchainedID, tt.unchained)
+			}
+
+			var got []problem
+			for _, p := range verification.Problems {
+				got = append(got, problem{p.EventID, p.Reason})
+			}
+			if len(got) != len(tt.problems) {
+				t.Fatalf("problems = %v, want %v", got, tt.problems)
+			}
+			for i, want := range tt.problems {
+				if got[i].eventID != want.eventID || !strings.Contains(got[i].reason, want.reason) {
+					t.Fatalf("problems = %v, want %v", got, tt.problems)
+				}
+			}
+		})
+	}
+}
+
+func TestComputeHash(t *testing.T) {
+	events, _ := buildChain(t, 0, 1)
+	event := events[0].AuditEvent
+
+	hash, err := event.ComputeHash(events[0].RawDiff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the database keeps milliseconds in UTC, and the hash only depends on those
+	event.CreatedAt = event.CreatedAt.Add(400 * time.Microsecond).In(time.FixedZone("JST", 9*60*60))
+	if rehashed, _ := event.ComputeHash(events[0].RawDiff); rehashed != hash {
+		t.Fatal("the hash depends on more than the stored time")
+	}
+
+	// every stored column but the ID is covered
+	for _, field := range []string{"PrevHash", "Type", "ActorID", "ImpersonatorID", "TargetID", "IP", "UserAgent", "RequestID"} {
+		changed := events[0].AuditEvent
+		reflect.ValueOf(&changed).Elem().FieldByName(field).SetString("changed")
+		if rehashed, _ := changed.ComputeHash(events[0].RawDiff); rehashed == hash {
+			t.Errorf("changing %s keeps the hash", field)
+		}
+	}
+
+	changed := events[0].AuditEvent
+	changed.ID = 99
+	if rehashed, _ := changed.ComputeHash(events[0].RawDiff); rehashed != hash {
+		t.Error("the hash depends on the ID")
+	}
+}
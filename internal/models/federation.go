@@ -0,0 +1,235 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// FederatedLoginTTL is how long a user has to sign in at an external
+// provider before the login state we stored for them expires
+const FederatedLoginTTL = 10 * time.Minute
+
+// ErrInvalidLoginState is returned when a federated login callback carries a
+// state we did not issue, issued for another provider, or that has expired
+var ErrInvalidLoginState = errors.New("invalid or expired login state")
+
+// FederatedIdentity links an account at an external OpenID Connect provider,
+// identified by the provider's issuer-unique subject, to one of our users
+type FederatedIdentity struct {
+	ID        int       `db:"id" json:"id"`
+	Provider  string    `db:"provider" json:"provider"`
+	Subject   string    `db:"subject" json:"subject"`
+	UserID    string    `db:"user_id" json:"user_id"`
+	Email     string    `db:"email" json:"email"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// ShowBySubject returns the identity for a subject at a provider
+func (f *FederatedIdentity) ShowBySubject(provider, subject string) (*FederatedIdentity, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT
+			*
+		FROM
+			federated_identities
+		WHERE
+			provider = ?
+			AND subject = ?
+	`
+
+	var identity FederatedIdentity
+	err := db.GetContext(ctx, &identity, query, provider, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+// Insert links a subject at a provider to a user
+func (f *FederatedIdentity) Insert(identity FederatedIdentity) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		INSERT INTO
+			federated_identities (
+				provider,
+				subject,
+				user_id,
+				email,
+				created_at,
+				updated_at
+			)
+			VALUES (
+				?,
+				?,
+				?,
+				?,
+				?,
+				?
+			)
+	`
+
+	_, err := db.ExecContext(ctx, stmt,
+		identity.Provider,
+		identity.Subject,
+		identity.UserID,
+		identity.Email,
+		time.Now(),
+		time.Now(),
+	)
+
+	return err
+}
+
+// FederatedLoginState is what we remember between sending a user to an
+// external provider and the provider sending them back: the nonce the ID
+// token must carry and the PKCE verifier for the code exchange. Only a
+// SHA-256 hash of the state parameter is stored.
+type FederatedLoginState struct {
+	ID           int       `db:"id"`
+	StateHash    []byte    `db:"state_hash"`
+	Provider     string    `db:"provider"`
+	Nonce        string    `db:"nonce"`
+	CodeVerifier string    `db:"code_verifier"`
+	CreatedAt    time.Time `db:"created_at"`
+	ExpireAt     time.Time `db:"expire_at"`
+	State        string    `db:"-"`
+}
+
+// CodeChallenge returns the S256 PKCE challenge for the state's verifier
+func (s *FederatedLoginState) CodeChallenge() string {
+	sum := sha256.Sum256([]byte(s.CodeVerifier))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// IssueLoginState stores a fresh state, nonce and code verifier for a login
+// at provider. The plain text state is only available on the returned value.
+func (s *FederatedLoginState) IssueLoginState(provider string) (*FederatedLoginState, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	state, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomString(48)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(state))
+
+	loginState := &FederatedLoginState{
+		StateHash:    hash[:],
+		Provider:     provider,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		CreatedAt:    time.Now(),
+		ExpireAt:     time.Now().Add(FederatedLoginTTL),
+		State:        state,
+	}
+
+	stmt := `
+		INSERT INTO
+			federated_login_states (
+				state_hash,
+				provider,
+				nonce,
+				code_verifier,
+				created_at,
+				expire_at
+			)
+			VALUES (
+				?,
+				?,
+				?,
+				?,
+				?,
+				?
+			)
+	`
+
+	_, err = db.ExecContext(ctx, stmt,
+		loginState.StateHash,
+		loginState.Provider,
+		loginState.Nonce,
+		loginState.CodeVerifier,
+		loginState.CreatedAt,
+		loginState.ExpireAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return loginState, nil
+}
+
+// ConsumeLoginState looks up a plain text state issued for provider and
+// deletes it, so that a callback can only ever be completed once
+func (s *FederatedLoginState) ConsumeLoginState(state, provider string) (*FederatedLoginState, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(state))
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT
+			*
+		FROM
+			federated_login_states
+		WHERE
+			state_hash = ?
+		FOR UPDATE
+	`
+
+	var loginState FederatedLoginState
+	err = tx.QueryRowxContext(ctx, query, hash[:]).StructScan(&loginState)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidLoginState
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `
+		DELETE FROM
+			federated_login_states
+		WHERE
+			id = ? OR expire_at < ?
+	`
+
+	_, err = tx.ExecContext(ctx, stmt, loginState.ID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	if loginState.Provider != provider || loginState.ExpireAt.Before(time.Now()) {
+		return nil, ErrInvalidLoginState
+	}
+
+	return &loginState, nil
+}
@@ -0,0 +1,362 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Outcomes of a login attempt
+const (
+	LoginSucceeded       = "succeeded"
+	LoginFailed          = "failed"
+	LoginPasswordExpired = "password_expired"
+	LoginStepUpRequired  = "step_up_required"
+	LoginStepUpPassed    = "step_up_passed"
+	LoginStepUpFailed    = "step_up_failed"
+)
+
+// LoginChallengeTTL is how long a user has to enter a step-up code
+const LoginChallengeTTL = 10 * time.Minute
+
+// maxStepUpAttempts is how many wrong codes a challenge survives
+const maxStepUpAttempts = 5
+
+// ErrInvalidLoginChallenge is returned for a step-up challenge we did not
+// issue, that has expired, or that has seen too many wrong codes
+var ErrInvalidLoginChallenge = errors.New("invalid or expired login challenge")
+
+// ErrWrongStepUpCode is returned when a step-up code does not match
+var ErrWrongStepUpCode = errors.New("wrong code")
+
+// LoginFlags are the reasons a login was found suspicious
+type LoginFlags []string
+
+// Value implements driver.Valuer
+func (f LoginFlags) Value() (driver.Value, error) {
+	return strings.Join(f, ","), nil
+}
+
+// Scan implements sql.Scanner
+func (f *LoginFlags) Scan(src interface{}) error {
+	var s string
+	switch v := src.(type) {
+	case nil:
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return fmt.Errorf("cannot scan %T into LoginFlags", src)
+	}
+
+	*f = nil
+	if s != "" {
+		*f = strings.Split(s, ",")
+	}
+
+	return nil
+}
+
+// LoginAttempt is one attempt to log in, successful or not. Attempts for an
+// email address we do not know have no user ID.
+type LoginAttempt struct {
+	ID        int64           `db:"id"`
+	UserID    string          `db:"user_id"`
+	Email     string          `db:"email"`
+	Method    string          `db:"method"`
+	Outcome   string          `db:"outcome"`
+	Flags     LoginFlags      `db:"flags"`
+	IP        string          `db:"ip"`
+	UserAgent string          `db:"user_agent"`
+	Latitude  sql.NullFloat64 `db:"latitude"`
+	Longitude sql.NullFloat64 `db:"longitude"`
+	CreatedAt time.Time       `db:"created_at"`
+}
+
+// Insert records an attempt
+func (l *LoginAttempt) Insert(attempt LoginAttempt) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		INSERT INTO
+			login_attempts (
+				user_id,
+				email,
+				method,
+				outcome,
+				flags,
+				ip,
+				user_agent,
+				latitude,
+				longitude,
+				created_at
+			)
+			VALUES (
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?
+			)
+	`
+
+	_, err := db.ExecContext(ctx, stmt,
+		attempt.UserID,
+		attempt.Email,
+		attempt.Method,
+		attempt.Outcome,
+		attempt.Flags,
+		attempt.IP,
+		attempt.UserAgent,
+		attempt.Latitude,
+		attempt.Longitude,
+		time.Now(),
+	)
+
+	return err
+}
+
+// IndexForUser returns a user's most recent attempts, newest first
+func (l *LoginAttempt) IndexForUser(userID string, limit int) ([]*LoginAttempt, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT
+			*
+		FROM
+			login_attempts
+		WHERE
+			user_id = ?
+		ORDER BY
+			id DESC
+		LIMIT ?
+	`
+
+	attempts := []*LoginAttempt{}
+	err := db.SelectContext(ctx, &attempts, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// RecentSuccessful returns a user's most recent attempts that got past the
+// credential check, newest first. These are what a new login is compared to.
+func (l *LoginAttempt) RecentSuccessful(userID string, limit int) ([]*LoginAttempt, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT
+			*
+		FROM
+			login_attempts
+		WHERE
+			user_id = ?
+			AND outcome IN (?, ?, ?)
+		ORDER BY
+			id DESC
+		LIMIT ?
+	`
+
+	attempts := []*LoginAttempt{}
+	err := db.SelectContext(ctx, &attempts, query, userID, LoginSucceeded, LoginPasswordExpired, LoginStepUpPassed, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return attempts, nil
+}
+
+// LoginChallenge holds back a suspicious login until the user enters the
+// one-time code we sent them. Only SHA-256 hashes of the challenge and the
+// code are stored; the plain text values are only available on the value
+// returned by IssueLoginChallenge.
+type LoginChallenge struct {
+	ID            int        `db:"id"`
+	ChallengeHash []byte     `db:"challenge_hash"`
+	CodeHash      []byte     `db:"code_hash"`
+	UserID        string     `db:"user_id"`
+	Method        string     `db:"method"`
+	Scopes        Scopes     `db:"scopes"`
+	Flags         LoginFlags `db:"flags"`
+	Attempts      int        `db:"attempts"`
+	CreatedAt     time.Time  `db:"created_at"`
+	ExpireAt      time.Time  `db:"expire_at"`
+	Challenge     string     `db:"-"`
+	Code          string     `db:"-"`
+}
+
+// codeHash hashes a code together with its challenge, so equal codes of
+// different challenges do not hash alike
+func codeHash(challengeHash []byte, code string) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, challengeHash...), code...))
+
+	return sum[:]
+}
+
+// IssueLoginChallenge stores a challenge and a six digit code for a login by
+// userID that will get scopes once the code is entered
+func (c *LoginChallenge) IssueLoginChallenge(userID, method string, scopes Scopes, flags LoginFlags) (*LoginChallenge, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	challenge, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return nil, err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	hash := sha256.Sum256([]byte(challenge))
+
+	loginChallenge := &LoginChallenge{
+		ChallengeHash: hash[:],
+		CodeHash:      codeHash(hash[:], code),
+		UserID:        userID,
+		Method:        method,
+		Scopes:        scopes,
+		Flags:         flags,
+		CreatedAt:     time.Now(),
+		ExpireAt:      time.Now().Add(LoginChallengeTTL),
+		Challenge:     challenge,
+		Code:          code,
+	}
+
+	stmt := `
+		INSERT INTO
+			login_challenges (
+				challenge_hash,
+				code_hash,
+				user_id,
+				method,
+				scopes,
+				flags,
+				created_at,
+				expire_at
+			)
+			VALUES (
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?
+			)
+	`
+
+	_, err = db.ExecContext(ctx, stmt,
+		loginChallenge.ChallengeHash,
+		loginChallenge.CodeHash,
+		loginChallenge.UserID,
+		loginChallenge.Method,
+		loginChallenge.Scopes,
+		loginChallenge.Flags,
+		loginChallenge.CreatedAt,
+		loginChallenge.ExpireAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return loginChallenge, nil
+}
+
+// ConsumeLoginChallenge checks code against a plain text challenge. The
+// right code deletes the challenge, so a login can only be completed once. A
+// wrong code counts against the challenge, which is deleted after too many;
+// the challenge is returned along with ErrWrongStepUpCode, so the failure can
+// be recorded against its user. Expired challenges are cleaned up on the way.
+func (c *LoginChallenge) ConsumeLoginChallenge(challenge, code string) (*LoginChallenge, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(challenge))
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT
+			*
+		FROM
+			login_challenges
+		WHERE
+			challenge_hash = ?
+		FOR UPDATE
+	`
+
+	var loginChallenge LoginChallenge
+	err = tx.QueryRowxContext(ctx, query, hash[:]).StructScan(&loginChallenge)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidLoginChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if loginChallenge.ExpireAt.Before(time.Now()) {
+		return nil, ErrInvalidLoginChallenge
+	}
+
+	result := ErrWrongStepUpCode
+	if subtle.ConstantTimeCompare(codeHash(hash[:], code), loginChallenge.CodeHash) == 1 {
+		result = nil
+	}
+
+	stmt := `
+		DELETE FROM
+			login_challenges
+		WHERE
+			id = ? OR expire_at < ?
+	`
+	args := []interface{}{loginChallenge.ID, time.Now()}
+
+	if result != nil && loginChallenge.Attempts+1 < maxStepUpAttempts {
+		stmt = `
+			UPDATE
+				login_challenges
+			SET
+				attempts = attempts + 1
+			WHERE
+				id = ?
+		`
+		args = args[:1]
+	}
+
+	_, err = tx.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return &loginChallenge, result
+}
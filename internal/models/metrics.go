@@ -0,0 +1,45 @@
+package models
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptCost is the work factor passwords are hashed with
+const bcryptCost = 12
+
+// bcryptDuration times bcrypt, which dominates the cost of logins and
+// password changes and grows with bcryptCost
+var bcryptDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "bcrypt_duration_seconds",
+	Help:    "Time spent hashing and comparing passwords with bcrypt.",
+	Buckets: []float64{0.05, 0.1, 0.2, 0.3, 0.5, 0.75, 1, 2},
+}, []string{"operation"})
+
+// RegisterMetrics registers the metrics of the models with reg. Without it
+// they are still kept, but not exposed.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	return reg.Register(bcryptDuration)
+}
+
+// hashPassword hashes a plain text password with bcrypt
+func hashPassword(plainText string) ([]byte, error) {
+	start := time.Now()
+	defer func() {
+		bcryptDuration.WithLabelValues("hash").Observe(time.Since(start).Seconds())
+	}()
+
+	return bcrypt.GenerateFromPassword([]byte(plainText), bcryptCost)
+}
+
+// comparePassword compares a bcrypt hash with a plain text password
+func comparePassword(hash, plainText string) error {
+	start := time.Now()
+	defer func() {
+		bcryptDuration.WithLabelValues("compare").Observe(time.Since(start).Seconds())
+	}()
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plainText))
+}
@@ -8,21 +8,33 @@ import (
 	"encoding/base32"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
+	"github.com/hiroshi-iwashita/20221202_golang/internal/logging"
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/crypto/bcrypt"
 )
 
-const dbTimeout = time.Second * 5
+// dbTimeout bounds every query; see SetDBTimeout
+var dbTimeout = time.Second * 5
 
 var db *sqlx.DB
 var ctx = context.Background()
+var logger = logging.Discard()
+
+// ErrInvalidCurrentPassword is returned by User.ChangePassword when the
+// current password given does not match the stored one
+var ErrInvalidCurrentPassword = errors.New("current password is incorrect")
+
+// UnusablePassword starts the stored password of accounts created with
+// User.InsertWithoutPassword, which only sign in through an external identity
+// provider. Instead of a bcrypt hash the account gets a value no password
+// will ever match.
+const UnusablePassword = "!"
 
 // New is the function used to create an instance of the data package.
 // It returns the type Model, which embeds all of the types we want to
@@ -31,18 +43,46 @@ func New(dbPool *sqlx.DB) Models {
 	db = dbPool
 
 	return Models{
-		User:  User{},
-		Token: Token{},
+		User:              User{},
+		Token:             Token{},
+		APIKey:            APIKey{},
+		OAuthClient:       OAuthClient{},
+		AuthorizationCode: AuthorizationCode{},
+		RefreshToken:      RefreshToken{},
+		FederatedIdentity: FederatedIdentity{},
+		LoginState:        FederatedLoginState{},
+		AuditEvent:        AuditEvent{},
+		LoginAttempt:      LoginAttempt{},
+		LoginChallenge:    LoginChallenge{},
 	}
 }
 
+// SetLogger sets where the models log to; by default they log nothing
+func SetLogger(l *logging.Logger) {
+	logger = l.With("component", "models")
+}
+
+// SetDBTimeout changes how long a query may take
+func SetDBTimeout(timeout time.Duration) {
+	dbTimeout = timeout
+}
+
 // Models is the type for this package. Note that any model that is
 // included as a member in this type is available to us throughout the
 // application, anywhere that the app variable is used, provided that the
 // model is also added in the New function.
 type Models struct {
-	User  User
-	Token Token
+	User              User
+	Token             Token
+	APIKey            APIKey
+	OAuthClient       OAuthClient
+	AuthorizationCode AuthorizationCode
+	RefreshToken      RefreshToken
+	FederatedIdentity FederatedIdentity
+	LoginState        FederatedLoginState
+	AuditEvent        AuditEvent
+	LoginAttempt      LoginAttempt
+	LoginChallenge    LoginChallenge
 }
 
 // define type for NULL from database
@@ -54,32 +94,67 @@ type NullString struct {
 	sql.NullString
 }
 
+// Roles a user can have
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 // User is the structure which holds one user from the database. Note
-// that it embeds a token type.
+// that it embeds a token type, and holds the API key when the user was
+// authenticated with one. Neither the password hash nor the credentials are
+// ever marshalled to JSON; handlers send a view of the user instead.
 type User struct {
-	ID              int       `db:"id" json:"id"`
-	UserID          string    `db:"user_id" json:"user_id" validate:"required"`
-	FirstName       string    `db:"first_name" json:"first_name,omitempty"`
-	LastName        string    `db:"last_name" json:"last_name,omitempty"`
-	Email           string    `db:"email" json:"email,omitempty" validate:"required"`
-	Password        string    `db:"password" json:"password,omitempty" validate:"required"`
-	EmailVerifiedAt NullTime  `db:"email_verified_at" json:"email_verified_at"`
-	CreatedAt       time.Time `db:"created_at" json:"created_at"`
-	UpdatedAt       time.Time `db:"updated_at" json:"updated_at"`
-	DeletedAt       NullTime  `db:"deleted_at" json:"deleted_at"`
-	Token           Token
+	ID                int       `db:"id" json:"id"`
+	UserID            string    `db:"user_id" json:"user_id" validate:"required"`
+	FirstName         string    `db:"first_name" json:"first_name,omitempty"`
+	LastName          string    `db:"last_name" json:"last_name,omitempty"`
+	Email             string    `db:"email" json:"email,omitempty" validate:"required"`
+	Password          string    `db:"password" json:"-" validate:"required"`
+	PasswordChangedAt NullTime  `db:"password_changed_at" json:"password_changed_at"`
+	Role              string    `db:"role" json:"role"`
+	EmailVerifiedAt   NullTime  `db:"email_verified_at" json:"email_verified_at"`
+	CreatedAt         time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt         time.Time `db:"updated_at" json:"updated_at"`
+	DeletedAt         NullTime  `db:"deleted_at" json:"deleted_at"`
+	Token             Token     `json:"-"`
+	APIKey            *APIKey   `db:"-" json:"-"`
+}
+
+// IsAdmin reports whether the user has the admin role
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// ImpersonatedBy returns the user ID of the admin acting as this user, or ""
+// when the user authenticated with their own credentials
+func (u *User) ImpersonatedBy() string {
+	if u.APIKey != nil || !u.Token.ImpersonatorID.Valid {
+		return ""
+	}
+
+	return u.Token.ImpersonatorID.String
 }
 
 // Token is the data structure for any token in the database. Note that
 // we do not send the TokenHash (a slice of bytes) in any exported JSON.
+// A token with PasswordChangeOnly set is handed out when the user's password
+// has expired, and may only be used to change that password. Scopes limit
+// which routes the token can be used for. ClientID is set for access tokens
+// issued to an OAuth client. ImpersonatorID is set on tokens an admin uses to
+// act as the token's user, and holds the admin's user ID.
 type Token struct {
-	ID        int       `db:"id" json:"id"`
-	UserID    string    `db:"user_id" json:"user_id"`
-	Token     string    `db:"token" json:"token"`
-	TokenHash []byte    `db:"-" json:"-"`
-	CreatedAt time.Time `db:"created_at" json:"created_at"`
-	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
-	ExpireAt  time.Time `db:"expire_at" json:"expire_at"`
+	ID                 int        `db:"id" json:"id"`
+	UserID             string     `db:"user_id" json:"user_id"`
+	Token              string     `db:"token" json:"token"`
+	TokenHash          []byte     `db:"token_hash" json:"-"`
+	PasswordChangeOnly bool       `db:"password_change_only" json:"password_change_only"`
+	Scopes             Scopes     `db:"scopes" json:"scopes"`
+	ClientID           NullString `db:"client_id" json:"-"`
+	ImpersonatorID     NullString `db:"impersonator_id" json:"-"`
+	CreatedAt          time.Time  `db:"created_at" json:"created_at"`
+	UpdatedAt          time.Time  `db:"updated_at" json:"updated_at"`
+	ExpireAt           time.Time  `db:"expire_at" json:"expire_at"`
 }
 
 func generateUUID() string {
@@ -90,20 +165,42 @@ func generateUUID() string {
 }
 
 // Insert inserts a new user into the database, and returns the ID of the
-// newly inserted row
+// newly inserted row. The password has to satisfy the password policy.
 func (u *User) Insert(user User) (string, error) {
-	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
-	defer cancel()
+	err := passwordPolicy.Validate(user.Password)
+	if err != nil {
+		return "", err
+	}
 
-	var newID string
+	hashedPassword, err := hashPassword(user.Password)
+	if err != nil {
+		return "", err
+	}
 
-	uuid := generateUUID()
+	return u.insert(user, hashedPassword)
+}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+// InsertWithoutPassword inserts a new user who only signs in through an
+// external identity provider, and returns the ID of the newly inserted row.
+// user.Password is ignored; the account gets a password nothing matches.
+func (u *User) InsertWithoutPassword(user User) (string, error) {
+	random, err := randomString(32)
 	if err != nil {
 		return "", err
 	}
 
+	return u.insert(user, []byte(UnusablePassword+random))
+}
+
+// insert stores user with the given password hash
+func (u *User) insert(user User, hashedPassword []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var newID string
+
+	uuid := generateUUID()
+
 	stmt := `
 		INSERT INTO
 			users
@@ -113,6 +210,7 @@ func (u *User) Insert(user User) (string, error) {
 				last_name,
 				email,
 				password,
+				password_changed_at,
 				created_at,
 				updated_at
 			)
@@ -123,11 +221,12 @@ func (u *User) Insert(user User) (string, error) {
 				?,
 				?,
 				?,
+				?,
 				?
 			)
 	`
 
-	_, err = db.ExecContext(ctx, stmt,
+	_, err := db.ExecContext(ctx, stmt,
 		uuid,
 		user.FirstName,
 		user.LastName,
@@ -135,6 +234,7 @@ func (u *User) Insert(user User) (string, error) {
 		hashedPassword,
 		time.Now(),
 		time.Now(),
+		time.Now(),
 	)
 
 	if err != nil {
@@ -146,12 +246,70 @@ func (u *User) Insert(user User) (string, error) {
 	return newID, nil
 }
 
+// ChangePassword changes the user's password after checking that
+// currentPassword matches the one stored in u.Password. This is what a user
+// changing their own password should go through.
+func (u *User) ChangePassword(currentPassword, newPassword string) error {
+	validPassword, err := u.PasswordMatches(currentPassword)
+	if err != nil {
+		return err
+	}
+	if !validPassword {
+		return ErrInvalidCurrentPassword
+	}
+
+	return u.ResetPassword(newPassword)
+}
+
 // ResetPassword is the method we will use to change a user's password.
+// The new password has to satisfy the password policy, and must not be the
+// one currently stored in u.Password or any of the recent ones kept in the
+// password history. The replaced hash is moved into the password history,
+// which keeps no more hashes than the policy compares.
+// It does not check who is asking; the caller has to have authorized the
+// change already, so prefer ChangePassword for self-service changes.
 func (u *User) ResetPassword(password string) error {
 	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	var previousHashes []string
+	if u.Password != "" {
+		previousHashes = append(previousHashes, u.Password)
+	}
+
+	if passwordPolicy.HistorySize > 1 {
+		history, err := passwordHistory(ctx, u.UserID, passwordPolicy.HistorySize-1)
+		if err != nil {
+			return err
+		}
+		previousHashes = append(previousHashes, history...)
+	}
+
+	err := passwordPolicy.Validate(password, previousHashes...)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if u.Password != "" {
+		err = insertPasswordHistory(ctx, tx, u.UserID, u.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the current password is compared besides the history
+	err = prunePasswordHistory(ctx, tx, u.UserID, passwordPolicy.HistorySize-1)
 	if err != nil {
 		return err
 	}
@@ -160,24 +318,60 @@ func (u *User) ResetPassword(password string) error {
 		UPDATE
 			users
 		SET
-			password = $1
+			password = ?,
+			password_changed_at = ?,
+			updated_at = ?
 		WHERE
-			id = $2
+			user_id = ?
 	`
 
-	_, err = db.ExecContext(ctx, stmt, hashedPassword, u.ID)
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, stmt, hashedPassword, now, now, u.UserID)
 	if err != nil {
 		return err
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	u.Password = string(hashedPassword)
+	u.PasswordChangedAt = NullTime{mysql.NullTime{Time: now, Valid: true}}
+
 	return nil
 }
 
+// PasswordExpired reports whether the user's password is older than maxAge.
+// A maxAge of zero or less means passwords never expire.
+func (u *User) PasswordExpired(maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+
+	changedAt := u.CreatedAt
+	if u.PasswordChangedAt.Valid {
+		changedAt = u.PasswordChangedAt.Time
+	}
+
+	return time.Since(changedAt) > maxAge
+}
+
+// HasUsablePassword reports whether the user can sign in with a local
+// password, which accounts created by an external identity provider cannot
+func (u *User) HasUsablePassword() bool {
+	return !strings.HasPrefix(u.Password, UnusablePassword)
+}
+
 // PasswordMatches uses Go's bcrypt package to compare a user supplied password
 // with the hash we have stored for a given user in the database. If the
 // password and hash match, we return true; otherwise, we return false.
 func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
+	if !u.HasUsablePassword() {
+		return false, nil
+	}
+
+	err := comparePassword(u.Password, plainText)
 	if err != nil {
 		switch {
 		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
@@ -221,7 +415,7 @@ func (u *User) Index() ([]*User, error) {
 	}
 	err = rows.Err()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return users, nil
@@ -287,21 +481,23 @@ func (u *User) Update() error {
 		UPDATE
 			users
 		SET
-			email = $1,
-			first_name = $2,
-			last_name = $3,
-			updated_at = $4
+			email = ?,
+			first_name = ?,
+			last_name = ?,
+			email_verified_at = ?,
+			updated_at = ?
 		WHERE
-			id = $5
+			user_id = ?
 	`
 
-	var user User
+	u.UpdatedAt = time.Now()
 	_, err := db.ExecContext(ctx, stmt,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		time.Now(),
-		&user.ID,
+		u.Email,
+		u.FirstName,
+		u.LastName,
+		u.EmailVerifiedAt,
+		u.UpdatedAt,
+		u.UserID,
 	)
 	if err != nil {
 		return err
@@ -330,6 +526,161 @@ func (u *User) Delete(userID string) error {
 	return nil
 }
 
+// SoftDelete closes the user's account by setting deleted_at, and revokes
+// every token, API key and OAuth refresh token the user holds. The row itself
+// is kept.
+func (u *User) SoftDelete() error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+		UPDATE
+			users
+		SET
+			deleted_at = ?,
+			updated_at = ?
+		WHERE
+			user_id = ?
+	`
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, stmt, now, now, u.UserID)
+	if err != nil {
+		return err
+	}
+
+	err = revokeCredentials(ctx, tx, u.UserID, "")
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	u.DeletedAt = NullTime{mysql.NullTime{Time: now, Valid: true}}
+
+	return nil
+}
+
+// SetRole changes the user's role. When the role actually changes, every
+// token, API key and OAuth refresh token the user holds is revoked, as they
+// carry scopes of the old role.
+func (u *User) SetRole(role string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	if role != RoleUser && role != RoleAdmin {
+		return fmt.Errorf("unknown role %q", role)
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `
+		UPDATE
+			users
+		SET
+			role = ?,
+			updated_at = ?
+		WHERE
+			user_id = ?
+	`
+
+	now := time.Now()
+	_, err = tx.ExecContext(ctx, stmt, role, now, u.UserID)
+	if err != nil {
+		return err
+	}
+
+	if role != u.Role {
+		err = revokeCredentials(ctx, tx, u.UserID, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	u.Role = role
+	u.UpdatedAt = now
+
+	return nil
+}
+
+// revokeCredentials deletes every token, API key and OAuth refresh token a
+// user holds, except the token keepPlainText, which may be empty
+func revokeCredentials(ctx context.Context, tx *sqlx.Tx, userID, keepPlainText string) error {
+	stmt := `
+		DELETE FROM
+			tokens
+		WHERE
+			user_id = ?
+			AND token <> ?
+	`
+
+	_, err := tx.ExecContext(ctx, stmt, userID, keepPlainText)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"api_keys", "oauth_refresh_tokens"} {
+		stmt = `
+			DELETE FROM
+				` + table + `
+			WHERE
+				user_id = ?
+		`
+
+		_, err = tx.ExecContext(ctx, stmt, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Restore reopens an account closed with SoftDelete. Its credentials stay revoked.
+func (u *User) Restore() error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		UPDATE
+			users
+		SET
+			deleted_at = NULL,
+			updated_at = ?
+		WHERE
+			user_id = ?
+	`
+
+	now := time.Now()
+	_, err := db.ExecContext(ctx, stmt, now, u.UserID)
+	if err != nil {
+		return err
+	}
+
+	u.DeletedAt = NullTime{}
+	u.UpdatedAt = now
+
+	return nil
+}
+
 // GetByToken takes a plain text token string, and looks up the full token
 // from the database. It returns a pointer to the Token model.
 func (t *Token) GetByToken(plainText string) (*Token, error) {
@@ -338,7 +689,17 @@ func (t *Token) GetByToken(plainText string) (*Token, error) {
 
 	query := `
 		SELECT
-			*
+			id,
+			user_id,
+			token,
+			token_hash,
+			password_change_only,
+			scopes,
+			client_id,
+			impersonator_id,
+			created_at,
+			updated_at,
+			expire_at
 		FROM
 			tokens
 		WHERE
@@ -369,7 +730,7 @@ func (t *Token) GetUserForToken(token Token) (*User, error) {
 		FROM
 			users
 		WHERE
-			id = ?
+			user_id = ?
 	`
 
 	var user User
@@ -384,9 +745,10 @@ func (t *Token) GetUserForToken(token Token) (*User, error) {
 }
 
 // GenerateToken generates a secure token of exactly 26 characters in length and returns it
-func (t *Token) GenerateToken(userID string, ttl time.Duration) (*Token, error) {
+func (t *Token) GenerateToken(userID string, ttl time.Duration, scopes Scopes) (*Token, error) {
 	token := &Token{
 		UserID:   userID,
+		Scopes:   scopes,
 		ExpireAt: time.Now().Add(ttl),
 	}
 
@@ -443,6 +805,14 @@ func (t *Token) AuthenticateToken(r *http.Request) (*User, error) {
 		return nil, errors.New("no matching user found")
 	}
 
+	// make sure the account has not been closed
+	if user.DeletedAt.Valid {
+		return nil, errors.New("user account is closed")
+	}
+
+	// keep the token on the user, so callers can see how it was authenticated
+	user.Token = *tkn
+
 	return user, nil
 }
 
@@ -451,14 +821,16 @@ func (t *Token) Insert(token Token, u User) error {
 	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	// delete any existing tokens
+	// delete any expired tokens; a user may hold several live tokens at once,
+	// e.g. a read only one for a dashboard next to their own session
 	stmt := `
 		DELETE FROM
 			tokens
 		WHERE
 			user_id = ?
+			AND expire_at < ?
 	`
-	_, err := db.ExecContext(ctx, stmt, token.UserID)
+	_, err := db.ExecContext(ctx, stmt, token.UserID, time.Now())
 	if err != nil {
 		return err
 	}
@@ -471,8 +843,6 @@ func (t *Token) Insert(token Token, u User) error {
 
 	uuid := generateUUID()
 
-	// fmt.Println(token)
-
 	stmt = `
 		INSERT INTO
 			tokens (
@@ -480,6 +850,10 @@ func (t *Token) Insert(token Token, u User) error {
 				user_id,
 				token,
 				token_hash,
+				password_change_only,
+				scopes,
+				client_id,
+				impersonator_id,
 				created_at,
 				updated_at,
 				expire_at
@@ -491,25 +865,25 @@ func (t *Token) Insert(token Token, u User) error {
 				?,
 				?,
 				?,
+				?,
+				?,
+				?,
+				?,
 				?
 			)
 	`
 
 	// _, err = db.NamedExecContext(ctx, stmt, new)
 
-	fmt.Println(uuid)
-	fmt.Println(token.UserID)
-	fmt.Println(token.Token)
-	fmt.Println(token.TokenHash)
-	fmt.Println(time.Now())
-	fmt.Println(time.Now())
-	fmt.Println(token.ExpireAt)
-
 	_, err = db.ExecContext(ctx, stmt,
 		uuid,
 		token.UserID,
 		token.Token,
 		token.TokenHash,
+		token.PasswordChangeOnly,
+		token.Scopes,
+		token.ClientID,
+		token.ImpersonatorID,
 		time.Now(),
 		time.Now(),
 		token.ExpireAt,
@@ -518,6 +892,8 @@ func (t *Token) Insert(token Token, u User) error {
 		return err
 	}
 
+	logger.Debug("token stored", "user_id", token.UserID, "scopes", token.Scopes.String(), "expire_at", token.ExpireAt)
+
 	return nil
 
 	// ctx, cancel := context.WithTimeout(ctx, dbTimeout)
@@ -605,7 +981,8 @@ func (t *Token) DeleteByToken(plainText string) error {
 	return nil
 }
 
-func (t *Token) DeleteTokensForUser(id int) error {
+// DeleteTokensForUser deletes every token belonging to a user
+func (t *Token) DeleteTokensForUser(userID string) error {
 	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
@@ -615,7 +992,7 @@ func (t *Token) DeleteTokensForUser(id int) error {
 		WHERE
 			user_id = ?
 	`
-	_, err := db.ExecContext(ctx, stmt, id)
+	_, err := db.ExecContext(ctx, stmt, userID)
 	if err != nil {
 		return err
 	}
@@ -623,6 +1000,48 @@ func (t *Token) DeleteTokensForUser(id int) error {
 	return nil
 }
 
+// DeleteClientTokensForUser deletes every access token issued to an OAuth
+// client for a user
+func (t *Token) DeleteClientTokensForUser(clientID, userID string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		DELETE FROM
+			tokens
+		WHERE
+			client_id = ?
+			AND user_id = ?
+	`
+	_, err := db.ExecContext(ctx, stmt, clientID, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeOtherCredentialsForUser deletes every token, API key and OAuth
+// refresh token belonging to a user except the plain text token given, which
+// is usually the one used for the current request
+func (t *Token) RevokeOtherCredentialsForUser(userID, keepPlainText string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = revokeCredentials(ctx, tx, userID, keepPlainText)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // ValidToken makes certain that a given token is valid; in order to be valid,
 // the token must exist in the database, the associated user must exist in the
 // database, and the token must not have expired.
@@ -0,0 +1,494 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Lifetimes of the credentials handed out by the OAuth 2.0 endpoints
+const (
+	AuthorizationCodeTTL = 10 * time.Minute
+	OAuthAccessTokenTTL  = time.Hour
+	OAuthRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// PKCEMethodS256 is the only PKCE code challenge method accepted (RFC 7636);
+// plain would send the verifier itself as the challenge
+const PKCEMethodS256 = "S256"
+
+// ErrInvalidGrant is returned when an authorization code or refresh token is
+// unknown, expired, already used or was issued to another client
+var ErrInvalidGrant = errors.New("invalid grant")
+
+// OAuthClient is an application registered to use the OAuth 2.0 endpoints.
+// Confidential clients have a secret, of which only a SHA-256 hash is kept;
+// public clients (SPAs, mobile apps) have none and must use PKCE. The plain
+// text Secret is only set right after the client was generated. Tokens
+// obtained with the client credentials grant act on behalf of UserID, the
+// user who registered the client.
+type OAuthClient struct {
+	ID           int       `db:"id" json:"id"`
+	ClientID     string    `db:"client_id" json:"client_id"`
+	UserID       string    `db:"user_id" json:"user_id"`
+	Name         string    `db:"name" json:"name"`
+	SecretHash   []byte    `db:"secret_hash" json:"-"`
+	RedirectURIs string    `db:"redirect_uris" json:"redirect_uris"`
+	Scopes       Scopes    `db:"scopes" json:"scopes"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt    time.Time `db:"updated_at" json:"updated_at"`
+	Secret       string    `db:"-" json:"-"`
+}
+
+// Confidential reports whether the client authenticates with a secret
+func (c *OAuthClient) Confidential() bool {
+	return len(c.SecretHash) > 0
+}
+
+// RedirectURIList returns the registered redirect URIs
+func (c *OAuthClient) RedirectURIList() []string {
+	return strings.Fields(c.RedirectURIs)
+}
+
+// HasRedirectURI reports whether uri is one of the registered redirect URIs.
+// Redirect URIs are compared exactly, as required for public clients.
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIList() {
+		if registered == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GenerateClient creates a new client owned by userID. It is not saved until
+// Insert is called.
+func (c *OAuthClient) GenerateClient(userID, name string, redirectURIs []string, scopes Scopes, confidential bool) (*OAuthClient, error) {
+	client := &OAuthClient{
+		ClientID:     generateUUID(),
+		UserID:       userID,
+		Name:         name,
+		RedirectURIs: strings.Join(redirectURIs, " "),
+		Scopes:       scopes,
+	}
+
+	if confidential {
+		secret, err := randomString(32)
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256([]byte(secret))
+		client.SecretHash = hash[:]
+		client.Secret = secret
+	}
+
+	return client, nil
+}
+
+// Insert saves a newly generated client
+func (c *OAuthClient) Insert(client *OAuthClient) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		INSERT INTO
+			oauth_clients (
+				client_id,
+				user_id,
+				name,
+				secret_hash,
+				redirect_uris,
+				scopes,
+				created_at,
+				updated_at
+			)
+			VALUES (
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?
+			)
+	`
+
+	client.CreatedAt = time.Now()
+	client.UpdatedAt = client.CreatedAt
+
+	result, err := db.ExecContext(ctx, stmt,
+		client.ClientID,
+		client.UserID,
+		client.Name,
+		client.SecretHash,
+		client.RedirectURIs,
+		client.Scopes,
+		client.CreatedAt,
+		client.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	client.ID = int(id)
+
+	return nil
+}
+
+// ShowByClientID returns one client by its client_id
+func (c *OAuthClient) ShowByClientID(clientID string) (*OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		SELECT
+			*
+		FROM
+			oauth_clients
+		WHERE
+			client_id = ?
+	`
+
+	var client OAuthClient
+	row := db.QueryRowxContext(ctx, query, clientID)
+
+	err := row.StructScan(&client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+// Authenticate looks up a client and checks its secret. Public clients pass
+// with an empty secret; confidential clients must present the right one.
+func (c *OAuthClient) Authenticate(clientID, secret string) (*OAuthClient, error) {
+	client, err := c.ShowByClientID(clientID)
+	if err != nil {
+		return nil, errors.New("unknown client")
+	}
+
+	if !client.Confidential() {
+		if secret != "" {
+			return nil, errors.New("public clients have no secret")
+		}
+		return client, nil
+	}
+
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], client.SecretHash) != 1 {
+		return nil, errors.New("invalid client secret")
+	}
+
+	return client, nil
+}
+
+// AuthorizationCode is a short lived, single use code issued by the
+// authorization endpoint and exchanged for tokens at the token endpoint.
+// Only a SHA-256 hash of the code is stored.
+type AuthorizationCode struct {
+	ID                  int       `db:"id"`
+	CodeHash            []byte    `db:"code_hash"`
+	ClientID            string    `db:"client_id"`
+	UserID              string    `db:"user_id"`
+	RedirectURI         string    `db:"redirect_uri"`
+	Scopes              Scopes    `db:"scopes"`
+	CodeChallenge       string    `db:"code_challenge"`
+	CodeChallengeMethod string    `db:"code_challenge_method"`
+	Nonce               string    `db:"nonce"`
+	CreatedAt           time.Time `db:"created_at"`
+	ExpireAt            time.Time `db:"expire_at"`
+}
+
+// IssueAuthorizationCode stores a new code for the given grant and returns
+// the plain text code to hand to the client
+func (a *AuthorizationCode) IssueAuthorizationCode(code AuthorizationCode) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	plainText, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(plainText))
+
+	stmt := `
+		INSERT INTO
+			oauth_authorization_codes (
+				code_hash,
+				client_id,
+				user_id,
+				redirect_uri,
+				scopes,
+				code_challenge,
+				code_challenge_method,
+				nonce,
+				created_at,
+				expire_at
+			)
+			VALUES (
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?,
+				?
+			)
+	`
+
+	_, err = db.ExecContext(ctx, stmt,
+		hash[:],
+		code.ClientID,
+		code.UserID,
+		code.RedirectURI,
+		code.Scopes,
+		code.CodeChallenge,
+		code.CodeChallengeMethod,
+		code.Nonce,
+		time.Now(),
+		time.Now().Add(AuthorizationCodeTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return plainText, nil
+}
+
+// ConsumeAuthorizationCode looks up a plain text code issued to clientID and
+// deletes it, so that it can only ever be exchanged once
+func (a *AuthorizationCode) ConsumeAuthorizationCode(plainText, clientID string) (*AuthorizationCode, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(plainText))
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT
+			*
+		FROM
+			oauth_authorization_codes
+		WHERE
+			code_hash = ?
+		FOR UPDATE
+	`
+
+	var code AuthorizationCode
+	err = tx.QueryRowxContext(ctx, query, hash[:]).StructScan(&code)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := `
+		DELETE FROM
+			oauth_authorization_codes
+		WHERE
+			id = ?
+	`
+
+	_, err = tx.ExecContext(ctx, stmt, code.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	if code.ClientID != clientID || code.ExpireAt.Before(time.Now()) {
+		return nil, ErrInvalidGrant
+	}
+
+	return &code, nil
+}
+
+// VerifyPKCE checks a code verifier against the challenge sent with the
+// authorization request (RFC 7636 section 4.6)
+func (a *AuthorizationCode) VerifyPKCE(verifier string) bool {
+	if a.CodeChallenge == "" {
+		return verifier == ""
+	}
+
+	var computed string
+	switch a.CodeChallengeMethod {
+	case PKCEMethodS256:
+		sum := sha256.Sum256([]byte(verifier))
+		computed = base64.RawURLEncoding.EncodeToString(sum[:])
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(a.CodeChallenge)) == 1
+}
+
+// RefreshToken lets a client obtain new access tokens without the user being
+// involved again. Only a SHA-256 hash is stored, and every use rotates it.
+type RefreshToken struct {
+	ID        int       `db:"id"`
+	TokenHash []byte    `db:"token_hash"`
+	ClientID  string    `db:"client_id"`
+	UserID    string    `db:"user_id"`
+	Scopes    Scopes    `db:"scopes"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpireAt  time.Time `db:"expire_at"`
+}
+
+// IssueRefreshToken stores a new refresh token and returns its plain text
+func (rt *RefreshToken) IssueRefreshToken(clientID, userID string, scopes Scopes) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	plainText, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(plainText))
+
+	stmt := `
+		INSERT INTO
+			oauth_refresh_tokens (
+				token_hash,
+				client_id,
+				user_id,
+				scopes,
+				created_at,
+				expire_at
+			)
+			VALUES (
+				?,
+				?,
+				?,
+				?,
+				?,
+				?
+			)
+	`
+
+	_, err = db.ExecContext(ctx, stmt,
+		hash[:],
+		clientID,
+		userID,
+		scopes,
+		time.Now(),
+		time.Now().Add(OAuthRefreshTokenTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return plainText, nil
+}
+
+// ShowByRefreshToken returns one refresh token by its plain text
+func (rt *RefreshToken) ShowByRefreshToken(plainText string) (*RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(plainText))
+
+	query := `
+		SELECT
+			*
+		FROM
+			oauth_refresh_tokens
+		WHERE
+			token_hash = ?
+	`
+
+	var token RefreshToken
+	err := db.QueryRowxContext(ctx, query, hash[:]).StructScan(&token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// ConsumeRefreshToken looks up a plain text refresh token issued to clientID
+// and deletes it; the caller is expected to issue a new one in its place
+func (rt *RefreshToken) ConsumeRefreshToken(plainText, clientID string) (*RefreshToken, error) {
+	token, err := rt.ShowByRefreshToken(plainText)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.ClientID != clientID || token.ExpireAt.Before(time.Now()) {
+		return nil, ErrInvalidGrant
+	}
+
+	err = rt.DeleteRefreshToken(token.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// DeleteRefreshToken deletes one refresh token, by ID
+func (rt *RefreshToken) DeleteRefreshToken(id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		DELETE FROM
+			oauth_refresh_tokens
+		WHERE
+			id = ?
+	`
+
+	result, err := db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	// a concurrent request already rotated this token
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidGrant
+	}
+
+	return nil
+}
+
+// randomString returns n random bytes encoded as unpadded url safe base64
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
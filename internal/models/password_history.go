@@ -0,0 +1,103 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// passwordHistory returns up to limit of the user's previous password
+// hashes, newest first
+func passwordHistory(ctx context.Context, userID string, limit int) ([]string, error) {
+	query := `
+		SELECT
+			password
+		FROM
+			password_history
+		WHERE
+			user_id = ?
+		ORDER BY
+			created_at DESC
+		LIMIT ?
+	`
+
+	var hashes []string
+	err := db.SelectContext(ctx, &hashes, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// insertPasswordHistory records a password hash the user is moving away from
+func insertPasswordHistory(ctx context.Context, tx *sqlx.Tx, userID, hash string) error {
+	stmt := `
+		INSERT INTO
+			password_history (
+				user_id,
+				password,
+				created_at
+			)
+			VALUES (
+				?,
+				?,
+				?
+			)
+	`
+
+	_, err := tx.ExecContext(ctx, stmt, userID, hash, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// prunePasswordHistory deletes all but the newest keep of the user's previous
+// password hashes; older ones are never compared, so there is no reason to
+// hold on to them
+func prunePasswordHistory(ctx context.Context, tx *sqlx.Tx, userID string, keep int) error {
+	if keep < 0 {
+		keep = 0
+	}
+
+	query := `
+		SELECT
+			id
+		FROM
+			password_history
+		WHERE
+			user_id = ?
+		ORDER BY
+			id DESC
+		LIMIT 1 OFFSET ?
+	`
+
+	var newestStale int
+	err := tx.GetContext(ctx, &newestStale, query, userID, keep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stmt := `
+		DELETE FROM
+			password_history
+		WHERE
+			user_id = ?
+			AND id <= ?
+	`
+
+	_, err = tx.ExecContext(ctx, stmt, userID, newestStale)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
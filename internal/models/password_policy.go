@@ -0,0 +1,236 @@
+package models
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// bcryptMaxBytes is the number of bytes bcrypt actually looks at; anything
+// after that is silently ignored, so we refuse longer passwords instead
+const bcryptMaxBytes = 72
+
+// PasswordPolicy describes the rules a new password has to satisfy. MaxAge
+// is how long a password may be used before it has to be changed; zero means
+// passwords never expire.
+type PasswordPolicy struct {
+	MinLength      int
+	MaxLength      int
+	RequireUpper   bool
+	RequireLower   bool
+	RequireDigit   bool
+	RequireSymbol  bool
+	HistorySize    int
+	MaxAge         time.Duration
+	BreachedHashes *BreachedPasswords
+}
+
+// DefaultPasswordPolicy returns the policy used when nothing else is configured
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{
+		MinLength:    8,
+		MaxLength:    bcryptMaxBytes,
+		RequireUpper: true,
+		RequireLower: true,
+		RequireDigit: true,
+		HistorySize:  5,
+	}
+}
+
+var passwordPolicy = DefaultPasswordPolicy()
+
+// SetPasswordPolicy replaces the policy enforced by User.Insert and
+// User.ResetPassword
+func SetPasswordPolicy(p PasswordPolicy) {
+	if p.MaxLength <= 0 || p.MaxLength > bcryptMaxBytes {
+		p.MaxLength = bcryptMaxBytes
+	}
+
+	passwordPolicy = p
+}
+
+// CurrentPasswordPolicy returns the policy currently being enforced
+func CurrentPasswordPolicy() PasswordPolicy {
+	return passwordPolicy
+}
+
+// PasswordViolation is one reason a password was rejected
+type PasswordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError is returned when a password does not satisfy the policy.
+// It holds every violation found, so the client can show them all at once.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Message)
+	}
+
+	return "password does not satisfy the password policy: " + strings.Join(messages, ", ")
+}
+
+func (e *PasswordPolicyError) add(code, message string) {
+	e.Violations = append(e.Violations, PasswordViolation{Code: code, Message: message})
+}
+
+// Validate checks a plain text password against the policy. previousHashes
+// are bcrypt hashes of the user's recent passwords, newest first; only the
+// first HistorySize of them are looked at.
+func (p PasswordPolicy) Validate(plainText string, previousHashes ...string) error {
+	policyErr := &PasswordPolicyError{}
+
+	if len([]rune(plainText)) < p.MinLength {
+		policyErr.add("too_short", fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	}
+
+	maxLength := p.MaxLength
+	if maxLength <= 0 || maxLength > bcryptMaxBytes {
+		maxLength = bcryptMaxBytes
+	}
+	if len(plainText) > maxLength {
+		policyErr.add("too_long", fmt.Sprintf("must be at most %d bytes long", maxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range plainText {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+
+	if p.RequireUpper && !hasUpper {
+		policyErr.add("missing_upper", "must contain an upper case letter")
+	}
+	if p.RequireLower && !hasLower {
+		policyErr.add("missing_lower", "must contain a lower case letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		policyErr.add("missing_digit", "must contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		policyErr.add("missing_symbol", "must contain a symbol")
+	}
+
+	if p.BreachedHashes != nil && p.BreachedHashes.Contains(plainText) {
+		policyErr.add("breached", "has appeared in a known data breach")
+	}
+
+	if p.HistorySize > 0 {
+		if len(previousHashes) > p.HistorySize {
+			previousHashes = previousHashes[:p.HistorySize]
+		}
+		for _, hash := range previousHashes {
+			if comparePassword(hash, plainText) == nil {
+				policyErr.add("reused", fmt.Sprintf("must not be one of your last %d passwords", p.HistorySize))
+				break
+			}
+		}
+	}
+
+	if len(policyErr.Violations) > 0 {
+		return policyErr
+	}
+
+	return nil
+}
+
+// BreachedPasswords is a set of SHA-1 hashes of known breached passwords,
+// bucketed by the first five hex characters of the hash in the same way as
+// the k-anonymity range API of Have I Been Pwned
+type BreachedPasswords struct {
+	ranges map[string]map[string]struct{}
+}
+
+// LoadBreachedPasswords reads a breached password list from disk. Each line is
+// an upper or lower case hex SHA-1 hash, optionally followed by ":count" as in
+// the Pwned Passwords downloads; blank lines and lines starting with # are
+// ignored.
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &BreachedPasswords{ranges: make(map[string]map[string]struct{})}
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hash, _, _ := strings.Cut(line, ":")
+		hash = strings.ToUpper(hash)
+		if len(hash) != sha1.Size*2 {
+			return nil, fmt.Errorf("%s:%d: invalid sha1 hash", path, lineNumber)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid sha1 hash", path, lineNumber)
+		}
+
+		b.add(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *BreachedPasswords) add(hash string) {
+	prefix, suffix := hash[:5], hash[5:]
+
+	bucket, ok := b.ranges[prefix]
+	if !ok {
+		bucket = make(map[string]struct{})
+		b.ranges[prefix] = bucket
+	}
+	bucket[suffix] = struct{}{}
+}
+
+// Contains reports whether the plain text password is in the breached list
+func (b *BreachedPasswords) Contains(plainText string) bool {
+	sum := sha1.Sum([]byte(plainText))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	bucket, ok := b.ranges[hash[:5]]
+	if !ok {
+		return false
+	}
+
+	_, found := bucket[hash[5:]]
+	return found
+}
+
+// Len returns the number of hashes in the list
+func (b *BreachedPasswords) Len() int {
+	n := 0
+	for _, bucket := range b.ranges {
+		n += len(bucket)
+	}
+
+	return n
+}
@@ -0,0 +1,158 @@
+package models
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// violationCodes returns the codes of the violations in err, or nil
+func violationCodes(t *testing.T, err error) []string {
+	t.Helper()
+
+	if err == nil {
+		return nil
+	}
+
+	var policyErr *PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("err = %v, want a *PasswordPolicyError", err)
+	}
+
+	var codes []string
+	for _, v := range policyErr.Violations {
+		codes = append(codes, v.Code)
+	}
+
+	return codes
+}
+
+func writeBreachedList(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func sha1Hex(plainText string) string {
+	sum := sha1.Sum([]byte(plainText))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	breached, err := LoadBreachedPasswords(writeBreachedList(t, sha1Hex("Passw0rdPassw0rd")+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := func(plainText string) string {
+		hashed, err := hashPassword(plainText)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(hashed)
+	}
+	previous, older := hash("0ldPassword1"), hash("0lderPassword1")
+
+	strict := DefaultPasswordPolicy()
+	strict.RequireSymbol = true
+	strict.HistorySize = 1
+	strict.BreachedHashes = breached
+
+	lastOnly := DefaultPasswordPolicy()
+	lastOnly.HistorySize = 1
+
+	tests := []struct {
+		name      string
+		policy    PasswordPolicy
+		password  string
+		previous  []string
+		violation []string
+	}{
+		{name: "satisfies the default", policy: DefaultPasswordPolicy(), password: "Corr3ctHorse"},
+		{name: "too short", policy: DefaultPasswordPolicy(), password: "Sh0rt", violation: []string{"too_short"}},
+		{name: "length counts characters", policy: DefaultPasswordPolicy(), password: "Ünïcödé1"},
+		{name: "too long for bcrypt", policy: DefaultPasswordPolicy(), password: "Aa1" + strings.Repeat("x", 70), violation: []string{"too_long"}},
+		{
+			name:      "every violation at once",
+			policy:    strict,
+			password:  "short",
+			violation: []string{"too_short", "missing_upper", "missing_digit", "missing_symbol"},
+		},
+		{name: "breached", policy: strict, password: "Passw0rdPassw0rd", violation: []string{"missing_symbol", "breached"}},
+		{name: "reused", policy: strict, password: "0ldPassword1", previous: []string{previous}, violation: []string{"missing_symbol", "reused"}},
+		{name: "reused within the history", policy: DefaultPasswordPolicy(), password: "0lderPassword1", previous: []string{previous, older}, violation: []string{"reused"}},
+		{name: "beyond the history size", policy: lastOnly, password: "0lderPassword1", previous: []string{previous, older}},
+		{name: "no history kept", policy: PasswordPolicy{MinLength: 1}, password: "0ldPassword1", previous: []string{previous}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := violationCodes(t, tt.policy.Validate(tt.password, tt.previous...))
+			if !reflect.DeepEqual(got, tt.violation) {
+				t.Fatalf("violations = %v, want %v", got, tt.violation)
+			}
+		})
+	}
+}
+
+func TestLoadBreachedPasswords(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		len      int
+		contains []string
+		invalid  bool
+	}{
+		{
+			name:     "hashes with counts, any case",
+			content:  "# Pwned Passwords\n" + strings.ToUpper(sha1Hex("password")) + ":3861493\n\n" + sha1Hex("letmein") + "\n",
+			len:      2,
+			contains: []string{"password", "letmein"},
+		},
+		{name: "empty", content: "", len: 0},
+		{name: "too short", content: "5BAA6:12\n", invalid: true},
+		{name: "not hex", content: strings.Repeat("z", 40) + "\n", invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breached, err := LoadBreachedPasswords(writeBreachedList(t, tt.content))
+			if tt.invalid {
+				if err == nil {
+					t.Fatal("loaded an invalid list")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if breached.Len() != tt.len {
+				t.Fatalf("Len() = %d, want %d", breached.Len(), tt.len)
+			}
+			for _, plainText := range tt.contains {
+				if !breached.Contains(plainText) {
+					t.Errorf("%q is not in the list", plainText)
+				}
+			}
+			if breached.Contains("Corr3ctHorseBattery") {
+				t.Error("a password not in the list is")
+			}
+		})
+	}
+
+	if _, err := LoadBreachedPasswords(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Fatal("loaded a missing file")
+	}
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"context"
+)
+
+// SchemaVersion is the migration the models are written against. Bump it
+// with every new migration in build/db/migrations.
+const SchemaVersion = 15
+
+// SchemaMigration is the schema version recorded by the migrate tool. A
+// dirty version is one whose migration failed half way.
+type SchemaMigration struct {
+	Version int64 `db:"version"`
+	Dirty   bool  `db:"dirty"`
+}
+
+// Ping checks that the database answers
+func Ping(ctx context.Context) error {
+	return db.PingContext(ctx)
+}
+
+// CurrentSchemaMigration returns the schema version the database is at
+func CurrentSchemaMigration(ctx context.Context) (*SchemaMigration, error) {
+	query := `
+		SELECT
+			version,
+			dirty
+		FROM
+			schema_migrations
+		LIMIT 1
+	`
+
+	var migration SchemaMigration
+	err := db.GetContext(ctx, &migration, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &migration, nil
+}
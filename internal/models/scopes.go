@@ -0,0 +1,134 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Scopes understood by the api. A token or API key can only ever carry a
+// subset of the scopes its user is allowed to have.
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+	ScopeAdmin      = "admin"
+
+	// ScopeSCIM lets an identity provider push users through /scim/v2. It
+	// is only honoured on API keys.
+	ScopeSCIM = "scim"
+
+	// OpenID Connect scopes
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// AllowedScopes returns every scope the user may be granted. Everybody can
+// read and write their own account and sign in to other apps with OpenID
+// Connect; only admins get the admin and scim scopes.
+func (u *User) AllowedScopes() Scopes {
+	scopes := Scopes{ScopeUsersRead, ScopeUsersWrite, ScopeOpenID, ScopeProfile, ScopeEmail}
+	if u.IsAdmin() {
+		scopes = append(scopes, ScopeAdmin, ScopeSCIM)
+	}
+
+	return ParseScopes(scopes.String())
+}
+
+// GrantedScopes returns the scopes of the credential the user authenticated
+// with, whether that was a token or an API key, leaving out any the user is
+// no longer allowed, e.g. the admin scopes of a demoted admin
+func (u *User) GrantedScopes() Scopes {
+	granted := u.Token.Scopes
+	if u.APIKey != nil {
+		granted = u.APIKey.Scopes
+	}
+
+	return granted.Intersect(u.AllowedScopes())
+}
+
+// Scopes is a set of permission names such as "users:read". It is stored in
+// the database as a space separated string, the same way OAuth writes them.
+type Scopes []string
+
+// ParseScopes splits a space or comma separated list of scopes, dropping
+// duplicates and empty entries
+func ParseScopes(s string) Scopes {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+
+	seen := make(map[string]bool, len(fields))
+	var scopes Scopes
+	for _, f := range fields {
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		scopes = append(scopes, f)
+	}
+	sort.Strings(scopes)
+
+	return scopes
+}
+
+// Has reports whether scope is in the set
+func (s Scopes) Has(scope string) bool {
+	for _, v := range s {
+		if v == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Contains reports whether every scope in other is also in s
+func (s Scopes) Contains(other Scopes) bool {
+	for _, scope := range other {
+		if !s.Has(scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Intersect returns the scopes that are in both s and other
+func (s Scopes) Intersect(other Scopes) Scopes {
+	var scopes Scopes
+	for _, scope := range s {
+		if other.Has(scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return scopes
+}
+
+// String returns the scopes as a space separated list
+func (s Scopes) String() string {
+	return strings.Join(s, " ")
+}
+
+// Value implements driver.Valuer
+func (s Scopes) Value() (driver.Value, error) {
+	return s.String(), nil
+}
+
+// Scan implements sql.Scanner
+func (s *Scopes) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*s = nil
+	case []byte:
+		*s = ParseScopes(string(v))
+	case string:
+		*s = ParseScopes(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Scopes", src)
+	}
+
+	return nil
+}
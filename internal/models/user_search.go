@@ -0,0 +1,104 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Fields users can be searched by
+const (
+	UserFieldUserID    = "user_id"
+	UserFieldEmail     = "email"
+	UserFieldFirstName = "first_name"
+	UserFieldLastName  = "last_name"
+)
+
+// Operators a UserFilter can compare with
+const (
+	FilterEqual      = "eq"
+	FilterContains   = "co"
+	FilterStartsWith = "sw"
+)
+
+// UserFilter is one condition of a user search, such as email eq "a@b.c"
+type UserFilter struct {
+	Field    string
+	Operator string
+	Value    string
+}
+
+// userSearchFields maps the fields that may be filtered on to their columns.
+// Nothing outside this list ever ends up in a query.
+var userSearchFields = map[string]string{
+	UserFieldUserID:    "user_id",
+	UserFieldEmail:     "email",
+	UserFieldFirstName: "first_name",
+	UserFieldLastName:  "last_name",
+}
+
+// condition returns the SQL condition and argument for the filter
+func (f UserFilter) condition() (string, interface{}, error) {
+	column, ok := userSearchFields[f.Field]
+	if !ok {
+		return "", nil, fmt.Errorf("cannot filter users by %q", f.Field)
+	}
+
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(f.Value)
+
+	switch f.Operator {
+	case FilterEqual:
+		return column + " = ?", f.Value, nil
+	case FilterContains:
+		return column + " LIKE ?", "%" + escaped + "%", nil
+	case FilterStartsWith:
+		return column + " LIKE ?", escaped + "%", nil
+	default:
+		return "", nil, fmt.Errorf("unsupported filter operator %q", f.Operator)
+	}
+}
+
+// Search returns the users matching every one of filters, closed accounts
+// included, ordered by creation. offset and limit page through the matches;
+// the total number of matches is returned as well.
+func (u *User) Search(filters []UserFilter, offset, limit int) ([]*User, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	where := "1 = 1"
+	var args []interface{}
+	for _, f := range filters {
+		condition, arg, err := f.condition()
+		if err != nil {
+			return nil, 0, err
+		}
+		where += " AND " + condition
+		args = append(args, arg)
+	}
+
+	var total int
+	err := db.GetContext(ctx, &total, `SELECT COUNT(*) FROM users WHERE `+where, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT
+			*
+		FROM
+			users
+		WHERE
+			` + where + `
+		ORDER BY
+			id
+		LIMIT ? OFFSET ?
+	`
+
+	users := []*User{}
+	err = db.SelectContext(ctx, &users, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
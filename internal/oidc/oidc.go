@@ -0,0 +1,178 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+)
+
+// Algorithm is the only signing algorithm we issue ID tokens with
+const Algorithm = "RS256"
+
+// Signer signs ID tokens with an RSA key, and publishes the public half of
+// that key as a JSON Web Key Set
+type Signer struct {
+	key   *rsa.PrivateKey
+	keyID string
+}
+
+// NewSigner wraps an RSA private key. The key ID is derived from the public
+// key, so it stays the same across restarts as long as the key does.
+func NewSigner(key *rsa.PrivateKey) (*Signer, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	return &Signer{
+		key:   key,
+		keyID: base64.RawURLEncoding.EncodeToString(sum[:12]),
+	}, nil
+}
+
+// LoadSigner reads a PEM encoded RSA private key, in PKCS #1 or PKCS #8 form
+func LoadSigner(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewSigner(key)
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("signing key must be an RSA key")
+		}
+		return NewSigner(key)
+	default:
+		return nil, errors.New("unsupported PEM block " + block.Type)
+	}
+}
+
+// GenerateSigner creates a signer with a fresh key. ID tokens signed with it
+// cannot be verified after a restart, so this is only meant for development.
+func GenerateSigner() (*Signer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSigner(key)
+}
+
+// Sign returns claims as a compact serialized, RS256 signed JWT
+func (s *Signer) Sign(claims interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{
+		"alg": Algorithm,
+		"typ": "JWT",
+		"kid": s.keyID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// JWK is a public RSA key in JSON Web Key form (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKSet is what the jwks_uri serves
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public key relying parties verify ID tokens with
+func (s *Signer) JWKS() JWKSet {
+	pub := s.key.PublicKey
+
+	return JWKSet{
+		Keys: []JWK{
+			{
+				Kty: "RSA",
+				Use: "sig",
+				Alg: Algorithm,
+				Kid: s.keyID,
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			},
+		},
+	}
+}
+
+// IDTokenClaims are the claims of an ID token. The subject and the standard
+// claims about the user come from the embedded UserInfo.
+type IDTokenClaims struct {
+	Issuer    string `json:"iss"`
+	Audience  string `json:"aud"`
+	ExpiresAt int64  `json:"exp"`
+	IssuedAt  int64  `json:"iat"`
+	Nonce     string `json:"nonce,omitempty"`
+	AtHash    string `json:"at_hash,omitempty"`
+	UserInfo
+}
+
+// UserInfo holds the standard claims about the end user, as served by the
+// userinfo endpoint and embedded in ID tokens. Everything but the subject is
+// only filled in when the matching scope was granted.
+type UserInfo struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified *bool  `json:"email_verified,omitempty"`
+	Name          string `json:"name,omitempty"`
+	GivenName     string `json:"given_name,omitempty"`
+	FamilyName    string `json:"family_name,omitempty"`
+	UpdatedAt     int64  `json:"updated_at,omitempty"`
+}
+
+// AccessTokenHash computes the at_hash claim for an access token: the left
+// half of its SHA-256 hash, base64url encoded (OpenID Connect Core 3.1.3.6)
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}